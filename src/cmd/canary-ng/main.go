@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/ovh/canary-ng/internal"
 
@@ -31,6 +36,7 @@ func main() {
 	debug := flag.Bool("debug", false, "print even more logs")
 	version := flag.Bool("version", false, "print version")
 	configFile := flag.String("config", AppName+".yaml", "configuration file name")
+	watchConfig := flag.Bool("watch-config", false, "reload configuration when the file changes")
 	flag.Parse()
 
 	if *version {
@@ -94,30 +100,91 @@ func main() {
 	reg := prometheus.NewRegistry()
 	metrics := internal.NewMetrics(reg, config)
 
-	for _, jobConfig := range config.Jobs {
-		if jobConfig.HostsDiscovery.Type != "" {
-			dm := internal.NewDiscoveryManager(jobConfig, metrics, config.QueryLabels, config.JobLabelName)
-			go dm.Run()
-			continue
+	// Cancelled on SIGINT or SIGTERM to stop every job and discovery manager
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Split discovered hosts with the other instances when sharding
+	sharder, err := internal.NewSharder(config.Sharding)
+	if err != nil {
+		slog.Error("could not create sharding", slog.Any("error", err))
+		os.Exit(1)
+	}
+	if sharder != nil {
+		go sharder.Run(ctx)
+	}
+
+	manager := internal.NewJobManager(config, metrics, sharder)
+	if err = manager.Reconcile(ctx, config.Jobs); err != nil {
+		slog.Error("could not start every job", slog.Any("error", err))
+	}
+
+	// Reload configuration on SIGHUP and, if enabled, when the file changes
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	changed := make(chan struct{}, 1)
+	if *watchConfig {
+		if err = internal.WatchFile(ctx, *configFile, changed); err != nil {
+			slog.Error("could not watch configuration file", slog.Any("error", err))
+			os.Exit(1)
 		}
+	}
 
-		jobs, err := internal.NewJobs(jobConfig, metrics, config.QueryLabels, config.JobLabelName)
-		if err != nil {
-			slog.Error("could not create job", slog.Any("job", jobConfig.Name), slog.Any("error", err))
-			continue
+	slog.Info(fmt.Sprintf("serving to %s%s", config.ListenAddr, config.Route))
+
+	mux := http.NewServeMux()
+	mux.Handle(config.Route, promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	mux.Handle(config.ProbeRoute, internal.ProbeHandler(manager))
+	server := &http.Server{Addr: config.ListenAddr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("could not listen and serve", slog.Any("error", err))
+			os.Exit(1)
 		}
-		for _, j := range jobs {
-			go j.Run(nil)
+	}()
+
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case <-hup:
+			reload(ctx, manager, *configFile)
+		case <-changed:
+			reload(ctx, manager, *configFile)
 		}
 	}
+	stop()
+	slog.Info("shutting down", slog.Int("timeout", config.ShutdownTimeout))
+
+	// Let in-flight measurements complete within the grace period, then stop
+	// serving metrics so the last results can still be scraped meanwhile
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		manager.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		slog.Info("all jobs stopped")
+	case <-shutdownCtx.Done():
+		slog.Warn("shutdown timeout reached before all jobs stopped")
+	}
 
-	slog.Info(fmt.Sprintf("serving to %s%s", config.ListenAddr, config.Route))
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("could not shut down http server", slog.Any("error", err))
+	}
+}
 
-	http.Handle(config.Route, promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
-	if err = http.ListenAndServe(config.ListenAddr, nil); err != nil {
-		slog.Error("could not listen and serve", slog.Any("error", err))
-		os.Exit(1)
+func reload(ctx context.Context, manager *internal.JobManager, configFile string) {
+	slog.Info("reloading configuration", slog.String("file", configFile))
+	if err := manager.Reload(ctx, configFile); err != nil {
+		slog.Error("could not reload configuration", slog.Any("error", err))
+		return
 	}
+	slog.Info("configuration reloaded")
 }
 
 func showVersion() {
@@ -1,15 +1,36 @@
 package discover
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/ovh/canary-ng/utils"
 )
 
 const (
-	CONSUL_ADDRESS = "127.0.0.1:8500"
+	CONSUL_ADDRESS              = "127.0.0.1:8500"
+	CONSUL_WATCH_RETRY_INTERVAL = 5 * time.Second
+
+	// Metadata labels of the targets, named as in Prometheus
+	CONSUL_NODE_LABEL                    = "__meta_consul_node"
+	CONSUL_ADDRESS_LABEL                 = "__meta_consul_address"
+	CONSUL_DATACENTER_LABEL              = "__meta_consul_dc"
+	CONSUL_METADATA_LABEL_PREFIX         = "__meta_consul_metadata_"
+	CONSUL_SERVICE_LABEL                 = "__meta_consul_service"
+	CONSUL_SERVICE_ID_LABEL              = "__meta_consul_service_id"
+	CONSUL_SERVICE_ADDRESS_LABEL         = "__meta_consul_service_address"
+	CONSUL_SERVICE_PORT_LABEL            = "__meta_consul_service_port"
+	CONSUL_SERVICE_METADATA_LABEL_PREFIX = "__meta_consul_service_metadata_"
+	CONSUL_TAGS_LABEL                    = "__meta_consul_tags"
+	CONSUL_TAG_SEPARATOR                 = ","
 )
 
 type ConsulOpts struct {
@@ -21,17 +42,25 @@ type ConsulOpts struct {
 	Scheme      string
 	SkipVerify  bool
 	Datacenter  string
+	Service     string
+	Tags        []string
+	PassingOnly bool
 }
 
 type Consul struct {
 	nodeMeta    map[string]string
 	returnMetas []string
+	service     string
+	tags        []string
+	passingOnly bool
 	clients     []*api.Client
+	transport   *http.Transport // shared by the clients
 }
 
 func NewConsul(opts ConsulOpts) (*Consul, error) {
-	// Used only at startup, the connection doesn't need to be in a pool to be reused
-	config := api.DefaultNonPooledConfig()
+	// Blocking queries are sent for the whole lifetime of the process, their
+	// connections are kept in a pool to be reused by the next queries
+	config := api.DefaultConfig()
 
 	if len(opts.Addresses) == 0 {
 		opts.Addresses = []string{CONSUL_ADDRESS}
@@ -73,43 +102,175 @@ func NewConsul(opts ConsulOpts) (*Consul, error) {
 	return &Consul{
 		nodeMeta:    opts.NodeMeta,
 		returnMetas: returnMetas,
+		service:     opts.Service,
+		tags:        opts.Tags,
+		passingOnly: opts.PassingOnly,
 		clients:     clients,
+		transport:   config.Transport,
 	}, nil
 }
 
-func (c *Consul) Discover() (hosts []string, err error) {
-	var ok bool
-	var nodes []*api.Node
+// Close closes the idle connections of the pool
+func (c *Consul) Close() {
+	c.transport.CloseIdleConnections()
+}
+
+func (c *Consul) Discover() (targets []Target, err error) {
+	targets, _, err = c.query(&api.QueryOptions{NodeMeta: c.nodeMeta})
+	if err != nil {
+		return []Target{}, err
+	}
+	return targets, nil
+}
+
+// Watch sends the targets on updates each time they change, until ctx is
+// cancelled. It relies on blocking queries: Consul holds each query until the
+// index returned by the previous one changes, so changes are pushed as they
+// happen instead of being polled.
+func (c *Consul) Watch(ctx context.Context, updates chan<- []Target) error {
+	var index uint64
+	var previous []Target
+	first := true
+	for {
+		q := &api.QueryOptions{NodeMeta: c.nodeMeta, WaitIndex: index}
+		targets, lastIndex, err := c.query(q.WithContext(ctx))
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			slog.Warn("could not watch consul", slog.Any("error", err))
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(CONSUL_WATCH_RETRY_INTERVAL):
+			}
+			continue
+		}
+
+		// The index can go backwards, for instance after a snapshot restore,
+		// in which case the watch starts over
+		if lastIndex < index {
+			lastIndex = 0
+		}
+		index = lastIndex
+
+		// The index of a query changes on unrelated updates of the catalog
+		if !first && reflect.DeepEqual(targets, previous) {
+			continue
+		}
+		first = false
+		previous = targets
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case updates <- targets:
+		}
+	}
+}
+
+// Query the first Consul client available, returning the targets and the
+// index to wait on for the next change
+func (c *Consul) query(q *api.QueryOptions) (targets []Target, index uint64, err error) {
 	for _, client := range c.clients {
-		nodes, _, err = client.Catalog().Nodes(&api.QueryOptions{NodeMeta: c.nodeMeta})
+		if c.service != "" {
+			targets, index, err = c.queryService(client, q)
+		} else {
+			targets, index, err = c.queryNodes(client, q)
+		}
 		if err == nil {
-			ok = true
-			break
+			return targets, index, nil
+		}
+		if q.Context().Err() != nil {
+			return []Target{}, 0, err
 		}
-		slog.Warn("could not query consul catalog", slog.Any("error", err))
+		slog.Warn("could not query consul", slog.Any("error", err))
 	}
-	if !ok {
-		return []string{}, fmt.Errorf("all consul clients failed")
+	return []Target{}, 0, fmt.Errorf("all consul clients failed")
+}
+
+// Return the address or the node meta values of the nodes of the catalog,
+// labelled with the node metadata
+func (c *Consul) queryNodes(client *api.Client, q *api.QueryOptions) (targets []Target, index uint64, err error) {
+	nodes, queryMeta, err := client.Catalog().Nodes(q)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	if len(nodes) > 0 {
 		slog.Debug("nodes discovered", slog.Any("nodes", nodes))
 	}
 
+	var hosts []string
 	for _, node := range nodes {
 		if len(c.returnMetas) > 0 {
 			for _, returnMeta := range c.returnMetas {
 				if meta, ok := node.Meta[returnMeta]; ok && !utils.In(hosts, meta) {
 					hosts = append(hosts, meta)
+					targets = append(targets, Target{Host: meta, Labels: nodeLabels(node)})
 				}
 			}
 		} else {
 			hosts = append(hosts, node.Address)
+			targets = append(targets, Target{Host: node.Address, Labels: nodeLabels(node)})
 		}
 	}
 
 	if len(hosts) > 0 {
 		slog.Debug("hosts discovered", slog.Any("hosts", hosts))
 	}
-	return hosts, nil
+	return targets, queryMeta.LastIndex, nil
+}
+
+// Return the address and port of the instances of a service, from the health
+// endpoint so instances failing their checks can be skipped
+func (c *Consul) queryService(client *api.Client, q *api.QueryOptions) (targets []Target, index uint64, err error) {
+	entries, queryMeta, err := client.Health().ServiceMultipleTags(c.service, c.tags, c.passingOnly, q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var hosts []string
+	for _, entry := range entries {
+		// The service address is optional, the node address is used when empty
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		host := net.JoinHostPort(address, strconv.Itoa(entry.Service.Port))
+		if utils.In(hosts, host) {
+			continue
+		}
+		hosts = append(hosts, host)
+
+		labels := nodeLabels(entry.Node)
+		labels[CONSUL_SERVICE_LABEL] = entry.Service.Service
+		labels[CONSUL_SERVICE_ID_LABEL] = entry.Service.ID
+		labels[CONSUL_SERVICE_ADDRESS_LABEL] = entry.Service.Address
+		labels[CONSUL_SERVICE_PORT_LABEL] = strconv.Itoa(entry.Service.Port)
+		// Tags are surrounded by separators so a tag can be matched as ,tag,
+		labels[CONSUL_TAGS_LABEL] = CONSUL_TAG_SEPARATOR + strings.Join(entry.Service.Tags, CONSUL_TAG_SEPARATOR) + CONSUL_TAG_SEPARATOR
+		for k, v := range entry.Service.Meta {
+			labels[CONSUL_SERVICE_METADATA_LABEL_PREFIX+sanitizeLabelName(k)] = v
+		}
+		targets = append(targets, Target{Host: host, Labels: labels})
+	}
+
+	if len(hosts) > 0 {
+		slog.Debug("hosts discovered", slog.Any("service", c.service), slog.Any("hosts", hosts))
+	}
+	return targets, queryMeta.LastIndex, nil
+}
+
+// Metadata labels of a node
+func nodeLabels(node *api.Node) map[string]string {
+	labels := map[string]string{
+		CONSUL_NODE_LABEL:       node.Node,
+		CONSUL_ADDRESS_LABEL:    node.Address,
+		CONSUL_DATACENTER_LABEL: node.Datacenter,
+	}
+	for k, v := range node.Meta {
+		labels[CONSUL_METADATA_LABEL_PREFIX+sanitizeLabelName(k)] = v
+	}
+	return labels
 }
@@ -0,0 +1,151 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestConsulDiscoverService(t *testing.T) {
+	entries := []*api.ServiceEntry{
+		{Node: &api.Node{Node: "pg1-a", Address: "10.0.0.1", Datacenter: "gra", Meta: map[string]string{"cluster": "pg1"}}, Service: &api.AgentService{ID: "postgresql-1", Service: "postgresql", Address: "192.168.0.1", Port: 5432, Tags: []string{"primary", "canary"}, Meta: map[string]string{"pg-version": "16"}}},
+		{Node: &api.Node{Address: "10.0.0.2"}, Service: &api.AgentService{Port: 5433}},
+		{Node: &api.Node{Address: "10.0.0.3"}, Service: &api.AgentService{Address: "192.168.0.1", Port: 5432}},
+	}
+
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/postgresql" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.RawQuery
+		json.NewEncoder(w).Encode(entries)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		tags        []string
+		passingOnly bool
+		query       []string
+	}{
+		{"without filter", nil, false, nil},
+		{"with tags", []string{"primary", "canary"}, false, []string{"tag=primary", "tag=canary"}},
+		{"with passing only", nil, true, []string{"passing=1"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewConsul(ConsulOpts{
+				Addresses:   []string{strings.TrimPrefix(server.URL, "http://")},
+				Service:     "postgresql",
+				Tags:        tc.tags,
+				PassingOnly: tc.passingOnly,
+			})
+			if err != nil {
+				t.Fatalf("could not create consul: %v", err)
+			}
+
+			targets, err := c.Discover()
+			if err != nil {
+				t.Fatalf("could not discover: %v", err)
+			}
+			hosts := Hosts(targets)
+
+			expected := []string{"192.168.0.1:5432", "10.0.0.2:5433"}
+			if fmt.Sprint(hosts) != fmt.Sprint(expected) {
+				t.Errorf("got %v, expect %v", hosts, expected)
+			}
+			for _, q := range tc.query {
+				if !strings.Contains(query, q) {
+					t.Errorf("got query %s, expect it to contain %s", query, q)
+				}
+			}
+
+			labels := map[string]string{
+				CONSUL_NODE_LABEL:                                   "pg1-a",
+				CONSUL_ADDRESS_LABEL:                                "10.0.0.1",
+				CONSUL_DATACENTER_LABEL:                             "gra",
+				CONSUL_METADATA_LABEL_PREFIX + "cluster":            "pg1",
+				CONSUL_SERVICE_LABEL:                                "postgresql",
+				CONSUL_SERVICE_ID_LABEL:                             "postgresql-1",
+				CONSUL_SERVICE_ADDRESS_LABEL:                        "192.168.0.1",
+				CONSUL_SERVICE_PORT_LABEL:                           "5432",
+				CONSUL_SERVICE_METADATA_LABEL_PREFIX + "pg_version": "16",
+				CONSUL_TAGS_LABEL:                                   ",primary,canary,",
+			}
+			if fmt.Sprint(targets[0].Labels) != fmt.Sprint(labels) {
+				t.Errorf("got labels %v, expect %v", targets[0].Labels, labels)
+			}
+		})
+	}
+}
+
+func TestConsulWatch(t *testing.T) {
+	// Each index maps to the nodes returned once it is reached, the last one
+	// blocks until the watch is cancelled
+	nodes := [][]*api.Node{
+		{{Address: "192.168.0.1"}},
+		{{Address: "192.168.0.1"}, {Address: "192.168.0.2"}},
+		{{Address: "192.168.0.1"}, {Address: "192.168.0.2"}},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		index, _ := strconv.Atoi(r.URL.Query().Get("index"))
+		if index >= len(nodes) {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index+1))
+		json.NewEncoder(w).Encode(nodes[index])
+	}))
+	defer server.Close()
+
+	c, err := NewConsul(ConsulOpts{Addresses: []string{strings.TrimPrefix(server.URL, "http://")}})
+	if err != nil {
+		t.Fatalf("could not create consul: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan []Target)
+	done := make(chan error)
+	go func() { done <- c.Watch(ctx, updates) }()
+
+	// The third index returns the same nodes and is not sent
+	expected := []string{"[192.168.0.1]", "[192.168.0.1 192.168.0.2]"}
+	for _, want := range expected {
+		select {
+		case targets := <-updates:
+			if hosts := Hosts(targets); fmt.Sprint(hosts) != want {
+				t.Errorf("got %v, expect %v", hosts, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no update received, expect %v", want)
+		}
+	}
+	select {
+	case targets := <-updates:
+		t.Errorf("got unexpected update %v", Hosts(targets))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got error %v, expect nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watch did not return after cancel")
+	}
+}
@@ -1,8 +1,68 @@
 package discover
 
+import (
+	"context"
+	"strings"
+	"time"
+)
+
 // Library to return a list of hosts according to a provider
 // Inspired by https://github.com/hashicorp/go-discover
 
+// Target is a host returned by a provider along with its labels. Labels
+// prefixed with __ are metadata, not attached to the jobs as is.
+type Target struct {
+	Host   string
+	Labels map[string]string
+}
+
 type Discover interface {
-	Discover() ([]string, error)
+	Discover() ([]Target, error)
+}
+
+// Watcher is implemented by providers able to push the targets as they change,
+// instead of being polled
+type Watcher interface {
+	Watch(ctx context.Context, updates chan<- []Target) error
+}
+
+// Closer is implemented by providers keeping resources between discoveries,
+// released once the provider is not used anymore
+type Closer interface {
+	Close()
+}
+
+// Expirer is implemented by providers whose hosts are valid for a limited time,
+// such as DNS records, to schedule the next discovery when they expire
+type Expirer interface {
+	TTL() time.Duration
+}
+
+// Hosts returns the hosts of targets
+func Hosts(targets []Target) []string {
+	hosts := make([]string, 0, len(targets))
+	for _, t := range targets {
+		hosts = append(hosts, t.Host)
+	}
+	return hosts
+}
+
+// Replace the characters not allowed in Prometheus label names by underscores,
+// for metadata labels built from arbitrary keys
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Targets returns targets without labels for hosts
+func Targets(hosts []string) []Target {
+	targets := make([]Target, 0, len(hosts))
+	for _, h := range hosts {
+		targets = append(targets, Target{Host: h})
+	}
+	return targets
 }
@@ -0,0 +1,196 @@
+package discover
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ovh/canary-ng/utils"
+)
+
+const (
+	DNS_SRV_PORT        = "53"
+	DNS_SRV_TIMEOUT     = 3 * time.Second
+	DNS_SRV_RESOLV_CONF = "/etc/resolv.conf"
+
+	// Metadata labels of the targets, named as in Prometheus
+	DNS_NAME_LABEL              = "__meta_dns_name"
+	DNS_SRV_RECORD_TARGET_LABEL = "__meta_dns_srv_record_target"
+	DNS_SRV_RECORD_PORT_LABEL   = "__meta_dns_srv_record_port"
+)
+
+type DNSSRVOpts struct {
+	Names    []string
+	Resolver string
+	Resolve  bool
+	Timeout  time.Duration
+}
+
+// DNSSRV returns the targets of DNS SRV records as host:port, or the addresses
+// of the targets when resolve is set. Records are queried directly instead of
+// through the system resolver so their TTL is known.
+type DNSSRV struct {
+	names     []string
+	resolvers []string
+	resolve   bool
+	client    *dns.Client
+	tcpClient *dns.Client
+
+	// Lowest TTL of the records returned by the last discovery
+	ttl time.Duration
+}
+
+func NewDNSSRV(opts DNSSRVOpts) (*DNSSRV, error) {
+	if len(opts.Names) == 0 {
+		return nil, fmt.Errorf("names are required")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DNS_SRV_TIMEOUT
+	}
+
+	var resolvers []string
+	if opts.Resolver != "" {
+		resolver := opts.Resolver
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, DNS_SRV_PORT)
+		}
+		resolvers = []string{resolver}
+	} else {
+		config, err := dns.ClientConfigFromFile(DNS_SRV_RESOLV_CONF)
+		if err != nil {
+			return nil, err
+		}
+		for _, server := range config.Servers {
+			resolvers = append(resolvers, net.JoinHostPort(server, config.Port))
+		}
+	}
+
+	return &DNSSRV{
+		names:     opts.Names,
+		resolvers: resolvers,
+		resolve:   opts.Resolve,
+		client:    &dns.Client{Timeout: opts.Timeout},
+		tcpClient: &dns.Client{Net: "tcp", Timeout: opts.Timeout},
+	}, nil
+}
+
+func (d *DNSSRV) Discover() (targets []Target, err error) {
+	var hosts []string
+	var ttl uint32
+	for _, name := range d.names {
+		records, err := d.query(name, dns.TypeSRV)
+		if err != nil {
+			return []Target{}, err
+		}
+
+		for _, record := range records {
+			srv, ok := record.(*dns.SRV)
+			if !ok {
+				continue
+			}
+			ttl = minTTL(ttl, srv.Hdr.Ttl)
+			// A target of "." means the service is not available at this name
+			if srv.Target == "." {
+				continue
+			}
+			port := strconv.Itoa(int(srv.Port))
+
+			addresses := []string{strings.TrimSuffix(srv.Target, ".")}
+			if d.resolve {
+				var recordTTL uint32
+				addresses, recordTTL, err = d.addresses(srv.Target)
+				if err != nil {
+					return []Target{}, err
+				}
+				ttl = minTTL(ttl, recordTTL)
+			}
+
+			for _, address := range addresses {
+				host := net.JoinHostPort(address, port)
+				if utils.In(hosts, host) {
+					continue
+				}
+				hosts = append(hosts, host)
+				targets = append(targets, Target{Host: host, Labels: map[string]string{
+					DNS_NAME_LABEL:              name,
+					DNS_SRV_RECORD_TARGET_LABEL: srv.Target,
+					DNS_SRV_RECORD_PORT_LABEL:   port,
+				}})
+			}
+		}
+	}
+	d.ttl = time.Duration(ttl) * time.Second
+
+	if len(hosts) > 0 {
+		slog.Debug("hosts discovered", slog.Any("names", d.names), slog.Any("hosts", hosts), slog.Duration("ttl", d.ttl))
+	}
+	return targets, nil
+}
+
+// TTL returns the lowest TTL of the records returned by the last discovery
+func (d *DNSSRV) TTL() time.Duration {
+	return d.ttl
+}
+
+// Return the IPv4 and IPv6 addresses of a target along with their lowest TTL
+func (d *DNSSRV) addresses(target string) (addresses []string, ttl uint32, err error) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		records, err := d.query(target, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, record := range records {
+			switch r := record.(type) {
+			case *dns.A:
+				addresses = append(addresses, r.A.String())
+				ttl = minTTL(ttl, r.Hdr.Ttl)
+			case *dns.AAAA:
+				addresses = append(addresses, r.AAAA.String())
+				ttl = minTTL(ttl, r.Hdr.Ttl)
+			}
+		}
+	}
+	return addresses, ttl, nil
+}
+
+// Query the first resolver answering, retrying over TCP when the answer is
+// truncated
+func (d *DNSSRV) query(name string, qtype uint16) (records []dns.RR, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+
+	for _, resolver := range d.resolvers {
+		var r *dns.Msg
+		r, _, err = d.client.Exchange(m, resolver)
+		if err == nil && r.Truncated {
+			r, _, err = d.tcpClient.Exchange(m, resolver)
+		}
+		if err != nil {
+			slog.Warn("could not query dns resolver", slog.String("resolver", resolver), slog.Any("error", err))
+			continue
+		}
+
+		switch r.Rcode {
+		case dns.RcodeSuccess:
+			return r.Answer, nil
+		case dns.RcodeNameError:
+			return nil, fmt.Errorf("%s does not exist", name)
+		default:
+			err = fmt.Errorf("could not resolve %s: %s", name, dns.RcodeToString[r.Rcode])
+			slog.Warn("could not query dns resolver", slog.String("resolver", resolver), slog.Any("error", err))
+		}
+	}
+	return nil, fmt.Errorf("all dns resolvers failed")
+}
+
+// Lowest non-zero TTL, zero meaning unset
+func minTTL(a, b uint32) uint32 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,97 @@
+package discover
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Serve the given records over UDP on a random local port, returning its
+// address
+func serveDNS(t *testing.T, records []string) string {
+	zone := map[uint16]map[string][]dns.RR{}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("could not parse record %q: %v", record, err)
+		}
+		qtype := rr.Header().Rrtype
+		if zone[qtype] == nil {
+			zone[qtype] = map[string][]dns.RR{}
+		}
+		zone[qtype][rr.Header().Name] = append(zone[qtype][rr.Header().Name], rr)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		answer, ok := zone[q.Qtype][q.Name]
+		if !ok && len(zone[dns.TypeSRV][q.Name]) == 0 && len(zone[dns.TypeA][q.Name]) == 0 {
+			m.SetRcode(r, dns.RcodeNameError)
+		}
+		m.Answer = answer
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestDNSSRVDiscover(t *testing.T) {
+	resolver := serveDNS(t, []string{
+		"_mongodb._tcp.example.com. 300 IN SRV 0 0 27017 mongo1.example.com.",
+		"_mongodb._tcp.example.com. 60 IN SRV 0 0 27018 mongo2.example.com.",
+		"_ldap._tcp.example.com. 120 IN SRV 0 0 0 .",
+		"mongo1.example.com. 30 IN A 192.168.0.1",
+		"mongo2.example.com. 600 IN A 192.168.0.2",
+		"mongo2.example.com. 600 IN AAAA 2001:db8::2",
+	})
+
+	tests := []struct {
+		name     string
+		opts     DNSSRVOpts
+		expected []string
+		ttl      time.Duration
+		err      bool
+	}{
+		{"with srv records", DNSSRVOpts{Names: []string{"_mongodb._tcp.example.com"}}, []string{"mongo1.example.com:27017", "mongo2.example.com:27018"}, 60 * time.Second, false},
+		{"with addresses", DNSSRVOpts{Names: []string{"_mongodb._tcp.example.com"}, Resolve: true}, []string{"192.168.0.1:27017", "192.168.0.2:27018", "[2001:db8::2]:27018"}, 30 * time.Second, false},
+		{"with unavailable service", DNSSRVOpts{Names: []string{"_ldap._tcp.example.com"}, Resolve: true}, []string{}, 120 * time.Second, false},
+		{"with unknown name", DNSSRVOpts{Names: []string{"_etcd._tcp.example.com"}}, []string{}, 0, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Resolver = resolver
+			d, err := NewDNSSRV(tc.opts)
+			if err != nil {
+				t.Fatalf("could not create dns srv: %v", err)
+			}
+
+			targets, err := d.Discover()
+			if tc.err != (err != nil) {
+				t.Fatalf("got error %v, expect error %v", err, tc.err)
+			}
+			if hosts := Hosts(targets); fmt.Sprint(hosts) != fmt.Sprint(tc.expected) {
+				t.Errorf("got %v, expect %v", hosts, tc.expected)
+			}
+			if d.TTL() != tc.ttl {
+				t.Errorf("got ttl %v, expect %v", d.TTL(), tc.ttl)
+			}
+			for _, target := range targets {
+				if got := target.Labels[DNS_NAME_LABEL]; got != tc.opts.Names[0] {
+					t.Errorf("got name label %q, expect %s", got, tc.opts.Names[0])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FILE_PATH_LABEL = "__meta_filepath"
+)
+
+type FileOpts struct {
+	Files []string
+}
+
+// File returns the targets of files in the format of the Prometheus file_sd,
+// a list of target groups with their labels, in JSON or YAML depending on the
+// file extension
+type File struct {
+	patterns []string
+}
+
+// A group of targets sharing the same labels
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+func NewFile(opts FileOpts) (*File, error) {
+	if len(opts.Files) == 0 {
+		return nil, fmt.Errorf("files are required")
+	}
+	for _, pattern := range opts.Files {
+		// Only the file name can be a pattern, directories are watched
+		if strings.ContainsAny(filepath.Dir(pattern), "*?[") {
+			return nil, fmt.Errorf("invalid pattern %s, only the file name can contain a glob", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+	}
+	return &File{patterns: opts.Files}, nil
+}
+
+func (f *File) Discover() (targets []Target, err error) {
+	seen := map[string]bool{}
+	for _, pattern := range f.patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return []Target{}, err
+		}
+		for _, file := range files {
+			groups, err := readTargetGroups(file)
+			if err != nil {
+				return []Target{}, err
+			}
+			targets = appendTargets(targets, seen, groups, map[string]string{FILE_PATH_LABEL: file})
+		}
+	}
+
+	if len(targets) > 0 {
+		slog.Debug("hosts discovered", slog.Any("files", f.patterns), slog.Any("hosts", Hosts(targets)))
+	}
+	return targets, nil
+}
+
+// Watch sends the targets on updates each time a file matching the patterns
+// changes, until ctx is cancelled. The parent directories are watched instead
+// of the files so files created later or replaced through a rename are
+// followed. When a file fails to be read, the error is logged and the previous
+// targets are kept until it is fixed.
+func (f *File) Watch(ctx context.Context, updates chan<- []Target) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, pattern := range f.patterns {
+		if err = watcher.Add(filepath.Dir(pattern)); err != nil {
+			return err
+		}
+	}
+
+	var previous []Target
+	first := true
+	send := func() bool {
+		targets, err := f.Discover()
+		if err != nil {
+			slog.Warn("could not read target files", slog.Any("error", err))
+			return true
+		}
+		if !first && reflect.DeepEqual(targets, previous) {
+			return true
+		}
+		first = false
+		previous = targets
+
+		select {
+		case <-ctx.Done():
+			return false
+		case updates <- targets:
+			return true
+		}
+	}
+
+	if !send() {
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("could not watch target files", slog.Any("error", err))
+		case _, ok := <-watcher.Events:
+			// Any event is followed as files can be symlinks swapped without
+			// an event on their own name, as done for Kubernetes ConfigMaps.
+			// Unchanged targets are not sent.
+			if !ok {
+				return nil
+			}
+			if !send() {
+				return nil
+			}
+		}
+	}
+}
+
+// Append the targets of groups not seen yet, along with the labels of their
+// group and the given metadata labels
+func appendTargets(targets []Target, seen map[string]bool, groups []targetGroup, meta map[string]string) []Target {
+	for _, group := range groups {
+		for _, host := range group.Targets {
+			if seen[host] {
+				continue
+			}
+			seen[host] = true
+
+			labels := map[string]string{}
+			for k, v := range meta {
+				labels[k] = v
+			}
+			for k, v := range group.Labels {
+				labels[k] = v
+			}
+			targets = append(targets, Target{Host: host, Labels: labels})
+		}
+	}
+	return targets
+}
+
+// Read the target groups of a file, in JSON unless it has a YAML extension
+func readTargetGroups(file string) (groups []targetGroup, err error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(file) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(buf, &groups)
+	default:
+		err = json.Unmarshal(buf, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", file, err)
+	}
+	return groups, nil
+}
@@ -0,0 +1,114 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileDiscover(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.json": `[{"targets": ["192.168.0.1:5432", "192.168.0.2:5432"], "labels": {"az": "a"}}]`,
+		"b.yml":  "- targets:\n    - 192.168.0.3:5432\n    - 192.168.0.1:5432\n  labels:\n    az: b\n",
+		"c.txt":  `not targets`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("could not write %s: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		files    []string
+		expected []string
+		err      bool
+	}{
+		{"with json file", []string{filepath.Join(dir, "a.json")}, []string{"192.168.0.1:5432/a", "192.168.0.2:5432/a"}, false},
+		{"with yaml file", []string{filepath.Join(dir, "b.yml")}, []string{"192.168.0.3:5432/b", "192.168.0.1:5432/b"}, false},
+		{"with glob", []string{filepath.Join(dir, "*.json"), filepath.Join(dir, "*.yml")}, []string{"192.168.0.1:5432/a", "192.168.0.2:5432/a", "192.168.0.3:5432/b"}, false},
+		{"without match", []string{filepath.Join(dir, "*.yaml")}, []string{}, false},
+		{"with invalid file", []string{filepath.Join(dir, "c.txt")}, []string{}, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := NewFile(FileOpts{Files: tc.files})
+			if err != nil {
+				t.Fatalf("could not create file: %v", err)
+			}
+
+			targets, err := f.Discover()
+			if tc.err != (err != nil) {
+				t.Fatalf("got error %v, expect error %v", err, tc.err)
+			}
+
+			got := []string{}
+			for _, target := range targets {
+				got = append(got, target.Host+"/"+target.Labels["az"])
+				if target.Labels[FILE_PATH_LABEL] == "" {
+					t.Errorf("missing %s label on %s", FILE_PATH_LABEL, target.Host)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Errorf("got %v, expect %v", got, tc.expected)
+			}
+		})
+	}
+
+	t.Run("with glob in directory", func(t *testing.T) {
+		if _, err := NewFile(FileOpts{Files: []string{filepath.Join(dir, "*", "a.json")}}); err == nil {
+			t.Error("expected error for a glob in the directory")
+		}
+	})
+}
+
+func TestFileWatch(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.json")
+	write := func(content string) {
+		// Replace the file through a rename, as done by generators
+		tmp := filepath.Join(dir, ".targets.json.tmp")
+		if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+			t.Fatalf("could not write targets: %v", err)
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			t.Fatalf("could not rename targets: %v", err)
+		}
+	}
+	write(`[{"targets": ["192.168.0.1"]}]`)
+
+	f, err := NewFile(FileOpts{Files: []string{filepath.Join(dir, "*.json")}})
+	if err != nil {
+		t.Fatalf("could not create file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Target)
+	go f.Watch(ctx, updates)
+
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case targets := <-updates:
+			if got := fmt.Sprint(Hosts(targets)); got != want {
+				t.Errorf("got %v, expect %v", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no update received, expect %v", want)
+		}
+	}
+
+	receive("[192.168.0.1]")
+	write(`[{"targets": ["192.168.0.1", "192.168.0.2"]}]`)
+	receive("[192.168.0.1 192.168.0.2]")
+	if err := os.Remove(file); err != nil {
+		t.Fatalf("could not remove targets: %v", err)
+	}
+	receive("[]")
+}
@@ -0,0 +1,118 @@
+package discover
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	HTTP_URL_LABEL  = "__meta_url"
+	HTTP_TIMEOUT    = 10 * time.Second
+	HTTP_USER_AGENT = "canary-ng"
+)
+
+type HTTPOpts struct {
+	URL         string
+	BearerToken string
+	Username    string
+	Password    string
+	CAFile      string
+	SkipVerify  bool
+	Timeout     time.Duration
+}
+
+// HTTP returns the targets of an endpoint in the format of the Prometheus
+// http_sd, a JSON list of target groups with their labels
+type HTTP struct {
+	url         string
+	bearerToken string
+	username    string
+	password    string
+	client      *http.Client
+}
+
+func NewHTTP(opts HTTPOpts) (*HTTP, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	if opts.BearerToken != "" && opts.Username != "" {
+		return nil, fmt.Errorf("bearer token and basic authentication are mutually exclusive")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = HTTP_TIMEOUT
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.CAFile != "" || opts.SkipVerify {
+		tlsConfig := &tls.Config{}
+		if opts.SkipVerify {
+			tlsConfig.InsecureSkipVerify = true
+		}
+		if opts.CAFile != "" {
+			ca, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("could not parse certificates from %s", opts.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &HTTP{
+		url:         opts.URL,
+		bearerToken: opts.BearerToken,
+		username:    opts.Username,
+		password:    opts.Password,
+		client:      &http.Client{Transport: transport, Timeout: opts.Timeout},
+	}, nil
+}
+
+func (h *HTTP) Discover() (targets []Target, err error) {
+	req, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return []Target{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", HTTP_USER_AGENT)
+	if h.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+h.bearerToken)
+	} else if h.username != "" {
+		req.SetBasicAuth(h.username, h.password)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return []Target{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return []Target{}, fmt.Errorf("could not get targets from %s: %s", h.url, resp.Status)
+	}
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []Target{}, err
+	}
+	var groups []targetGroup
+	if err = json.Unmarshal(buf, &groups); err != nil {
+		return []Target{}, fmt.Errorf("could not parse targets from %s: %w", h.url, err)
+	}
+
+	targets = appendTargets(nil, map[string]bool{}, groups, map[string]string{HTTP_URL_LABEL: h.url})
+	if len(targets) > 0 {
+		slog.Debug("hosts discovered", slog.String("url", h.url), slog.Any("hosts", Hosts(targets)))
+	}
+	return targets, nil
+}
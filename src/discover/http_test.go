@@ -0,0 +1,87 @@
+package discover
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPDiscover(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		authorized := r.Header.Get("Authorization") == "Bearer secret" || user == "canary" && password == "secret"
+		if r.URL.Path == "/private" && !authorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/targets", "/private":
+			fmt.Fprint(w, `[
+				{"targets": ["192.168.0.1:5432", "192.168.0.2:5432"], "labels": {"env": "prod"}},
+				{"targets": ["192.168.0.2:5432", "192.168.0.3:5432"]}
+			]`)
+		case "/invalid":
+			fmt.Fprint(w, `{"targets": []}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	if err := os.WriteFile(ca, cert, 0o600); err != nil {
+		t.Fatalf("could not write ca: %v", err)
+	}
+
+	expected := []string{"192.168.0.1:5432", "192.168.0.2:5432", "192.168.0.3:5432"}
+	tests := []struct {
+		name     string
+		opts     HTTPOpts
+		expected []string
+		err      bool
+	}{
+		{"without authentication", HTTPOpts{URL: server.URL + "/targets"}, expected, false},
+		{"with bearer token", HTTPOpts{URL: server.URL + "/private", BearerToken: "secret"}, expected, false},
+		{"with basic authentication", HTTPOpts{URL: server.URL + "/private", Username: "canary", Password: "secret"}, expected, false},
+		{"with wrong credentials", HTTPOpts{URL: server.URL + "/private", Username: "canary", Password: "wrong"}, []string{}, true},
+		{"with ca file", HTTPOpts{URL: tlsServer.URL + "/targets", CAFile: ca}, expected, false},
+		{"with skip verify", HTTPOpts{URL: tlsServer.URL + "/targets", SkipVerify: true}, expected, false},
+		{"with unknown authority", HTTPOpts{URL: tlsServer.URL + "/targets"}, []string{}, true},
+		{"with not found", HTTPOpts{URL: server.URL + "/unknown"}, []string{}, true},
+		{"with invalid format", HTTPOpts{URL: server.URL + "/invalid"}, []string{}, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := NewHTTP(tc.opts)
+			if err != nil {
+				t.Fatalf("could not create http: %v", err)
+			}
+
+			targets, err := h.Discover()
+			if tc.err != (err != nil) {
+				t.Fatalf("got error %v, expect error %v", err, tc.err)
+			}
+			if hosts := Hosts(targets); fmt.Sprint(hosts) != fmt.Sprint(tc.expected) {
+				t.Errorf("got %v, expect %v", hosts, tc.expected)
+			}
+			if tc.err {
+				return
+			}
+			if got := targets[0].Labels["env"]; got != "prod" {
+				t.Errorf("got env label %q, expect prod", got)
+			}
+			if got := targets[2].Labels[HTTP_URL_LABEL]; got != tc.opts.URL {
+				t.Errorf("got url label %q, expect %s", got, tc.opts.URL)
+			}
+		})
+	}
+}
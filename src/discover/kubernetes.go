@@ -0,0 +1,478 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	KUBERNETES_ROLE_POD           = "pod"
+	KUBERNETES_ROLE_ENDPOINTS     = "endpoints"
+	KUBERNETES_ROLE_ENDPOINTSLICE = "endpointslice"
+	KUBERNETES_SYNC_TIMEOUT       = 30 * time.Second
+
+	// Metadata labels of the targets, named as in Prometheus
+	KUBERNETES_NAMESPACE_LABEL               = "__meta_kubernetes_namespace"
+	KUBERNETES_POD_NAME_LABEL                = "__meta_kubernetes_pod_name"
+	KUBERNETES_POD_IP_LABEL                  = "__meta_kubernetes_pod_ip"
+	KUBERNETES_POD_NODE_NAME_LABEL           = "__meta_kubernetes_pod_node_name"
+	KUBERNETES_POD_LABEL_PREFIX              = "__meta_kubernetes_pod_label_"
+	KUBERNETES_POD_CONTAINER_NAME_LABEL      = "__meta_kubernetes_pod_container_name"
+	KUBERNETES_POD_CONTAINER_PORT_NAME_LABEL = "__meta_kubernetes_pod_container_port_name"
+	KUBERNETES_POD_CONTAINER_PORT_LABEL      = "__meta_kubernetes_pod_container_port_number"
+	KUBERNETES_SERVICE_NAME_LABEL            = "__meta_kubernetes_service_name"
+	KUBERNETES_ENDPOINTS_NAME_LABEL          = "__meta_kubernetes_endpoints_name"
+	KUBERNETES_ENDPOINT_PORT_NAME_LABEL      = "__meta_kubernetes_endpoint_port_name"
+	KUBERNETES_ENDPOINT_HOSTNAME_LABEL       = "__meta_kubernetes_endpoint_hostname"
+	KUBERNETES_ENDPOINT_NODE_NAME_LABEL      = "__meta_kubernetes_endpoint_node_name"
+	KUBERNETES_ENDPOINTSLICE_NAME_LABEL      = "__meta_kubernetes_endpointslice_name"
+	KUBERNETES_ENDPOINTSLICE_PORT_NAME_LABEL = "__meta_kubernetes_endpointslice_port_name"
+	KUBERNETES_ENDPOINTSLICE_HOSTNAME_LABEL  = "__meta_kubernetes_endpointslice_endpoint_hostname"
+	KUBERNETES_ENDPOINTSLICE_ZONE_LABEL      = "__meta_kubernetes_endpointslice_endpoint_zone"
+)
+
+type KubernetesOpts struct {
+	Kubeconfig    string
+	Role          string
+	Namespaces    []string
+	LabelSelector string
+}
+
+// Kubernetes returns the ready addresses of pods, endpoints or endpoint slices
+// from the API server, with the labels of their pods as metadata. Resources are
+// followed with informers, which list them once then watch their changes. The
+// informers of Discover are kept between polls until Close is called.
+type Kubernetes struct {
+	client        kubernetes.Interface
+	role          string
+	namespaces    []string
+	labelSelector string
+	syncTimeout   time.Duration // to wait for the first list of the resources
+	pods          *kubernetesPods
+
+	mu      sync.Mutex
+	listers []kubernetesListers
+	stop    context.CancelFunc
+}
+
+// NewKubernetes connects with the kubeconfig file when set, with the service
+// account of the pod otherwise
+func NewKubernetes(opts KubernetesOpts) (*Kubernetes, error) {
+	var config *rest.Config
+	var err error
+	if opts.Kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", opts.Kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return newKubernetes(client, opts)
+}
+
+func newKubernetes(client kubernetes.Interface, opts KubernetesOpts) (*Kubernetes, error) {
+	switch opts.Role {
+	case KUBERNETES_ROLE_POD, KUBERNETES_ROLE_ENDPOINTS, KUBERNETES_ROLE_ENDPOINTSLICE:
+	case "":
+		return nil, fmt.Errorf("role is required")
+	default:
+		return nil, fmt.Errorf("unsupported role %s", opts.Role)
+	}
+	if _, err := labels.Parse(opts.LabelSelector); err != nil {
+		return nil, fmt.Errorf("invalid label selector %s: %w", opts.LabelSelector, err)
+	}
+
+	// All namespaces by default
+	namespaces := opts.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	return &Kubernetes{
+		client:        client,
+		role:          opts.Role,
+		namespaces:    namespaces,
+		labelSelector: opts.LabelSelector,
+		syncTimeout:   KUBERNETES_SYNC_TIMEOUT,
+		pods:          &kubernetesPods{client: client, cache: map[string]*corev1.Pod{}},
+	}, nil
+}
+
+// The listers of the resources of a namespace
+type kubernetesListers struct {
+	namespace string
+	pods      corelisters.PodLister
+	endpoints corelisters.EndpointsLister
+	slices    discoverylisters.EndpointSliceLister
+}
+
+func (k *Kubernetes) Discover() (targets []Target, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// Informers are started on the first poll and their cache is read by the
+	// next ones
+	if k.listers == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		listers, err := k.start(ctx, nil)
+		if err != nil {
+			cancel()
+			return []Target{}, err
+		}
+		k.listers, k.stop = listers, cancel
+	}
+	return k.targets(context.Background(), k.listers)
+}
+
+// Close stops the informers kept between polls
+func (k *Kubernetes) Close() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.stop != nil {
+		k.stop()
+		k.listers, k.stop = nil, nil
+	}
+}
+
+// Watch sends the targets on updates each time they change, until ctx is
+// cancelled
+func (k *Kubernetes) Watch(ctx context.Context, updates chan<- []Target) error {
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	listers, err := k.start(ctx, notify)
+	if err != nil {
+		return err
+	}
+
+	var previous []Target
+	first := true
+	for {
+		targets, err := k.targets(ctx, listers)
+		if err != nil {
+			return err
+		}
+		// Updates of resources not changing the targets, such as the status of
+		// a pod, are not sent
+		if first || !reflect.DeepEqual(targets, previous) {
+			first = false
+			previous = targets
+			select {
+			case <-ctx.Done():
+				return nil
+			case updates <- targets:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// Start the informers of the namespaces until ctx is cancelled, calling notify
+// on each change when set, and wait for their first list until the sync
+// timeout expires
+func (k *Kubernetes) start(ctx context.Context, notify func()) ([]kubernetesListers, error) {
+	var handler cache.ResourceEventHandler
+	if notify != nil {
+		handler = cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(any) { notify() },
+			UpdateFunc: func(any, any) { notify() },
+			DeleteFunc: func(any) { notify() },
+		}
+	}
+	register := func(informer cache.SharedIndexInformer) {
+		if handler != nil {
+			informer.AddEventHandler(handler)
+		}
+	}
+
+	var factories []informers.SharedInformerFactory
+	var listers []kubernetesListers
+	for _, namespace := range k.namespaces {
+		selected := informers.NewSharedInformerFactoryWithOptions(k.client, 0,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(o *metav1.ListOptions) { o.LabelSelector = k.labelSelector }),
+		)
+		factories = append(factories, selected)
+		l := kubernetesListers{namespace: namespace}
+
+		switch k.role {
+		case KUBERNETES_ROLE_POD:
+			informer := selected.Core().V1().Pods()
+			register(informer.Informer())
+			l.pods = informer.Lister()
+		case KUBERNETES_ROLE_ENDPOINTS:
+			informer := selected.Core().V1().Endpoints()
+			register(informer.Informer())
+			l.endpoints = informer.Lister()
+		case KUBERNETES_ROLE_ENDPOINTSLICE:
+			informer := selected.Discovery().V1().EndpointSlices()
+			register(informer.Informer())
+			l.slices = informer.Lister()
+		}
+		listers = append(listers, l)
+	}
+
+	syncCtx, cancel := context.WithTimeout(ctx, k.syncTimeout)
+	defer cancel()
+	for _, factory := range factories {
+		factory.Start(ctx.Done())
+		for informer, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+			if !synced {
+				return nil, fmt.Errorf("could not list %v from kubernetes within %s", informer, k.syncTimeout)
+			}
+		}
+	}
+	return listers, nil
+}
+
+// Return the targets of the resources of the listers, ordered by namespace and
+// name so unchanged resources return the same targets. The pods referenced by
+// the endpoints are fetched within the sync timeout.
+func (k *Kubernetes) targets(ctx context.Context, listers []kubernetesListers) (targets []Target, err error) {
+	ctx, cancel := context.WithTimeout(ctx, k.syncTimeout)
+	defer cancel()
+	k.pods.mu.Lock()
+	defer k.pods.mu.Unlock()
+	k.pods.used = map[string]bool{}
+	refLabels := func(ref *corev1.ObjectReference) map[string]string { return k.pods.labels(ctx, ref) }
+
+	seen := map[string]bool{}
+	add := func(host string, labels map[string]string) {
+		if seen[host] {
+			return
+		}
+		seen[host] = true
+		targets = append(targets, Target{Host: host, Labels: labels})
+	}
+
+	for _, l := range listers {
+		switch k.role {
+		case KUBERNETES_ROLE_POD:
+			pods, err := l.pods.Pods(l.namespace).List(labels.Everything())
+			if err != nil {
+				return []Target{}, err
+			}
+			slices.SortFunc(pods, compareObjects)
+			for _, pod := range pods {
+				podTargets(pod, add)
+			}
+		case KUBERNETES_ROLE_ENDPOINTS:
+			endpoints, err := l.endpoints.Endpoints(l.namespace).List(labels.Everything())
+			if err != nil {
+				return []Target{}, err
+			}
+			slices.SortFunc(endpoints, compareObjects)
+			for _, e := range endpoints {
+				endpointsTargets(e, refLabels, add)
+			}
+		case KUBERNETES_ROLE_ENDPOINTSLICE:
+			endpointSlices, err := l.slices.EndpointSlices(l.namespace).List(labels.Everything())
+			if err != nil {
+				return []Target{}, err
+			}
+			slices.SortFunc(endpointSlices, compareObjects)
+			for _, s := range endpointSlices {
+				endpointSliceTargets(s, refLabels, add)
+			}
+		}
+	}
+
+	k.pods.prune()
+
+	if len(targets) > 0 {
+		slog.Debug("hosts discovered", slog.String("role", k.role), slog.Any("hosts", Hosts(targets)))
+	}
+	return targets, nil
+}
+
+// Return the pod IP with each TCP port of the containers of a ready pod, or
+// the pod IP alone without port
+func podTargets(pod *corev1.Pod, add func(host string, labels map[string]string)) {
+	if pod.Status.PodIP == "" || pod.DeletionTimestamp != nil || !podReady(pod) {
+		return
+	}
+
+	found := false
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
+				continue
+			}
+			found = true
+			labels := podLabels(pod)
+			labels[KUBERNETES_POD_CONTAINER_NAME_LABEL] = container.Name
+			labels[KUBERNETES_POD_CONTAINER_PORT_NAME_LABEL] = port.Name
+			labels[KUBERNETES_POD_CONTAINER_PORT_LABEL] = strconv.Itoa(int(port.ContainerPort))
+			add(net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(port.ContainerPort))), labels)
+		}
+	}
+	if !found {
+		add(pod.Status.PodIP, podLabels(pod))
+	}
+}
+
+// Return the ready addresses of endpoints with each of their TCP ports
+func endpointsTargets(e *corev1.Endpoints, refLabels func(*corev1.ObjectReference) map[string]string, add func(host string, labels map[string]string)) {
+	for _, subset := range e.Subsets {
+		for _, address := range subset.Addresses {
+			for _, port := range subset.Ports {
+				if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
+					continue
+				}
+				labels := refLabels(address.TargetRef)
+				labels[KUBERNETES_NAMESPACE_LABEL] = e.Namespace
+				labels[KUBERNETES_ENDPOINTS_NAME_LABEL] = e.Name
+				labels[KUBERNETES_SERVICE_NAME_LABEL] = e.Name
+				labels[KUBERNETES_ENDPOINT_PORT_NAME_LABEL] = port.Name
+				labels[KUBERNETES_ENDPOINT_HOSTNAME_LABEL] = address.Hostname
+				if address.NodeName != nil {
+					labels[KUBERNETES_ENDPOINT_NODE_NAME_LABEL] = *address.NodeName
+				}
+				add(net.JoinHostPort(address.IP, strconv.Itoa(int(port.Port))), labels)
+			}
+		}
+	}
+}
+
+// Return the addresses of the ready endpoints of a slice with each of its TCP
+// ports
+func endpointSliceTargets(s *discoveryv1.EndpointSlice, refLabels func(*corev1.ObjectReference) map[string]string, add func(host string, labels map[string]string)) {
+	if s.AddressType == discoveryv1.AddressTypeFQDN {
+		return
+	}
+	for _, endpoint := range s.Endpoints {
+		// An unknown condition is interpreted as ready
+		if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+			continue
+		}
+		for _, address := range endpoint.Addresses {
+			for _, port := range s.Ports {
+				if port.Port == nil || port.Protocol != nil && *port.Protocol != corev1.ProtocolTCP {
+					continue
+				}
+				labels := refLabels(endpoint.TargetRef)
+				labels[KUBERNETES_NAMESPACE_LABEL] = s.Namespace
+				labels[KUBERNETES_ENDPOINTSLICE_NAME_LABEL] = s.Name
+				labels[KUBERNETES_SERVICE_NAME_LABEL] = s.Labels[discoveryv1.LabelServiceName]
+				if port.Name != nil {
+					labels[KUBERNETES_ENDPOINTSLICE_PORT_NAME_LABEL] = *port.Name
+				}
+				if endpoint.Hostname != nil {
+					labels[KUBERNETES_ENDPOINTSLICE_HOSTNAME_LABEL] = *endpoint.Hostname
+				}
+				if endpoint.Zone != nil {
+					labels[KUBERNETES_ENDPOINTSLICE_ZONE_LABEL] = *endpoint.Zone
+				}
+				add(net.JoinHostPort(address, strconv.Itoa(int(*port.Port))), labels)
+			}
+		}
+	}
+}
+
+// The pods referenced by the endpoints, fetched when they first back an
+// endpoint instead of caching every pod of the namespaces. Pods no longer
+// referenced are forgotten.
+type kubernetesPods struct {
+	client kubernetes.Interface
+	mu     sync.Mutex
+	cache  map[string]*corev1.Pod // by namespace/name
+	used   map[string]bool        // referenced since the targets were listed
+}
+
+// Metadata labels of the pod an endpoint refers to, when known
+func (p *kubernetesPods) labels(ctx context.Context, ref *corev1.ObjectReference) map[string]string {
+	if ref == nil || ref.Kind != "Pod" {
+		return map[string]string{}
+	}
+	key := ref.Namespace + "/" + ref.Name
+	p.used[key] = true
+
+	// A pod recreated with the same name has another UID
+	pod, ok := p.cache[key]
+	if !ok || ref.UID != "" && ref.UID != pod.UID {
+		var err error
+		pod, err = p.client.CoreV1().Pods(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			delete(p.cache, key)
+			return map[string]string{KUBERNETES_POD_NAME_LABEL: ref.Name}
+		}
+		p.cache[key] = pod
+	}
+	return podLabels(pod)
+}
+
+// Forget the pods not referenced since the targets were listed
+func (p *kubernetesPods) prune() {
+	for key := range p.cache {
+		if !p.used[key] {
+			delete(p.cache, key)
+		}
+	}
+}
+
+// Metadata labels of a pod
+func podLabels(pod *corev1.Pod) map[string]string {
+	labels := map[string]string{
+		KUBERNETES_NAMESPACE_LABEL:     pod.Namespace,
+		KUBERNETES_POD_NAME_LABEL:      pod.Name,
+		KUBERNETES_POD_IP_LABEL:        pod.Status.PodIP,
+		KUBERNETES_POD_NODE_NAME_LABEL: pod.Spec.NodeName,
+	}
+	for k, v := range pod.Labels {
+		labels[KUBERNETES_POD_LABEL_PREFIX+sanitizeLabelName(k)] = v
+	}
+	return labels
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Order resources by namespace then name
+func compareObjects[T metav1.Object](a, b T) int {
+	if c := strings.Compare(a.GetNamespace(), b.GetNamespace()); c != 0 {
+		return c
+	}
+	return strings.Compare(a.GetName(), b.GetName())
+}
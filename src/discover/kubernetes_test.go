@@ -0,0 +1,263 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testPod(name, ip string, ready bool, labels map[string]string) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "databases", Labels: labels},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{{
+				Name:  "postgres",
+				Ports: []corev1.ContainerPort{{Name: "postgresql", ContainerPort: 5432}, {Name: "metrics", ContainerPort: 9187, Protocol: corev1.ProtocolUDP}},
+			}},
+		},
+		Status: corev1.PodStatus{
+			PodIP:      ip,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestKubernetesDiscover(t *testing.T) {
+	ready, notReady := true, false
+	port := int32(5432)
+	portName := "postgresql"
+	objects := []runtime.Object{
+		testPod("pg-1", "10.1.0.1", true, map[string]string{"cnpg.io/cluster": "pg", "role": "primary"}),
+		testPod("pg-2", "10.1.0.2", true, map[string]string{"cnpg.io/cluster": "pg", "role": "replica"}),
+		testPod("pg-3", "10.1.0.3", false, map[string]string{"cnpg.io/cluster": "pg", "role": "replica"}),
+		testPod("mysql-1", "10.1.0.4", true, map[string]string{"app": "mysql"}),
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "pg-rw", Namespace: "databases", Labels: map[string]string{"cnpg.io/cluster": "pg"}},
+			Subsets: []corev1.EndpointSubset{{
+				Addresses:         []corev1.EndpointAddress{{IP: "10.1.0.1", TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "databases", Name: "pg-1"}}},
+				NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.1.0.3"}},
+				Ports:             []corev1.EndpointPort{{Name: portName, Port: port}},
+			}},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Name: "pg-r-abcde", Namespace: "databases", Labels: map[string]string{"cnpg.io/cluster": "pg", discoveryv1.LabelServiceName: "pg-r"}},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.1.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}, TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "databases", Name: "pg-1"}},
+				{Addresses: []string{"10.1.0.2"}, TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "databases", Name: "pg-2"}},
+				{Addresses: []string{"10.1.0.3"}, Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+			},
+			Ports: []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		opts     KubernetesOpts
+		expected []string
+		labels   map[string]string
+	}{
+		{
+			"with pods",
+			KubernetesOpts{Role: KUBERNETES_ROLE_POD, LabelSelector: "cnpg.io/cluster=pg"},
+			[]string{"10.1.0.1:5432", "10.1.0.2:5432"},
+			map[string]string{KUBERNETES_POD_NAME_LABEL: "pg-1", KUBERNETES_POD_LABEL_PREFIX + "cnpg_io_cluster": "pg", KUBERNETES_POD_CONTAINER_PORT_NAME_LABEL: "postgresql"},
+		},
+		{
+			"with pods of another namespace",
+			KubernetesOpts{Role: KUBERNETES_ROLE_POD, Namespaces: []string{"default"}},
+			nil,
+			nil,
+		},
+		{
+			"with endpoints",
+			KubernetesOpts{Role: KUBERNETES_ROLE_ENDPOINTS, Namespaces: []string{"databases"}},
+			[]string{"10.1.0.1:5432"},
+			map[string]string{KUBERNETES_SERVICE_NAME_LABEL: "pg-rw", KUBERNETES_ENDPOINT_PORT_NAME_LABEL: "postgresql", KUBERNETES_POD_LABEL_PREFIX + "role": "primary"},
+		},
+		{
+			"with endpoint slices",
+			KubernetesOpts{Role: KUBERNETES_ROLE_ENDPOINTSLICE, LabelSelector: "cnpg.io/cluster=pg"},
+			[]string{"10.1.0.1:5432", "10.1.0.2:5432"},
+			map[string]string{KUBERNETES_SERVICE_NAME_LABEL: "pg-r", KUBERNETES_ENDPOINTSLICE_NAME_LABEL: "pg-r-abcde", KUBERNETES_POD_LABEL_PREFIX + "role": "primary"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			k, err := newKubernetes(fake.NewClientset(objects...), tc.opts)
+			if err != nil {
+				t.Fatalf("could not create kubernetes: %v", err)
+			}
+
+			targets, err := k.Discover()
+			if err != nil {
+				t.Fatalf("could not discover: %v", err)
+			}
+			if hosts := Hosts(targets); fmt.Sprint(hosts) != fmt.Sprint(tc.expected) {
+				t.Errorf("got %v, expect %v", hosts, tc.expected)
+			}
+			for k, v := range tc.labels {
+				if got := targets[0].Labels[k]; got != v {
+					t.Errorf("got %s=%q, expect %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestKubernetesDiscoverReusesInformers(t *testing.T) {
+	client := fake.NewClientset(
+		testPod("pg-1", "10.1.0.1", true, map[string]string{"role": "primary"}),
+		testPod("mysql-1", "10.1.0.4", true, map[string]string{"app": "mysql"}),
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "pg-rw", Namespace: "databases"},
+			Subsets: []corev1.EndpointSubset{{
+				Addresses: []corev1.EndpointAddress{{IP: "10.1.0.1", TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "databases", Name: "pg-1"}}},
+				Ports:     []corev1.EndpointPort{{Port: 5432}},
+			}},
+		},
+	)
+	k, err := newKubernetes(client, KubernetesOpts{Role: KUBERNETES_ROLE_ENDPOINTS})
+	if err != nil {
+		t.Fatalf("could not create kubernetes: %v", err)
+	}
+	defer k.Close()
+
+	for range 2 {
+		targets, err := k.Discover()
+		if err != nil {
+			t.Fatalf("could not discover: %v", err)
+		}
+		if hosts := fmt.Sprint(Hosts(targets)); hosts != "[10.1.0.1:5432]" {
+			t.Errorf("got %v, expect [10.1.0.1:5432]", hosts)
+		}
+		if got := targets[0].Labels[KUBERNETES_POD_LABEL_PREFIX+"role"]; got != "primary" {
+			t.Errorf("got role=%q, expect %q", got, "primary")
+		}
+	}
+
+	// Endpoints are listed once for both polls, and only the pod they refer
+	// to is fetched, once
+	calls := map[string]int{}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "watch" {
+			continue
+		}
+		calls[action.GetVerb()+" "+action.GetResource().Resource]++
+	}
+	expected := map[string]int{"get pods": 1, "list endpoints": 1}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("got %v, expect %v", calls, expected)
+	}
+}
+
+func TestNewKubernetes(t *testing.T) {
+	tests := []struct {
+		name string
+		opts KubernetesOpts
+		err  bool
+	}{
+		{"with pods", KubernetesOpts{Role: KUBERNETES_ROLE_POD}, false},
+		{"without role", KubernetesOpts{}, true},
+		{"with unknown role", KubernetesOpts{Role: "service"}, true},
+		{"with invalid label selector", KubernetesOpts{Role: KUBERNETES_ROLE_POD, LabelSelector: "app in (mysql"}, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newKubernetes(fake.NewClientset(), tc.opts)
+			if tc.err != (err != nil) {
+				t.Errorf("got error %v, expect error %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestKubernetesWatch(t *testing.T) {
+	client := fake.NewClientset(testPod("pg-1", "10.1.0.1", true, nil))
+	k, err := newKubernetes(client, KubernetesOpts{Role: KUBERNETES_ROLE_POD, Namespaces: []string{"databases"}})
+	if err != nil {
+		t.Fatalf("could not create kubernetes: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan []Target)
+	done := make(chan error)
+	go func() { done <- k.Watch(ctx, updates) }()
+
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case targets := <-updates:
+			if hosts := Hosts(targets); fmt.Sprint(hosts) != want {
+				t.Errorf("got %v, expect %v", hosts, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no update received, expect %v", want)
+		}
+	}
+	receive("[10.1.0.1:5432]")
+
+	// A pod becoming ready is added, a pod not ready yet is not
+	pods := client.CoreV1().Pods("databases")
+	if _, err := pods.Create(ctx, testPod("pg-2", "10.1.0.2", false, nil), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("could not create pod: %v", err)
+	}
+	if _, err := pods.Update(ctx, testPod("pg-2", "10.1.0.2", true, nil), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("could not update pod: %v", err)
+	}
+	receive("[10.1.0.1:5432 10.1.0.2:5432]")
+
+	if err := pods.Delete(ctx, "pg-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("could not delete pod: %v", err)
+	}
+	receive("[10.1.0.2:5432]")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got error %v, expect nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watch did not return after cancel")
+	}
+}
+
+func TestKubernetesWatchSyncTimeout(t *testing.T) {
+	// The informers retry a failing list, so their cache never syncs
+	client := fake.NewClientset()
+	client.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("forbidden")
+	})
+	k, err := newKubernetes(client, KubernetesOpts{Role: KUBERNETES_ROLE_POD})
+	if err != nil {
+		t.Fatalf("could not create kubernetes: %v", err)
+	}
+	k.syncTimeout = 100 * time.Millisecond
+
+	done := make(chan error)
+	go func() { done <- k.Watch(context.Background(), make(chan []Target)) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("got nil, expect an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch blocked on a cache that never syncs")
+	}
+}
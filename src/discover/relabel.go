@@ -0,0 +1,168 @@
+package discover
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	ADDRESS_LABEL = "__address__"
+
+	RELABEL_ACTION_REPLACE  = "replace"
+	RELABEL_ACTION_KEEP     = "keep"
+	RELABEL_ACTION_DROP     = "drop"
+	RELABEL_ACTION_LABELMAP = "labelmap"
+	RELABEL_ACTION_HASHMOD  = "hashmod"
+
+	RELABEL_SEPARATOR   = ";"
+	RELABEL_REGEX       = "(.*)"
+	RELABEL_REPLACEMENT = "$1"
+)
+
+type RelabelOpts struct {
+	SourceLabels []string
+	Separator    string
+	TargetLabel  string
+	Regex        string
+	Modulus      uint64
+	Replacement  string
+	Action       string
+}
+
+// Relabel rewrites the labels of targets the way Prometheus relabel_configs
+// do. The host of a target is exposed as the __address__ label so it can be
+// rewritten too.
+type Relabel struct {
+	sourceLabels []string
+	separator    string
+	targetLabel  string
+	regex        *regexp.Regexp
+	modulus      uint64
+	replacement  string
+	action       string
+}
+
+func NewRelabel(opts RelabelOpts) (*Relabel, error) {
+	if opts.Action == "" {
+		opts.Action = RELABEL_ACTION_REPLACE
+	}
+	if opts.Separator == "" {
+		opts.Separator = RELABEL_SEPARATOR
+	}
+	if opts.Regex == "" {
+		opts.Regex = RELABEL_REGEX
+	}
+	if opts.Replacement == "" {
+		opts.Replacement = RELABEL_REPLACEMENT
+	}
+
+	switch opts.Action {
+	case RELABEL_ACTION_REPLACE, RELABEL_ACTION_HASHMOD:
+		if opts.TargetLabel == "" {
+			return nil, fmt.Errorf("target_label is required for %s action", opts.Action)
+		}
+	case RELABEL_ACTION_KEEP, RELABEL_ACTION_DROP, RELABEL_ACTION_LABELMAP:
+	default:
+		return nil, fmt.Errorf("unsupported relabel action %s", opts.Action)
+	}
+	if opts.Action == RELABEL_ACTION_HASHMOD && opts.Modulus == 0 {
+		return nil, fmt.Errorf("modulus is required for %s action", opts.Action)
+	}
+
+	// The regex is anchored on both ends, as in Prometheus
+	regex, err := regexp.Compile("^(?:" + opts.Regex + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %s: %w", opts.Regex, err)
+	}
+
+	return &Relabel{
+		sourceLabels: opts.SourceLabels,
+		separator:    opts.Separator,
+		targetLabel:  opts.TargetLabel,
+		regex:        regex,
+		modulus:      opts.Modulus,
+		replacement:  opts.Replacement,
+		action:       opts.Action,
+	}, nil
+}
+
+// Process returns the labels rewritten, or false when the target is dropped
+func (r *Relabel) Process(labels map[string]string) (map[string]string, bool) {
+	values := make([]string, 0, len(r.sourceLabels))
+	for _, name := range r.sourceLabels {
+		values = append(values, labels[name])
+	}
+	value := strings.Join(values, r.separator)
+
+	switch r.action {
+	case RELABEL_ACTION_KEEP:
+		return labels, r.regex.MatchString(value)
+	case RELABEL_ACTION_DROP:
+		return labels, !r.regex.MatchString(value)
+	case RELABEL_ACTION_REPLACE:
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return labels, true
+		}
+		target := string(r.regex.ExpandString(nil, r.targetLabel, value, match))
+		replacement := string(r.regex.ExpandString(nil, r.replacement, value, match))
+		if replacement == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = replacement
+		}
+	case RELABEL_ACTION_HASHMOD:
+		// Same hash as Prometheus, so targets are sharded the same way
+		sum := md5.Sum([]byte(value))
+		labels[r.targetLabel] = strconv.FormatUint(binary.BigEndian.Uint64(sum[8:])%r.modulus, 10)
+	case RELABEL_ACTION_LABELMAP:
+		mapped := map[string]string{}
+		for name, v := range labels {
+			if r.regex.MatchString(name) {
+				mapped[r.regex.ReplaceAllString(name, r.replacement)] = v
+			}
+		}
+		for name, v := range mapped {
+			labels[name] = v
+		}
+	}
+	return labels, true
+}
+
+// Apply the relabeling steps in order to each target, returning the targets
+// kept. A target whose __address__ label is removed is dropped, as is a
+// target rewritten to the address of a previous one.
+func ApplyRelabel(targets []Target, relabels []*Relabel) []Target {
+	if len(relabels) == 0 {
+		return targets
+	}
+
+	kept := make([]Target, 0, len(targets))
+	seen := map[string]bool{}
+	for _, t := range targets {
+		labels := map[string]string{ADDRESS_LABEL: t.Host}
+		for k, v := range t.Labels {
+			labels[k] = v
+		}
+
+		keep := true
+		for _, r := range relabels {
+			if labels, keep = r.Process(labels); !keep {
+				break
+			}
+		}
+		host := labels[ADDRESS_LABEL]
+		if !keep || host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+
+		delete(labels, ADDRESS_LABEL)
+		kept = append(kept, Target{Host: host, Labels: labels})
+	}
+	return kept
+}
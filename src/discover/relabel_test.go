@@ -0,0 +1,158 @@
+package discover
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestApplyRelabel(t *testing.T) {
+	targets := []Target{
+		{Host: "pg1-a.example.com:5432", Labels: map[string]string{"__meta_consul_node": "pg1-a", "__meta_consul_metadata_cluster": "pg1", "__meta_consul_metadata_state": "active"}},
+		{Host: "pg1-b.example.com:5432", Labels: map[string]string{"__meta_consul_node": "pg1-b", "__meta_consul_metadata_cluster": "pg1", "__meta_consul_metadata_state": "decommissioning"}},
+		{Host: "pg2-a.example.com:5432", Labels: map[string]string{"__meta_consul_node": "pg2-a", "__meta_consul_metadata_cluster": "pg2"}},
+	}
+
+	tests := []struct {
+		name     string
+		opts     []RelabelOpts
+		expected string
+	}{
+		{
+			"without relabeling",
+			nil,
+			"[pg1-a.example.com:5432 pg1-b.example.com:5432 pg2-a.example.com:5432]",
+		},
+		{
+			"with drop",
+			[]RelabelOpts{{Action: RELABEL_ACTION_DROP, SourceLabels: []string{"__meta_consul_metadata_state"}, Regex: "decommissioning"}},
+			"[pg1-a.example.com:5432 pg2-a.example.com:5432]",
+		},
+		{
+			"with keep",
+			[]RelabelOpts{{Action: RELABEL_ACTION_KEEP, SourceLabels: []string{"__meta_consul_metadata_cluster"}, Regex: "pg1"}},
+			"[pg1-a.example.com:5432 pg1-b.example.com:5432]",
+		},
+		{
+			"with address replaced",
+			[]RelabelOpts{{SourceLabels: []string{"__meta_consul_node", "__address__"}, Regex: "(.+);.+:(\\d+)", TargetLabel: ADDRESS_LABEL, Replacement: "$1.monitoring.example.com:$2"}},
+			"[pg1-a.monitoring.example.com:5432 pg1-b.monitoring.example.com:5432 pg2-a.monitoring.example.com:5432]",
+		},
+		{
+			"with addresses replaced by the same one",
+			[]RelabelOpts{{SourceLabels: []string{"__meta_consul_metadata_cluster"}, TargetLabel: ADDRESS_LABEL, Replacement: "$1.example.com:5432"}},
+			"[pg1.example.com:5432 pg2.example.com:5432]",
+		},
+		{
+			// The address of a target without state is removed
+			"with address removed",
+			[]RelabelOpts{
+				{SourceLabels: []string{"__meta_consul_metadata_state"}, TargetLabel: ADDRESS_LABEL},
+				{SourceLabels: []string{"__meta_consul_node"}, Regex: "(pg1-.)", TargetLabel: ADDRESS_LABEL, Replacement: "$1:5432"},
+			},
+			"[pg1-a:5432 pg1-b:5432]",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var relabels []*Relabel
+			for _, opts := range tc.opts {
+				r, err := NewRelabel(opts)
+				if err != nil {
+					t.Fatalf("could not create relabel: %v", err)
+				}
+				relabels = append(relabels, r)
+			}
+
+			got := Hosts(ApplyRelabel(targets, relabels))
+			if fmt.Sprint(got) != tc.expected {
+				t.Errorf("got %v, expect %v", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRelabelProcess(t *testing.T) {
+	labels := map[string]string{
+		"__address__":                    "192.168.0.1:5432",
+		"__meta_consul_node":             "pg1-a",
+		"__meta_consul_metadata_cluster": "pg1",
+		"__meta_consul_metadata_az":      "gra1",
+	}
+
+	tests := []struct {
+		name     string
+		opts     RelabelOpts
+		expected map[string]string
+	}{
+		{
+			"with replace",
+			RelabelOpts{SourceLabels: []string{"__meta_consul_metadata_az"}, Regex: "([a-z]+)\\d+", TargetLabel: "region"},
+			map[string]string{"region": "gra"},
+		},
+		{
+			"with replace not matching",
+			RelabelOpts{SourceLabels: []string{"__meta_consul_metadata_az"}, Regex: "sbg.*", TargetLabel: "region"},
+			map[string]string{},
+		},
+		{
+			"with labelmap",
+			RelabelOpts{Action: RELABEL_ACTION_LABELMAP, Regex: "__meta_consul_metadata_(.+)"},
+			map[string]string{"cluster": "pg1", "az": "gra1"},
+		},
+		{
+			"with hashmod",
+			RelabelOpts{Action: RELABEL_ACTION_HASHMOD, SourceLabels: []string{"__address__"}, Modulus: 8, TargetLabel: "__tmp_hash"},
+			map[string]string{"__tmp_hash": "6"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRelabel(tc.opts)
+			if err != nil {
+				t.Fatalf("could not create relabel: %v", err)
+			}
+
+			got := map[string]string{}
+			for k, v := range labels {
+				got[k] = v
+			}
+			got, keep := r.Process(got)
+			if !keep {
+				t.Fatalf("got target dropped, expect it kept")
+			}
+			for k, v := range tc.expected {
+				if got[k] != v {
+					t.Errorf("got %s=%q, expect %q", k, got[k], v)
+				}
+			}
+			if len(got) != len(labels)+len(tc.expected) {
+				t.Errorf("got labels %v, expect %v added to %v", got, tc.expected, labels)
+			}
+		})
+	}
+}
+
+func TestNewRelabel(t *testing.T) {
+	tests := []struct {
+		name string
+		opts RelabelOpts
+		err  bool
+	}{
+		{"with defaults", RelabelOpts{TargetLabel: "node"}, false},
+		{"without target label", RelabelOpts{SourceLabels: []string{"__meta_consul_node"}}, true},
+		{"with hashmod without modulus", RelabelOpts{Action: RELABEL_ACTION_HASHMOD, TargetLabel: "__tmp_hash"}, true},
+		{"with unknown action", RelabelOpts{Action: "labelkeep"}, true},
+		{"with invalid regex", RelabelOpts{Action: RELABEL_ACTION_KEEP, Regex: "("}, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewRelabel(tc.opts)
+			if tc.err != (err != nil) {
+				t.Errorf("got error %v, expect error %v", err, tc.err)
+			}
+		})
+	}
+}
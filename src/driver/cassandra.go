@@ -0,0 +1,330 @@
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+const (
+	CASSANDRA_DRIVER                   = "cassandra"
+	CASSANDRA_PORT                     = 9042
+	CASSANDRA_CONSISTENCY              = "QUORUM"
+	CASSANDRA_TABLE_NOT_FOUND_ERROR    = "unconfigured table"
+	CASSANDRA_KEYSPACE_NOT_FOUND_ERROR = "does not exist"
+)
+
+type CassandraOpts struct {
+	Hosts            []string
+	Port             int
+	Username         string
+	Password         string
+	Timeout          int
+	Keyspace         string
+	Table            string
+	Create           bool
+	ReadConsistency  string
+	WriteConsistency string
+	Datacenter       string // route queries to the hosts of this datacenter first
+	TLS              bool
+	SkipVerify       bool
+	Logger           *slog.Logger
+}
+
+type Cassandra struct {
+	opts             CassandraOpts
+	cluster          *gocql.ClusterConfig
+	session          *gocql.Session
+	table            string // quoted table name
+	readConsistency  gocql.Consistency
+	writeConsistency gocql.Consistency
+	logger           *slog.Logger
+}
+
+func NewCassandra(opts CassandraOpts) (c *Cassandra, err error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = TIMEOUT
+	}
+
+	if opts.Table == "" {
+		return nil, fmt.Errorf("table name is required")
+	}
+
+	// Quoted names are case sensitive, so they are folded to lower case as
+	// unquoted names are, to keep targeting the same table
+	opts.Keyspace = strings.ToLower(opts.Keyspace)
+	parts, err := parseTableName(strings.ToLower(opts.Table))
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 1 && opts.Keyspace == "" {
+		return nil, fmt.Errorf("keyspace is required")
+	}
+	if opts.Keyspace != "" {
+		if err = validateIdentifier(opts.Keyspace); err != nil {
+			return nil, fmt.Errorf("invalid keyspace name: %w", err)
+		}
+	}
+
+	if opts.ReadConsistency == "" {
+		opts.ReadConsistency = CASSANDRA_CONSISTENCY
+	}
+	readConsistency, err := gocql.ParseConsistencyWrapper(opts.ReadConsistency)
+	if err != nil {
+		return nil, fmt.Errorf("invalid read consistency: %w", err)
+	}
+	if opts.WriteConsistency == "" {
+		opts.WriteConsistency = CASSANDRA_CONSISTENCY
+	}
+	writeConsistency, err := gocql.ParseConsistencyWrapper(opts.WriteConsistency)
+	if err != nil {
+		return nil, fmt.Errorf("invalid write consistency: %w", err)
+	}
+
+	// Cassandra hosts expect a port
+	var hosts []string
+	port := CASSANDRA_PORT
+	if opts.Port != 0 {
+		port = opts.Port
+	}
+	for _, h := range opts.Hosts {
+		if !strings.Contains(h, ":") {
+			hosts = append(hosts, h+":"+strconv.Itoa(port))
+		} else {
+			hosts = append(hosts, h)
+		}
+	}
+
+	cluster := gocql.NewCluster(hosts...)
+	cluster.Keyspace = opts.Keyspace
+	cluster.Timeout = time.Duration(opts.Timeout) * time.Second
+	cluster.ConnectTimeout = time.Duration(opts.Timeout) * time.Second
+	// A single connection per host is enough for one query at a time
+	cluster.NumConns = 1
+
+	if opts.Datacenter != "" {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.DCAwareRoundRobinPolicy(opts.Datacenter))
+	} else {
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(gocql.RoundRobinHostPolicy())
+	}
+
+	if opts.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: opts.Username,
+			Password: opts.Password,
+		}
+	}
+
+	if opts.TLS || opts.SkipVerify {
+		cluster.SslOpts = &gocql.SslOptions{
+			Config:                 &tls.Config{InsecureSkipVerify: opts.SkipVerify},
+			EnableHostVerification: !opts.SkipVerify,
+		}
+	}
+
+	var logger *slog.Logger
+	if opts.Logger != nil {
+		logger = opts.Logger.With("driver", CASSANDRA_DRIVER)
+	} else {
+		logger = slog.With("driver", CASSANDRA_DRIVER)
+	}
+
+	return &Cassandra{
+		opts:             opts,
+		cluster:          cluster,
+		table:            quoteDoubleQuotes(parts...),
+		readConsistency:  readConsistency,
+		writeConsistency: writeConsistency,
+		logger:           logger,
+	}, nil
+}
+
+// Sessions are created without a context, so the creation runs aside and the
+// session is closed once created when ctx is done first
+func (c *Cassandra) Connect(ctx context.Context) error {
+	c.logger.Debug("connecting")
+
+	type result struct {
+		session *gocql.Session
+		err     error
+	}
+	created := make(chan result, 1)
+	go func() {
+		session, err := c.cluster.CreateSession()
+		created <- result{session, err}
+	}()
+
+	select {
+	case r := <-created:
+		if r.err != nil {
+			return r.err
+		}
+		c.session = r.session
+	case <-ctx.Done():
+		go func() {
+			if r := <-created; r.err == nil {
+				r.session.Close()
+			}
+		}()
+		return ctx.Err()
+	}
+
+	c.logger.Debug("connected")
+	return nil
+}
+
+func (c *Cassandra) Read(ctx context.Context) error {
+	c.logger.Debug("reading")
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
+	defer cancel()
+
+	var ts time.Time
+	err := c.session.Query(fmt.Sprintf("SELECT ts FROM %s WHERE id = 1", c.table)).
+		WithContext(ctx).Consistency(c.readConsistency).Scan(&ts)
+	if err != nil {
+		if (errors.Is(err, gocql.ErrNotFound) || strings.Contains(err.Error(), CASSANDRA_TABLE_NOT_FOUND_ERROR)) && c.opts.Create {
+			return c.Write(ctx)
+		}
+		return err
+	}
+
+	c.logger.Debug("read", slog.Any("ts", ts))
+	return nil
+}
+
+func (c *Cassandra) Write(ctx context.Context) error {
+	c.logger.Debug("writing")
+	err := c.insert(ctx)
+	if err != nil && strings.Contains(err.Error(), CASSANDRA_TABLE_NOT_FOUND_ERROR) && c.opts.Create {
+		if err = c.createTable(ctx); err != nil {
+			return err
+		}
+		return c.insert(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.logger.Debug("written")
+	return nil
+}
+
+func (c *Cassandra) insert(ctx context.Context) error {
+	c.logger.Debug("inserting")
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
+	defer cancel()
+	return c.session.Query(fmt.Sprintf("INSERT INTO %s (id, ts) VALUES (1, toTimestamp(now()))", c.table)).
+		WithContext(ctx).Consistency(c.writeConsistency).Exec()
+}
+
+// The keyspace is not created, as its replication strategy depends on the
+// topology of the cluster
+func (c *Cassandra) createTable(ctx context.Context) error {
+	c.logger.Debug("creating table")
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
+	defer cancel()
+	return c.session.Query(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id int PRIMARY KEY, ts timestamp, token text)", c.table)).
+		WithContext(ctx).Exec()
+}
+
+func (c *Cassandra) WriteToken(ctx context.Context, token string) error {
+	c.logger.Debug("writing token")
+	err := c.insertToken(ctx, token)
+	if err != nil && strings.Contains(err.Error(), CASSANDRA_TABLE_NOT_FOUND_ERROR) && c.opts.Create {
+		if err = c.createTable(ctx); err != nil {
+			return err
+		}
+		err = c.insertToken(ctx, token)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.logger.Debug("token written", slog.Any("token", token))
+	return nil
+}
+
+func (c *Cassandra) insertToken(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
+	defer cancel()
+	return c.session.Query(fmt.Sprintf("INSERT INTO %s (id, ts, token) VALUES (1, toTimestamp(now()), ?)", c.table), token).
+		WithContext(ctx).Consistency(c.writeConsistency).Exec()
+}
+
+// ReadToken returns the token and timestamp of the canary row, or an empty
+// token when the row or the table does not exist yet and create is enabled
+func (c *Cassandra) ReadToken(ctx context.Context) (token string, ts time.Time, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
+	defer cancel()
+
+	var value *string
+	err = c.session.Query(fmt.Sprintf("SELECT token, ts FROM %s WHERE id = 1", c.table)).
+		WithContext(ctx).Consistency(c.readConsistency).Scan(&value, &ts)
+	if errors.Is(err, gocql.ErrNotFound) && !c.opts.Create {
+		return "", time.Time{}, ErrKeyNotFound
+	}
+	if errors.Is(err, gocql.ErrNotFound) {
+		return "", time.Time{}, nil
+	}
+	// The table is created by the next token write
+	if err != nil && c.opts.Create && strings.Contains(err.Error(), CASSANDRA_TABLE_NOT_FOUND_ERROR) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if value != nil {
+		token = *value
+	}
+	return token, ts, nil
+}
+
+func (c *Cassandra) Disconnect(ctx context.Context) error {
+	if c.session != nil {
+		c.logger.Debug("disconnecting")
+		c.session.Close()
+		c.logger.Debug("disconnected")
+	}
+	return nil
+}
+
+// Classify maps CQL error codes to a failure reason
+func (c *Cassandra) Classify(err error) string {
+	switch {
+	case errors.Is(err, gocql.ErrNotFound), errors.Is(err, gocql.ErrKeyspaceDoesNotExist):
+		return REASON_NOT_FOUND
+	case errors.Is(err, gocql.ErrTimeoutNoResponse):
+		return REASON_TIMEOUT
+	case errors.Is(err, gocql.ErrNoConnections), errors.Is(err, gocql.ErrNoConnectionsStarted):
+		return REASON_CONNECTION
+	}
+
+	var requestErr gocql.RequestError
+	if !errors.As(err, &requestErr) {
+		return ""
+	}
+	switch requestErr.Code() {
+	case gocql.ErrCodeCredentials:
+		return REASON_AUTHENTICATION
+	case gocql.ErrCodeUnauthorized:
+		return REASON_PERMISSION
+	case gocql.ErrCodeInvalid:
+		message := requestErr.Message()
+		if strings.Contains(message, CASSANDRA_TABLE_NOT_FOUND_ERROR) || strings.Contains(message, CASSANDRA_KEYSPACE_NOT_FOUND_ERROR) {
+			return REASON_NOT_FOUND
+		}
+	case gocql.ErrCodeReadTimeout, gocql.ErrCodeWriteTimeout:
+		return REASON_TIMEOUT
+	case gocql.ErrCodeUnavailable, gocql.ErrCodeOverloaded, gocql.ErrCodeBootstrapping, gocql.ErrCodeReadFailure, gocql.ErrCodeWriteFailure:
+		return REASON_UNAVAILABLE
+	}
+	return ""
+}
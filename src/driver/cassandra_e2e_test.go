@@ -0,0 +1,22 @@
+//go:build e2e
+
+package driver
+
+import "testing"
+
+func TestCassandraE2E(t *testing.T) {
+	d, err := NewCassandra(CassandraOpts{
+		Hosts:    []string{e2eHost("CASSANDRA", "127.0.0.1")},
+		Port:     e2ePort("CASSANDRA", 9042),
+		Username: e2eEnv("CASSANDRA", "USERNAME", ""),
+		Password: e2eEnv("CASSANDRA", "PASSWORD", ""),
+		Keyspace: e2eEnv("CASSANDRA", "KEYSPACE", "canary"),
+		Table:    "canary_ng",
+		Create:   true,
+	})
+	if err != nil {
+		t.Fatalf("new cassandra: %v", err)
+	}
+
+	runDriverE2E(t, d)
+}
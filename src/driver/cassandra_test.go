@@ -0,0 +1,112 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestCassandraHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    CassandraOpts
+		expected string
+	}{
+		{"with single host", CassandraOpts{Hosts: []string{"127.0.0.1"}, Keyspace: "canary", Table: "canary_ng"}, "127.0.0.1:9042"},
+		{"with single host and port", CassandraOpts{Hosts: []string{"127.0.0.1:9043"}, Keyspace: "canary", Table: "canary_ng"}, "127.0.0.1:9043"},
+		{"with multiple hosts and port", CassandraOpts{Hosts: []string{"192.168.0.1", "192.168.0.2"}, Port: 9043, Keyspace: "canary", Table: "canary_ng"}, "192.168.0.1:9043,192.168.0.2:9043"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewCassandra(tc.input)
+			if err != nil {
+				t.Fatalf("could not create cassandra: %v", err)
+			}
+
+			got := strings.Join(c.cluster.Hosts, ",")
+			if got != tc.expected {
+				t.Errorf("got %s, expect %s", got, tc.expected)
+			}
+
+			t.Logf("got %s", got)
+		})
+	}
+}
+
+func TestCassandraOpts(t *testing.T) {
+	tests := []struct {
+		name  string
+		input CassandraOpts
+		table string
+		read  gocql.Consistency
+		write gocql.Consistency
+		valid bool
+	}{
+		{"with defaults", CassandraOpts{Keyspace: "canary", Table: "canary_ng"}, `"canary_ng"`, gocql.Quorum, gocql.Quorum, true},
+		{"with upper case keyspace", CassandraOpts{Keyspace: "Canary", Table: "canary_ng"}, `"canary_ng"`, gocql.Quorum, gocql.Quorum, true},
+		{"with consistencies", CassandraOpts{Keyspace: "canary", Table: "canary_ng", ReadConsistency: "one", WriteConsistency: "LOCAL_QUORUM"}, `"canary_ng"`, gocql.One, gocql.LocalQuorum, true},
+		{"with keyspace in table", CassandraOpts{Table: "monitoring.canary_ng"}, `"monitoring"."canary_ng"`, gocql.Quorum, gocql.Quorum, true},
+		{"with upper case names", CassandraOpts{Table: "Monitoring.Canary_NG"}, `"monitoring"."canary_ng"`, gocql.Quorum, gocql.Quorum, true},
+		{"without keyspace", CassandraOpts{Table: "canary_ng"}, "", 0, 0, false},
+		{"with invalid consistency", CassandraOpts{Keyspace: "canary", Table: "canary_ng", ReadConsistency: "MOST"}, "", 0, 0, false},
+		{"with invalid table", CassandraOpts{Keyspace: "canary", Table: "canary_ng;"}, "", 0, 0, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewCassandra(tc.input)
+			if (err == nil) != tc.valid {
+				t.Fatalf("got error %v, expect valid %t", err, tc.valid)
+			}
+			if !tc.valid {
+				return
+			}
+
+			if c.table != tc.table || c.readConsistency != tc.read || c.writeConsistency != tc.write {
+				t.Errorf("got %s, %s and %s, expect %s, %s and %s", c.table, c.readConsistency, c.writeConsistency, tc.table, tc.read, tc.write)
+			}
+			if c.cluster.Keyspace != strings.ToLower(tc.input.Keyspace) {
+				t.Errorf("got keyspace %s, expect %s", c.cluster.Keyspace, strings.ToLower(tc.input.Keyspace))
+			}
+		})
+	}
+}
+
+func TestCassandraConnectCancel(t *testing.T) {
+	// A host accepting connections without ever answering
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c, err := NewCassandra(CassandraOpts{Hosts: []string{silent.Addr().String()}, Keyspace: "canary", Table: "canary_ng", Timeout: 10})
+	if err != nil {
+		t.Fatalf("new cassandra: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = c.Connect(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, expect %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("got %v to return, expect ctx to interrupt the connection", elapsed)
+	}
+}
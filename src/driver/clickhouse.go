@@ -3,8 +3,11 @@ package driver
 import (
 	"context"
 	"crypto/tls"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -14,30 +17,43 @@ import (
 )
 
 const (
-	CLICKHOUSE_DRIVER                       = "clickhouse"
-	CLICKHOUSE_TABLE_NOT_FOUND_ERROR_PREFIX = "code: 60,"
+	CLICKHOUSE_DRIVER                        = "clickhouse"
+	CLICKHOUSE_TABLE_NOT_FOUND_ERROR_PREFIX  = "code: 60,"
+	CLICKHOUSE_COLUMN_NOT_FOUND_ERROR_PREFIX = "code: 16,"
+	CLICKHOUSE_UNKNOWN_IDENTIFIER_PREFIX     = "code: 47,"
 )
 
 type ClickhousebOpts struct {
-	DSN        string
-	Hosts      []string
-	Port       int
-	Database   string
-	Username   string
-	Password   string
-	Timeout    int
-	Secure     bool
-	SkipVerify bool
-	Logger     *slog.Logger
-	Table      string
-	Create     bool
-	Cluster    string
+	DSN         string
+	Hosts       []string
+	Port        int
+	Database    string
+	Username    string
+	Password    string
+	Timeout     int
+	Secure      bool
+	SkipVerify  bool
+	Logger      *slog.Logger
+	Table       string
+	Create      bool
+	Cluster     string
+	ReadQuery   string // replaces the canary table read
+	ReadParams  []any
+	WriteQuery  string // replaces the canary table write
+	WriteParams []any
+	Assertions  []*Assertion
 }
 
 type Clickhouse struct {
 	opts   ClickhousebOpts
 	conn   driver.Conn
+	table  string // quoted table name
+	chunk  string // quoted name of the local replicated table in a cluster
 	logger *slog.Logger
+
+	// Arguments of the Distributed engine, validated names written as literals
+	shardDatabase string
+	shardTable    string
 }
 
 func NewClickhouse(opts ClickhousebOpts) (c *Clickhouse, err error) {
@@ -45,10 +61,22 @@ func NewClickhouse(opts ClickhousebOpts) (c *Clickhouse, err error) {
 		opts.Timeout = TIMEOUT
 	}
 
-	if opts.Table == "" {
+	if opts.Table == "" && opts.ReadQuery == "" && opts.WriteQuery == "" {
 		return nil, fmt.Errorf("table name is required")
 	}
 
+	if opts.Database != "" {
+		if err = validateIdentifier(opts.Database); err != nil {
+			return nil, fmt.Errorf("invalid database name: %w", err)
+		}
+	}
+
+	if opts.Cluster != "" {
+		if err = validateIdentifier(opts.Cluster); err != nil {
+			return nil, fmt.Errorf("invalid cluster name: %w", err)
+		}
+	}
+
 	var logger *slog.Logger
 	if opts.Logger != nil {
 		logger = opts.Logger.With("driver", CLICKHOUSE_DRIVER)
@@ -57,14 +85,31 @@ func NewClickhouse(opts ClickhousebOpts) (c *Clickhouse, err error) {
 	}
 
 	c = &Clickhouse{
-		opts:   opts,
-		logger: logger,
+		opts:          opts,
+		logger:        logger,
+		shardDatabase: opts.Database,
+	}
+
+	if opts.Table != "" {
+		parts, err := parseTableName(opts.Table)
+		if err != nil {
+			return nil, err
+		}
+		c.table = quoteBackticks(parts...)
+
+		// The replicated table lives next to the distributed one
+		last := len(parts) - 1
+		c.shardTable = parts[last] + "_chunk"
+		if last > 0 {
+			c.shardDatabase = parts[0]
+		}
+		c.chunk = quoteBackticks(append(parts[:last:last], c.shardTable)...)
 	}
 
 	return c, nil
 }
 
-func (c *Clickhouse) Connect() (err error) {
+func (c *Clickhouse) Connect(ctx context.Context) (err error) {
 	opts := &clickhouse.Options{
 		Auth: clickhouse.Auth{
 			Database: "default",
@@ -117,7 +162,7 @@ func (c *Clickhouse) Connect() (err error) {
 	}
 
 	c.logger.Debug("pinging")
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
 	defer cancel()
 	if err = conn.Ping(ctx); err != nil {
 		return err
@@ -128,14 +173,17 @@ func (c *Clickhouse) Connect() (err error) {
 	return nil
 }
 
-func (c *Clickhouse) Read() (err error) {
+func (c *Clickhouse) Read(ctx context.Context) (err error) {
 	c.logger.Debug("reading")
 	var ts string
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
 	defer cancel()
-	if err = c.conn.QueryRow(ctx, fmt.Sprintf("SELECT formatDateTime(ts, '%%Y-%%m-%%d %%H:%%i:%%s%%z') FROM %s", c.opts.Table)).Scan(&ts); err != nil {
+	if c.opts.ReadQuery != "" {
+		return c.readQuery(ctx)
+	}
+	if err = c.conn.QueryRow(ctx, fmt.Sprintf("SELECT formatDateTime(ts, '%%Y-%%m-%%d %%H:%%i:%%s%%z') FROM %s", c.table)).Scan(&ts); err != nil {
 		if strings.HasPrefix(err.Error(), CLICKHOUSE_TABLE_NOT_FOUND_ERROR_PREFIX) && c.opts.Create {
-			if err = c.Write(); err != nil {
+			if err = c.Write(ctx); err != nil {
 				return err
 			}
 		}
@@ -146,72 +194,198 @@ func (c *Clickhouse) Read() (err error) {
 	return nil
 }
 
-func (c *Clickhouse) Write() (err error) {
+// Run the custom read query and check its result against the assertions
+func (c *Clickhouse) readQuery(ctx context.Context) (err error) {
+	rows, err := c.conn.Query(ctx, c.opts.ReadQuery, c.opts.ReadParams...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	result := Result{Columns: rows.Columns()}
+	types := rows.ColumnTypes()
+	for rows.Next() {
+		// Values are scanned into their column type, dereferenced by the
+		// assertions
+		values := make([]any, len(types))
+		for i, t := range types {
+			values[i] = reflect.New(t.ScanType()).Interface()
+		}
+		if err = rows.Scan(values...); err != nil {
+			return err
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	c.logger.Debug("read", slog.Int("rows", len(result.Rows)))
+	return Assert(result, c.opts.Assertions)
+}
+
+func (c *Clickhouse) Write(ctx context.Context) (err error) {
 	c.logger.Debug("writing")
-	err = c.insert()
+	if c.opts.WriteQuery != "" {
+		return c.writeQuery(ctx)
+	}
+	err = c.insert(ctx)
 	if err != nil && strings.HasPrefix(err.Error(), CLICKHOUSE_TABLE_NOT_FOUND_ERROR_PREFIX) && c.opts.Create {
-		if err = c.createTable(); err != nil {
+		if err = c.createTable(ctx); err != nil {
 			return err
 		}
-		return c.insert()
+		return c.insert(ctx)
+	}
+	if err != nil {
+		return err
 	}
 
 	c.logger.Debug("written")
 	return nil
 }
 
-func (c *Clickhouse) insert() (err error) {
+// Run the custom write query
+func (c *Clickhouse) writeQuery(ctx context.Context) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
+	defer cancel()
+	if err = c.conn.Exec(ctx, c.opts.WriteQuery, c.opts.WriteParams...); err != nil {
+		return err
+	}
+	c.logger.Debug("written")
+	return nil
+}
+
+func (c *Clickhouse) insert(ctx context.Context) (err error) {
 	c.logger.Debug("inserting")
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
 	defer cancel()
-	return c.conn.Exec(ctx, fmt.Sprintf("INSERT INTO %s (id, ts) VALUES (1, now64())", c.opts.Table))
+	return c.conn.Exec(ctx, fmt.Sprintf("INSERT INTO %s (id, ts) VALUES (1, now64())", c.table))
 }
 
-func (c *Clickhouse) createTable() (err error) {
+func (c *Clickhouse) createTable(ctx context.Context) (err error) {
 	if c.opts.Cluster != "" {
-		if err = c.createReplicatedTable(); err != nil {
+		if err = c.createReplicatedTable(ctx); err != nil {
 			return err
 		}
-		if err = c.createDistributedTable(); err != nil {
+		if err = c.createDistributedTable(ctx); err != nil {
 			return err
 		}
 		return nil
 	} else {
-		return c.createLocalTable()
+		return c.createLocalTable(ctx)
 	}
 }
 
-func (c *Clickhouse) createLocalTable() (err error) {
+func (c *Clickhouse) createLocalTable(ctx context.Context) (err error) {
 	c.logger.Debug("creating local table")
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
 	defer cancel()
-	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id int, ts DateTime64(3)) ENGINE ReplacingMergeTree ORDER BY id PRIMARY KEY id", c.opts.Table)
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id int, ts DateTime64(3), token String) ENGINE ReplacingMergeTree ORDER BY id PRIMARY KEY id", c.table)
 	return c.conn.Exec(ctx, query)
 }
 
-func (c *Clickhouse) createReplicatedTable() (err error) {
+func (c *Clickhouse) createReplicatedTable(ctx context.Context) (err error) {
 	c.logger.Debug("creating replicated table")
 	if c.opts.Cluster == "" {
 		return fmt.Errorf("cluster is not defined")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
 	defer cancel()
-	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s_chunk ON CLUSTER '%s' (id int, ts DateTime64(3)) ENGINE ReplicatedReplacingMergeTree ORDER BY id PRIMARY KEY id", c.opts.Table, c.opts.Cluster)
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ON CLUSTER %s (id int, ts DateTime64(3), token String) ENGINE ReplicatedReplacingMergeTree ORDER BY id PRIMARY KEY id", c.chunk, quoteBackticks(c.opts.Cluster))
 	return c.conn.Exec(ctx, query)
 }
 
-func (c *Clickhouse) createDistributedTable() (err error) {
+func (c *Clickhouse) createDistributedTable(ctx context.Context) (err error) {
 	c.logger.Debug("creating distributed table")
 	if c.opts.Cluster == "" {
 		return fmt.Errorf("cluster is not defined")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
 	defer cancel()
-	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ON CLUSTER '%s' (id int, ts DateTime64(3)) ENGINE Distributed('%s', '%s', %s_chunk, rand())", c.opts.Table, c.opts.Cluster, c.opts.Cluster, c.opts.Database, c.opts.Table)
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ON CLUSTER %s (id int, ts DateTime64(3), token String) ENGINE Distributed('%s', '%s', '%s', rand())", c.table, quoteBackticks(c.opts.Cluster), c.opts.Cluster, c.shardDatabase, c.shardTable)
 	return c.conn.Exec(ctx, query)
 }
 
-func (c *Clickhouse) Disconnect() (err error) {
+func (c *Clickhouse) WriteToken(ctx context.Context, token string) (err error) {
+	c.logger.Debug("writing token")
+	err = c.insertToken(ctx, token)
+	if err != nil && c.opts.Create {
+		switch {
+		case strings.HasPrefix(err.Error(), CLICKHOUSE_TABLE_NOT_FOUND_ERROR_PREFIX):
+			err = c.createTable(ctx)
+		case strings.HasPrefix(err.Error(), CLICKHOUSE_COLUMN_NOT_FOUND_ERROR_PREFIX):
+			err = c.addTokenColumn(ctx)
+		default:
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		err = c.insertToken(ctx, token)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.logger.Debug("token written", slog.Any("token", token))
+	return nil
+}
+
+// In a cluster, tokens are written to and read from the local replicated table
+// so replicas of the same shard are compared, whatever the distributed table
+// sharding
+func (c *Clickhouse) tokenTable() string {
+	if c.opts.Cluster != "" {
+		return c.chunk
+	}
+	return c.table
+}
+
+func (c *Clickhouse) insertToken(ctx context.Context, token string) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
+	defer cancel()
+	return c.conn.Exec(ctx, fmt.Sprintf("INSERT INTO %s (id, ts, token) VALUES (1, now64(), ?)", c.tokenTable()), token)
+}
+
+// Tables created before tokens were introduced lack the token column
+func (c *Clickhouse) addTokenColumn(ctx context.Context) (err error) {
+	c.logger.Debug("adding token column")
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
+	defer cancel()
+	if c.opts.Cluster == "" {
+		return c.conn.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS token String", c.table))
+	}
+	for _, table := range []string{c.chunk, c.table} {
+		if err = c.conn.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ON CLUSTER %s ADD COLUMN IF NOT EXISTS token String", table, quoteBackticks(c.opts.Cluster))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadToken returns the token and timestamp of the latest canary row, or an
+// empty token when no row or table exists yet and create is enabled
+func (c *Clickhouse) ReadToken(ctx context.Context) (token string, ts time.Time, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.opts.Timeout)*time.Second)
+	defer cancel()
+	err = c.conn.QueryRow(ctx, fmt.Sprintf("SELECT token, ts FROM %s WHERE id = 1 ORDER BY ts DESC LIMIT 1", c.tokenTable())).Scan(&token, &ts)
+	if errors.Is(err, sql.ErrNoRows) && !c.opts.Create {
+		return "", time.Time{}, ErrKeyNotFound
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", time.Time{}, nil
+	}
+	// The table or its token column are created by the next token write
+	if err != nil && c.opts.Create && (strings.HasPrefix(err.Error(), CLICKHOUSE_TABLE_NOT_FOUND_ERROR_PREFIX) || strings.HasPrefix(err.Error(), CLICKHOUSE_UNKNOWN_IDENTIFIER_PREFIX)) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, ts, nil
+}
+
+func (c *Clickhouse) Disconnect(ctx context.Context) (err error) {
 	if c.conn != nil {
 		c.logger.Debug("disconnecting")
 		err := c.conn.Close()
@@ -222,3 +396,28 @@ func (c *Clickhouse) Disconnect() (err error) {
 	}
 	return nil
 }
+
+// Classify maps ClickHouse exception codes to a failure reason
+func (c *Clickhouse) Classify(err error) string {
+	var exception *clickhouse.Exception
+	if !errors.As(err, &exception) {
+		return ""
+	}
+	switch exception.Code {
+	case 192, 193, 194, 516: // UNKNOWN_USER, WRONG_PASSWORD, REQUIRED_PASSWORD, AUTHENTICATION_FAILED
+		return REASON_AUTHENTICATION
+	case 497: // ACCESS_DENIED
+		return REASON_PERMISSION
+	case 16, 47, 60, 81: // NO_SUCH_COLUMN_IN_TABLE, UNKNOWN_IDENTIFIER, UNKNOWN_TABLE, UNKNOWN_DATABASE
+		return REASON_NOT_FOUND
+	case 164, 242: // READONLY, TABLE_IS_READ_ONLY
+		return REASON_READ_ONLY
+	case 159, 209: // TIMEOUT_EXCEEDED, SOCKET_TIMEOUT
+		return REASON_TIMEOUT
+	case 210: // NETWORK_ERROR
+		return REASON_CONNECTION
+	case 202, 203: // TOO_MANY_SIMULTANEOUS_QUERIES, NO_FREE_CONNECTION
+		return REASON_UNAVAILABLE
+	}
+	return ""
+}
@@ -58,6 +58,11 @@ func TestConsulDiscoveryE2E(t *testing.T) {
 		"clickhouse": "clickhouse",
 		"valkey":     "valkey",
 		"etcd":       "etcd",
+		"cassandra":  "scylladb",
+		"kafka":      "kafka",
+		"rabbitmq":   "rabbitmq",
+		"opensearch": "opensearch",
+		"memcached":  "memcached",
 	}
 
 	for driver, address := range backends {
@@ -77,7 +82,7 @@ func TestConsulDiscoveryE2E(t *testing.T) {
 	}
 
 	metric := "canary_ng_jobs"
-	jobs := []string{"postgresql", "mysql", "mongodb", "clickhouse", "valkey", "etcd"}
+	jobs := []string{"postgresql", "mysql", "mongodb", "clickhouse", "valkey", "etcd", "cassandra", "kafka", "rabbitmq", "opensearch", "memcached"}
 
 	deadline := time.Now().Add(90 * time.Second)
 	for {
@@ -1,12 +1,37 @@
 package driver
 
+import (
+	"context"
+	"time"
+)
+
 const (
 	TIMEOUT = 3
 )
 
+// Driver performs the canary queries against a datastore. Drivers derive their
+// per-query timeouts from the given context so cancelling it interrupts the
+// query in flight.
 type Driver interface {
-	Connect() error
-	Read() error
-	Write() error
-	Disconnect() error
+	Connect(ctx context.Context) error
+	Read(ctx context.Context) error
+	Write(ctx context.Context) error
+	Disconnect(ctx context.Context) error
+}
+
+// Tokenized is implemented by drivers able to write a unique token and to read
+// it back along with the time it was written. Jobs use it to verify a read
+// returns what was written and to measure replication lag.
+type Tokenized interface {
+	WriteToken(ctx context.Context, token string) error
+	ReadToken(ctx context.Context) (token string, ts time.Time, err error)
+}
+
+// Queued is implemented by drivers reading back what they wrote through a
+// queue, such as a message broker. Jobs write the token before reading it, so
+// the age of the value read is the delay for a message to be delivered.
+// Queued is a marker, its method does nothing.
+type Queued interface {
+	Tokenized
+	Queued()
 }
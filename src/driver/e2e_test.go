@@ -3,6 +3,8 @@
 package driver
 
 import (
+	"context"
+	"crypto/rand"
 	"os"
 	"strconv"
 	"testing"
@@ -34,20 +36,51 @@ func e2ePort(driver string, def int) int {
 func runDriverE2E(t *testing.T, d Driver) {
 	t.Helper()
 
-	if err := d.Connect(); err != nil {
+	ctx := context.Background()
+
+	if err := d.Connect(ctx); err != nil {
 		t.Fatalf("connect: %v", err)
 	}
 	defer func() {
-		if err := d.Disconnect(); err != nil {
+		if err := d.Disconnect(ctx); err != nil {
 			t.Errorf("disconnect: %v", err)
 		}
 	}()
 
-	if err := d.Write(); err != nil {
+	if err := d.Write(ctx); err != nil {
 		t.Fatalf("write: %v", err)
 	}
 
-	if err := d.Read(); err != nil {
+	if err := d.Read(ctx); err != nil {
 		t.Fatalf("read: %v", err)
 	}
 }
+
+// runTokenE2E writes a token and checks the next read returns it, as read_write
+// jobs of queued drivers do
+func runTokenE2E(t *testing.T, d Driver) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	if err := d.Connect(ctx); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer d.Disconnect(ctx)
+
+	tokenized := d.(Tokenized)
+	token := rand.Text()
+	if err := tokenized.WriteToken(ctx, token); err != nil {
+		t.Fatalf("write token: %v", err)
+	}
+	got, ts, err := tokenized.ReadToken(ctx)
+	if err != nil {
+		t.Fatalf("read token: %v", err)
+	}
+	if got != token {
+		t.Errorf("got %s, expect %s", got, token)
+	}
+	if ts.IsZero() {
+		t.Error("got zero timestamp")
+	}
+}
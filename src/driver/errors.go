@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Reasons a query can fail for, shared by all drivers so failures can be
+// compared across datastores
+const (
+	REASON_ASSERTION      = "assertion"
+	REASON_AUTHENTICATION = "authentication"
+	REASON_CANCELED       = "canceled"
+	REASON_CONNECTION     = "connection"
+	REASON_DNS            = "dns"
+	REASON_NOT_FOUND      = "not_found"
+	REASON_PERMISSION     = "permission"
+	REASON_READ_ONLY      = "read_only"
+	REASON_TIMEOUT        = "timeout"
+	REASON_TLS            = "tls"
+	REASON_UNAVAILABLE    = "unavailable"
+	REASON_UNKNOWN        = "unknown"
+)
+
+// Returned when the canary key or message does not exist and create is
+// disabled
+var ErrKeyNotFound = errors.New("key does not exist")
+
+// Classifier is implemented by drivers able to map their native errors to a
+// failure reason. Classify returns an empty string for errors it does not
+// recognize.
+type Classifier interface {
+	Classify(err error) string
+}
+
+// Reason returns the failure reason of an error returned by a driver, trying
+// the driver's own classification before the generic one
+func Reason(d Driver, err error) string {
+	if c, ok := d.(Classifier); ok {
+		if reason := c.Classify(err); reason != "" {
+			return reason
+		}
+	}
+	return Classify(err)
+}
+
+// Classify maps the errors common to all drivers, from the standard library
+// network, TLS and context packages, to a failure reason
+func Classify(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var opErr *net.OpError
+	var verifyErr *tls.CertificateVerificationError
+	var headerErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return REASON_TIMEOUT
+	case errors.Is(err, context.Canceled):
+		return REASON_CANCELED
+	case errors.Is(err, ErrKeyNotFound):
+		return REASON_NOT_FOUND
+	case errors.Is(err, ErrAssertion):
+		return REASON_ASSERTION
+	case errors.As(err, &dnsErr):
+		return REASON_DNS
+	case errors.As(err, &verifyErr), errors.As(err, &headerErr), errors.As(err, &alertErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return REASON_TLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return REASON_TIMEOUT
+	case errors.As(err, &opErr), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EPIPE):
+		return REASON_CONNECTION
+	}
+	return REASON_UNKNOWN
+}
@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/bradfitz/gomemcache/memcache"
+	mysql "github.com/go-sql-driver/mysql"
+	"github.com/gocql/gocql"
+	"github.com/jackc/pgx/v5/pgconn"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/segmentio/kafka-go"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReason(t *testing.T) {
+	tests := []struct {
+		name     string
+		driver   Driver
+		err      error
+		expected string
+	}{
+		{"with deadline", &Postgresql{}, fmt.Errorf("failed to connect: %w", context.DeadlineExceeded), REASON_TIMEOUT},
+		{"with canceled context", &Postgresql{}, context.Canceled, REASON_CANCELED},
+		{"with dns error", &Postgresql{}, &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "db"}}, REASON_DNS},
+		{"with refused connection", &Mysql{}, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, REASON_CONNECTION},
+		{"with unknown authority", &Valkey{}, x509.UnknownAuthorityError{}, REASON_TLS},
+		{"with missing key", &Etcd{}, ErrKeyNotFound, REASON_NOT_FOUND},
+		{"with failed assertion", &Postgresql{}, fmt.Errorf("%w: got 0 rows, expect 1", ErrAssertion), REASON_ASSERTION},
+		{"with unknown error", &Valkey{}, errors.New("unexpected"), REASON_UNKNOWN},
+		{"with postgresql authentication", &Postgresql{}, &pgconn.PgError{Code: "28P01"}, REASON_AUTHENTICATION},
+		{"with postgresql missing table", &Postgresql{}, &pgconn.PgError{Code: "42P01"}, REASON_NOT_FOUND},
+		{"with postgresql standby", &Postgresql{}, &pgconn.PgError{Code: "25006"}, REASON_READ_ONLY},
+		{"with mysql authentication", &Mysql{}, &mysql.MySQLError{Number: 1045}, REASON_AUTHENTICATION},
+		{"with mysql read only", &Mysql{}, &mysql.MySQLError{Number: 1290}, REASON_READ_ONLY},
+		{"with mysql invalid connection", &Mysql{}, mysql.ErrInvalidConn, REASON_CONNECTION},
+		{"with mongodb permission", &Mongodb{}, mongo.CommandError{Code: 13}, REASON_PERMISSION},
+		{"with mongodb secondary", &Mongodb{}, mongo.CommandError{Code: 10107}, REASON_READ_ONLY},
+		{"with mongodb handshake authentication", &Mongodb{}, errors.New("auth error: (AuthenticationFailed) Authentication failed."), REASON_AUTHENTICATION},
+		{"with mongodb missing document", &Mongodb{}, mongo.ErrNoDocuments, REASON_NOT_FOUND},
+		{"with clickhouse authentication", &Clickhouse{}, &clickhouse.Exception{Code: 516}, REASON_AUTHENTICATION},
+		{"with clickhouse missing table", &Clickhouse{}, &clickhouse.Exception{Code: 60}, REASON_NOT_FOUND},
+		{"with etcd authentication", &Etcd{}, rpctypes.ErrAuthFailed, REASON_AUTHENTICATION},
+		{"with etcd permission", &Etcd{}, rpctypes.ErrPermissionDenied, REASON_PERMISSION},
+		{"with cassandra missing row", &Cassandra{}, gocql.ErrNotFound, REASON_NOT_FOUND},
+		{"with cassandra no connections", &Cassandra{}, gocql.ErrNoConnections, REASON_CONNECTION},
+		{"with kafka authentication", &Kafka{}, kafka.SASLAuthenticationFailed, REASON_AUTHENTICATION},
+		{"with kafka missing topic", &Kafka{}, fmt.Errorf("dial leader: %w", kafka.UnknownTopicOrPartition), REASON_NOT_FOUND},
+		{"with rabbitmq authentication", &Rabbitmq{}, amqp.ErrCredentials, REASON_AUTHENTICATION},
+		{"with rabbitmq missing queue", &Rabbitmq{}, &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no queue 'canary_ng'"}, REASON_NOT_FOUND},
+		{"with rabbitmq vhost", &Rabbitmq{}, amqp.ErrVhost, REASON_PERMISSION},
+		{"with opensearch authentication", &Opensearch{}, &OpensearchError{Status: 401}, REASON_AUTHENTICATION},
+		{"with opensearch read only", &Opensearch{}, &OpensearchError{Status: 403, Type: "cluster_block_exception"}, REASON_READ_ONLY},
+		{"with opensearch rejection", &Opensearch{}, &OpensearchError{Status: 429, Type: "es_rejected_execution_exception"}, REASON_UNAVAILABLE},
+		{"with memcached server error", &Memcached{}, fmt.Errorf("127.0.0.1:11211: %w", memcache.ErrServerError), REASON_UNAVAILABLE},
+		{"with memcached missing key", &Memcached{}, errors.Join(fmt.Errorf("127.0.0.1:11211: %w", ErrKeyNotFound)), REASON_NOT_FOUND},
+		{"with etcd unavailable", &Etcd{}, status.Error(codes.Unavailable, "no leader"), REASON_UNAVAILABLE},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Reason(tc.driver, tc.err)
+			if got != tc.expected {
+				t.Errorf("got %s, expect %s", got, tc.expected)
+			}
+		})
+	}
+}
@@ -3,13 +3,17 @@ package driver
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
 	"strings"
 	"time"
 
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -90,7 +94,7 @@ func buildEtcdEndpoints(hosts []string, port int) []string {
 	return endpoints
 }
 
-func (e *Etcd) Connect() error {
+func (e *Etcd) Connect(ctx context.Context) error {
 	e.logger.Debug("connecting")
 
 	client, err := clientv3.New(e.co)
@@ -101,7 +105,7 @@ func (e *Etcd) Connect() error {
 
 	// clientv3.New dials lazily, so probe an endpoint to surface connection
 	// errors here instead of on the first read or write
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(e.opts.Timeout)*time.Second)
 	defer cancel()
 	if _, err := client.Status(ctx, e.co.Endpoints[0]); err != nil {
 		return err
@@ -111,10 +115,10 @@ func (e *Etcd) Connect() error {
 	return nil
 }
 
-func (e *Etcd) Read() error {
+func (e *Etcd) Read(ctx context.Context) error {
 	e.logger.Debug("reading")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(e.opts.Timeout)*time.Second)
 	defer cancel()
 
 	resp, err := e.client.Get(ctx, e.opts.Key)
@@ -124,19 +128,19 @@ func (e *Etcd) Read() error {
 
 	if resp.Count == 0 {
 		if e.opts.Create {
-			return e.Write()
+			return e.Write(ctx)
 		}
-		return fmt.Errorf("key does not exist")
+		return ErrKeyNotFound
 	}
 
 	e.logger.Debug("read", slog.Any("result", string(resp.Kvs[0].Value)))
 	return nil
 }
 
-func (e *Etcd) Write() error {
+func (e *Etcd) Write(ctx context.Context) error {
 	e.logger.Debug("writing")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(e.opts.Timeout)*time.Second)
 	defer cancel()
 
 	ts := time.Now().Format(time.RFC3339)
@@ -147,7 +151,49 @@ func (e *Etcd) Write() error {
 	return nil
 }
 
-func (e *Etcd) Disconnect() error {
+// WriteToken stores the token after the current time, so the value keeps
+// starting with the timestamp written by Write
+func (e *Etcd) WriteToken(ctx context.Context, token string) error {
+	e.logger.Debug("writing token")
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(e.opts.Timeout)*time.Second)
+	defer cancel()
+
+	value := time.Now().Format(time.RFC3339Nano) + " " + token
+	if _, err := e.client.Put(ctx, e.opts.Key, value); err != nil {
+		return err
+	}
+	e.logger.Debug("token written", slog.Any("token", token))
+	return nil
+}
+
+// ReadToken returns the token and timestamp stored in the key, or an empty
+// token when the key does not exist yet and create is enabled
+func (e *Etcd) ReadToken(ctx context.Context) (string, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(e.opts.Timeout)*time.Second)
+	defer cancel()
+
+	resp, err := e.client.Get(ctx, e.opts.Key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.Count == 0 && !e.opts.Create {
+		return "", time.Time{}, ErrKeyNotFound
+	}
+	if resp.Count == 0 {
+		return "", time.Time{}, nil
+	}
+
+	value := string(resp.Kvs[0].Value)
+	ts, token, _ := strings.Cut(value, " ")
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid value %q: %w", value, err)
+	}
+	return token, t, nil
+}
+
+func (e *Etcd) Disconnect(ctx context.Context) error {
 	if e.client != nil {
 		e.logger.Debug("disconnecting")
 		e.client.Close()
@@ -155,3 +201,33 @@ func (e *Etcd) Disconnect() error {
 	}
 	return nil
 }
+
+// Classify maps etcd gRPC status codes to a failure reason
+func (e *Etcd) Classify(err error) string {
+	if errors.Is(err, rpctypes.ErrAuthFailed) || errors.Is(err, rpctypes.ErrInvalidAuthToken) {
+		return REASON_AUTHENTICATION
+	}
+
+	// The client converts known server errors to EtcdError, others are
+	// returned as gRPC statuses
+	code := status.Code(err)
+	var etcdErr rpctypes.EtcdError
+	if errors.As(err, &etcdErr) {
+		code = etcdErr.Code()
+	}
+	switch code {
+	case codes.Unauthenticated:
+		return REASON_AUTHENTICATION
+	case codes.PermissionDenied:
+		return REASON_PERMISSION
+	case codes.NotFound:
+		return REASON_NOT_FOUND
+	case codes.DeadlineExceeded:
+		return REASON_TIMEOUT
+	case codes.Canceled:
+		return REASON_CANCELED
+	case codes.Unavailable:
+		return REASON_UNAVAILABLE
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	IDENTIFIER_MAX_LENGTH = 64
+)
+
+// Names from the configuration are restricted to characters that are valid in
+// all the SQL dialects once quoted, so they cannot alter a query
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z0-9_$-]+$`)
+
+// Validate a single name, such as a database, schema, table or cluster name
+func validateIdentifier(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty identifier")
+	}
+	if len(name) > IDENTIFIER_MAX_LENGTH {
+		return fmt.Errorf("identifier %q is longer than %d characters", name, IDENTIFIER_MAX_LENGTH)
+	}
+	if !identifierRegexp.MatchString(name) {
+		return fmt.Errorf("identifier %q contains characters other than letters, digits, _, $ and -", name)
+	}
+	return nil
+}
+
+// Split a table name optionally qualified by its schema or database, as in
+// monitoring.canary, and validate each part
+func parseTableName(name string) ([]string, error) {
+	parts := strings.Split(name, ".")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid table name %q, expect table or schema.table", name)
+	}
+	for _, part := range parts {
+		if err := validateIdentifier(part); err != nil {
+			return nil, fmt.Errorf("invalid table name %q: %w", name, err)
+		}
+	}
+	return parts, nil
+}
+
+// Quote the parts of an identifier with backticks, as MySQL and ClickHouse do
+func quoteBackticks(parts ...string) string {
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		quoted[i] = "`" + strings.ReplaceAll(part, "`", "``") + "`"
+	}
+	return strings.Join(quoted, ".")
+}
+
+// Quote the parts of an identifier with double quotes, as CQL does
+func quoteDoubleQuotes(parts ...string) string {
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		quoted[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, ".")
+}
@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTableName(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		mysql      string
+		postgresql string
+		valid      bool
+	}{
+		{"with table", "canary_ng", "`canary_ng`", `"canary_ng"`, true},
+		{"with schema and table", "monitoring.canary_ng", "`monitoring`.`canary_ng`", `"monitoring"."canary_ng"`, true},
+		{"with dash and upper case", "Monitoring.Canary-NG", "`Monitoring`.`Canary-NG`", `"monitoring"."canary-ng"`, true},
+		{"with too many parts", "a.b.c", "", "", false},
+		{"with empty part", "monitoring.", "", "", false},
+		{"with backtick", "canary`; DROP TABLE users; --", "", "", false},
+		{"with quote", `canary"ng`, "", "", false},
+		{"with space", "canary ng", "", "", false},
+		{"with too long name", strings.Repeat("a", IDENTIFIER_MAX_LENGTH+1), "", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := NewMysql(MysqlOpts{Host: "127.0.0.1", Table: tc.input})
+			if (err == nil) != tc.valid {
+				t.Fatalf("got error %v, expect valid %t", err, tc.valid)
+			}
+			p, perr := NewPostgresql(PostgresqlOpts{Hosts: []string{"127.0.0.1"}, Table: tc.input})
+			if (perr == nil) != tc.valid {
+				t.Fatalf("got error %v, expect valid %t", perr, tc.valid)
+			}
+			if !tc.valid {
+				return
+			}
+
+			if m.table != tc.mysql {
+				t.Errorf("got %s, expect %s", m.table, tc.mysql)
+			}
+			if p.table != tc.postgresql {
+				t.Errorf("got %s, expect %s", p.table, tc.postgresql)
+			}
+		})
+	}
+}
+
+func TestClickhouseTableName(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    ClickhousebOpts
+		table    string
+		chunk    string
+		database string
+		valid    bool
+	}{
+		{"with table", ClickhousebOpts{Table: "canary_ng", Database: "canary"}, "`canary_ng`", "`canary_ng_chunk`", "canary", true},
+		{"with database and table", ClickhousebOpts{Table: "monitoring.canary_ng", Database: "canary"}, "`monitoring`.`canary_ng`", "`monitoring`.`canary_ng_chunk`", "monitoring", true},
+		{"with invalid cluster", ClickhousebOpts{Table: "canary_ng", Cluster: "main' SETTINGS"}, "", "", "", false},
+		{"with invalid database", ClickhousebOpts{Table: "canary_ng", Database: "canary'"}, "", "", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewClickhouse(tc.input)
+			if (err == nil) != tc.valid {
+				t.Fatalf("got error %v, expect valid %t", err, tc.valid)
+			}
+			if !tc.valid {
+				return
+			}
+
+			if c.table != tc.table || c.chunk != tc.chunk || c.shardDatabase != tc.database {
+				t.Errorf("got %s, %s and %s, expect %s, %s and %s", c.table, c.chunk, c.shardDatabase, tc.table, tc.chunk, tc.database)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	KAFKA_DRIVER             = "kafka"
+	KAFKA_PORT               = 9092
+	KAFKA_MAX_MESSAGE_BYTES  = 1024
+	KAFKA_LEADER_RETRY_DELAY = 100 * time.Millisecond
+)
+
+// https://kafka.apache.org/documentation/#topicconfigs
+var kafkaTopicRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,249}$`)
+
+type KafkaOpts struct {
+	Hosts             []string
+	Port              int
+	Username          string
+	Password          string
+	Mechanism         string // SASL mechanism: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512
+	Timeout           int
+	Topic             string
+	Partition         int
+	Acks              string // all, 1 or 0
+	Create            bool
+	ReplicationFactor int // of the topic created when it does not exist
+	TLS               bool
+	SkipVerify        bool
+	Logger            *slog.Logger
+}
+
+// Kafka produces canary messages to a partition of a topic and consumes them
+// back, reading the latest message of the partition
+type Kafka struct {
+	opts   KafkaOpts
+	hosts  []string
+	acks   int
+	dialer *kafka.Dialer
+	conn   *kafka.Conn
+	logger *slog.Logger
+}
+
+func NewKafka(opts KafkaOpts) (k *Kafka, err error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = TIMEOUT
+	}
+
+	if opts.Topic == "" {
+		return nil, fmt.Errorf("topic is required")
+	}
+	if !kafkaTopicRegexp.MatchString(opts.Topic) {
+		return nil, fmt.Errorf("invalid topic name %q", opts.Topic)
+	}
+
+	if opts.Partition < 0 {
+		return nil, fmt.Errorf("invalid partition %d", opts.Partition)
+	}
+
+	if opts.ReplicationFactor == 0 {
+		opts.ReplicationFactor = 1
+	}
+
+	var acks int
+	switch opts.Acks {
+	case "", "all", "-1":
+		acks = int(kafka.RequireAll)
+	case "1":
+		acks = int(kafka.RequireOne)
+	case "0":
+		acks = int(kafka.RequireNone)
+	default:
+		return nil, fmt.Errorf("invalid acks %s, expect all, 1 or 0", opts.Acks)
+	}
+
+	// Kafka hosts expect a port
+	var hosts []string
+	port := KAFKA_PORT
+	if opts.Port != 0 {
+		port = opts.Port
+	}
+	for _, h := range opts.Hosts {
+		if !strings.Contains(h, ":") {
+			hosts = append(hosts, h+":"+strconv.Itoa(port))
+		} else {
+			hosts = append(hosts, h)
+		}
+	}
+
+	dialer := &kafka.Dialer{
+		Timeout:   time.Duration(opts.Timeout) * time.Second,
+		DualStack: true,
+	}
+
+	if opts.Username != "" {
+		dialer.SASLMechanism, err = newSASLMechanism(opts.Mechanism, opts.Username, opts.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.TLS || opts.SkipVerify {
+		dialer.TLS = &tls.Config{}
+		if opts.SkipVerify {
+			dialer.TLS.InsecureSkipVerify = true
+		}
+	}
+
+	var logger *slog.Logger
+	if opts.Logger != nil {
+		logger = opts.Logger.With("driver", KAFKA_DRIVER)
+	} else {
+		logger = slog.With("driver", KAFKA_DRIVER)
+	}
+
+	return &Kafka{
+		opts:   opts,
+		hosts:  hosts,
+		acks:   acks,
+		dialer: dialer,
+		logger: logger,
+	}, nil
+}
+
+// SCRAM-SHA-512 is used when no mechanism is given
+func newSASLMechanism(mechanism, username, password string) (sasl.Mechanism, error) {
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "", "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	}
+	return nil, fmt.Errorf("invalid sasl mechanism %s, expect PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", mechanism)
+}
+
+// Connect to the leader of the canary partition, creating the topic first when
+// it does not exist and create is enabled
+func (k *Kafka) Connect(ctx context.Context) error {
+	k.logger.Debug("connecting")
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(k.opts.Timeout)*time.Second)
+	defer cancel()
+
+	conn, err := k.dialLeader(ctx)
+	// Partitions are not added to an existing topic
+	if errors.Is(err, kafka.UnknownTopicOrPartition) {
+		if count, perr := k.countPartitions(ctx); perr == nil && count > 0 {
+			return fmt.Errorf("partition %d does not exist, topic %s has %d partitions: %w", k.opts.Partition, k.opts.Topic, count, err)
+		}
+	}
+	if errors.Is(err, kafka.UnknownTopicOrPartition) && k.opts.Create {
+		if err = k.createTopic(ctx); err != nil {
+			return err
+		}
+		// The leader of a new partition is elected shortly after its creation
+		for {
+			conn, err = k.dialLeader(ctx)
+			if err == nil || !errors.Is(err, kafka.LeaderNotAvailable) && !errors.Is(err, kafka.UnknownTopicOrPartition) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(KAFKA_LEADER_RETRY_DELAY):
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = conn.SetRequiredAcks(k.acks); err != nil {
+		conn.Close()
+		return err
+	}
+	k.conn = conn
+	k.logger.Debug("connected")
+	return nil
+}
+
+// Try each host until one returns the leader of the canary partition
+func (k *Kafka) dialLeader(ctx context.Context) (conn *kafka.Conn, err error) {
+	if len(k.hosts) == 0 {
+		return nil, fmt.Errorf("invalid kafka hosts")
+	}
+	for _, host := range k.hosts {
+		conn, err = k.dialer.DialLeader(ctx, "tcp", host, k.opts.Topic, k.opts.Partition)
+		if err == nil || errors.Is(err, kafka.UnknownTopicOrPartition) || errors.Is(err, kafka.LeaderNotAvailable) {
+			return conn, err
+		}
+		k.logger.Debug("could not reach leader", slog.String("host", host), slog.Any("error", err))
+	}
+	return nil, err
+}
+
+// Connect to the first reachable host
+func (k *Kafka) dial(ctx context.Context) (conn *kafka.Conn, err error) {
+	for _, host := range k.hosts {
+		if conn, err = k.dialer.DialContext(ctx, "tcp", host); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Return the number of partitions of the canary topic, 0 when it does not
+// exist
+func (k *Kafka) countPartitions(ctx context.Context) (int, error) {
+	conn, err := k.dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(k.opts.Topic)
+	if errors.Is(err, kafka.UnknownTopicOrPartition) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(partitions), nil
+}
+
+// Topics are created through the controller, with enough partitions for the
+// canary one
+func (k *Kafka) createTopic(ctx context.Context) error {
+	k.logger.Debug("creating topic")
+
+	conn, err := k.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	broker, err := conn.Controller()
+	if err != nil {
+		return err
+	}
+	controller, err := k.dialer.DialContext(ctx, "tcp", net.JoinHostPort(broker.Host, strconv.Itoa(broker.Port)))
+	if err != nil {
+		return err
+	}
+	defer controller.Close()
+
+	return controller.CreateTopics(kafka.TopicConfig{
+		Topic:             k.opts.Topic,
+		NumPartitions:     k.opts.Partition + 1,
+		ReplicationFactor: k.opts.ReplicationFactor,
+	})
+}
+
+// Bound the operations of the connection by the deadline of the context, and
+// interrupt them when it is cancelled
+func (k *Kafka) withDeadline(ctx context.Context) func() {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(k.opts.Timeout)*time.Second)
+	deadline, _ := ctx.Deadline()
+	k.conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		k.conn.SetDeadline(time.Now())
+	})
+	return func() {
+		stop()
+		cancel()
+	}
+}
+
+func (k *Kafka) Read(ctx context.Context) error {
+	k.logger.Debug("reading")
+
+	value, err := k.consume(ctx)
+	if errors.Is(err, ErrKeyNotFound) && k.opts.Create {
+		return k.Write(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	k.logger.Debug("read", slog.String("result", value))
+	return nil
+}
+
+// Consume the latest message of the partition
+func (k *Kafka) consume(ctx context.Context) (string, error) {
+	defer k.withDeadline(ctx)()
+
+	first, last, err := k.conn.ReadOffsets()
+	if err != nil {
+		return "", err
+	}
+	if last <= first {
+		return "", ErrKeyNotFound
+	}
+	if _, err = k.conn.Seek(last-1, kafka.SeekAbsolute); err != nil {
+		return "", err
+	}
+	message, err := k.conn.ReadMessage(KAFKA_MAX_MESSAGE_BYTES)
+	if err != nil {
+		return "", err
+	}
+	return string(message.Value), nil
+}
+
+func (k *Kafka) Write(ctx context.Context) error {
+	k.logger.Debug("writing")
+
+	ts := time.Now().Format(time.RFC3339Nano)
+	if err := k.produce(ctx, ts); err != nil {
+		return err
+	}
+	k.logger.Debug("written", slog.Any("ts", ts))
+	return nil
+}
+
+func (k *Kafka) produce(ctx context.Context, value string) error {
+	defer k.withDeadline(ctx)()
+
+	_, err := k.conn.WriteMessages(kafka.Message{Value: []byte(value)})
+	return err
+}
+
+// WriteToken produces a message made of the current time and the token, as
+// the value written by Write followed by the token
+func (k *Kafka) WriteToken(ctx context.Context, token string) error {
+	k.logger.Debug("writing token")
+
+	if err := k.produce(ctx, time.Now().Format(time.RFC3339Nano)+" "+token); err != nil {
+		return err
+	}
+	k.logger.Debug("token written", slog.Any("token", token))
+	return nil
+}
+
+// ReadToken returns the token and production time of the latest message, or
+// an empty token when the partition is empty
+func (k *Kafka) ReadToken(ctx context.Context) (string, time.Time, error) {
+	value, err := k.consume(ctx)
+	if errors.Is(err, ErrKeyNotFound) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	ts, token, _ := strings.Cut(value, " ")
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid message %q: %w", value, err)
+	}
+	return token, t, nil
+}
+
+// Messages are consumed right after being produced, so the age of the token
+// read is the produce-to-consume latency
+func (k *Kafka) Queued() {}
+
+func (k *Kafka) Disconnect(ctx context.Context) error {
+	if k.conn != nil {
+		k.logger.Debug("disconnecting")
+		if err := k.conn.Close(); err != nil {
+			return err
+		}
+		k.logger.Debug("disconnected")
+	}
+	return nil
+}
+
+// Classify maps Kafka error codes to a failure reason
+func (k *Kafka) Classify(err error) string {
+	var kafkaErr kafka.Error
+	if !errors.As(err, &kafkaErr) {
+		return ""
+	}
+	switch kafkaErr {
+	case kafka.SASLAuthenticationFailed, kafka.UnsupportedSASLMechanism, kafka.IllegalSASLState:
+		return REASON_AUTHENTICATION
+	case kafka.TopicAuthorizationFailed, kafka.ClusterAuthorizationFailed:
+		return REASON_PERMISSION
+	case kafka.UnknownTopicOrPartition:
+		return REASON_NOT_FOUND
+	case kafka.RequestTimedOut:
+		return REASON_TIMEOUT
+	case kafka.NetworkException:
+		return REASON_CONNECTION
+	case kafka.LeaderNotAvailable, kafka.NotLeaderForPartition, kafka.BrokerNotAvailable, kafka.ReplicaNotAvailable,
+		kafka.NotEnoughReplicas, kafka.NotEnoughReplicasAfterAppend, kafka.KafkaStorageError:
+		return REASON_UNAVAILABLE
+	}
+	return ""
+}
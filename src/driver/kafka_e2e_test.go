@@ -0,0 +1,48 @@
+//go:build e2e
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func newKafkaE2E(t *testing.T, partition int) *Kafka {
+	d, err := NewKafka(KafkaOpts{
+		Hosts:     []string{e2eHost("KAFKA", "127.0.0.1")},
+		Port:      e2ePort("KAFKA", 9092),
+		Username:  e2eEnv("KAFKA", "USERNAME", ""),
+		Password:  e2eEnv("KAFKA", "PASSWORD", ""),
+		Topic:     "canary_ng",
+		Partition: partition,
+		Create:    true,
+	})
+	if err != nil {
+		t.Fatalf("new kafka: %v", err)
+	}
+	return d
+}
+
+func TestKafkaE2E(t *testing.T) {
+	runDriverE2E(t, newKafkaE2E(t, 0))
+}
+
+func TestKafkaTokenE2E(t *testing.T) {
+	runTokenE2E(t, newKafkaE2E(t, 0))
+}
+
+func TestKafkaMissingPartitionE2E(t *testing.T) {
+	// The topic is created with a single partition by the other tests
+	runDriverE2E(t, newKafkaE2E(t, 0))
+
+	d := newKafkaE2E(t, 5)
+	err := d.Connect(context.Background())
+	if err == nil {
+		d.Disconnect(context.Background())
+		t.Fatal("expected an error on a missing partition")
+	}
+	if !strings.Contains(err.Error(), "partition 5 does not exist") {
+		t.Errorf("got %v, expect a missing partition error", err)
+	}
+}
@@ -0,0 +1,45 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaOpts(t *testing.T) {
+	tests := []struct {
+		name  string
+		input KafkaOpts
+		hosts string
+		acks  kafka.RequiredAcks
+		valid bool
+	}{
+		{"with defaults", KafkaOpts{Hosts: []string{"127.0.0.1"}, Topic: "canary_ng"}, "127.0.0.1:9092", kafka.RequireAll, true},
+		{"with port and leader acks", KafkaOpts{Hosts: []string{"192.168.0.1", "192.168.0.2:9093"}, Port: 9094, Topic: "canary.ng", Acks: "1"}, "192.168.0.1:9094,192.168.0.2:9093", kafka.RequireOne, true},
+		{"with scram authentication", KafkaOpts{Hosts: []string{"127.0.0.1"}, Topic: "canary_ng", Username: "canary", Password: "canary", Mechanism: "SCRAM-SHA-256"}, "127.0.0.1:9092", kafka.RequireAll, true},
+		{"without topic", KafkaOpts{Hosts: []string{"127.0.0.1"}}, "", 0, false},
+		{"with invalid topic", KafkaOpts{Hosts: []string{"127.0.0.1"}, Topic: "canary ng"}, "", 0, false},
+		{"with invalid acks", KafkaOpts{Hosts: []string{"127.0.0.1"}, Topic: "canary_ng", Acks: "2"}, "", 0, false},
+		{"with invalid mechanism", KafkaOpts{Hosts: []string{"127.0.0.1"}, Topic: "canary_ng", Username: "canary", Mechanism: "GSSAPI"}, "", 0, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			k, err := NewKafka(tc.input)
+			if (err == nil) != tc.valid {
+				t.Fatalf("got error %v, expect valid %t", err, tc.valid)
+			}
+			if !tc.valid {
+				return
+			}
+
+			if got := strings.Join(k.hosts, ","); got != tc.hosts {
+				t.Errorf("got %s, expect %s", got, tc.hosts)
+			}
+			if k.acks != int(tc.acks) {
+				t.Errorf("got acks %d, expect %d", k.acks, tc.acks)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	MEMCACHED_DRIVER         = "memcached"
+	MEMCACHED_PORT           = 11211
+	MEMCACHED_TTL            = 3600
+	MEMCACHED_KEY_MAX_LENGTH = 250
+	MEMCACHED_TTL_MAX        = 30 * 24 * 3600 // longer expirations are unix timestamps
+)
+
+type MemcachedOpts struct {
+	Hosts      []string
+	Port       int
+	Timeout    int
+	Key        string
+	TTL        int // seconds before the canary key expires
+	Create     bool
+	TLS        bool
+	SkipVerify bool
+	Logger     *slog.Logger
+}
+
+// Memcached sets and gets the canary key on every host, instead of sharding
+// the key across hosts as memcached clients do, so each host is checked. The
+// errors name the hosts that failed.
+type Memcached struct {
+	opts    MemcachedOpts
+	hosts   []string
+	clients []*memcache.Client
+	logger  *slog.Logger
+}
+
+func NewMemcached(opts MemcachedOpts) (*Memcached, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = TIMEOUT
+	}
+
+	if opts.Key == "" {
+		return nil, fmt.Errorf("key is required")
+	}
+	if len(opts.Key) > MEMCACHED_KEY_MAX_LENGTH {
+		return nil, fmt.Errorf("key %q is longer than %d characters", opts.Key, MEMCACHED_KEY_MAX_LENGTH)
+	}
+	if strings.IndexFunc(opts.Key, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+		return nil, fmt.Errorf("key %q contains spaces or control characters", opts.Key)
+	}
+
+	if opts.TTL == 0 {
+		opts.TTL = MEMCACHED_TTL
+	}
+	if opts.TTL < 0 || opts.TTL > MEMCACHED_TTL_MAX {
+		return nil, fmt.Errorf("invalid ttl %d, expect at most %d seconds", opts.TTL, MEMCACHED_TTL_MAX)
+	}
+
+	// Memcached hosts expect a port
+	var hosts []string
+	port := MEMCACHED_PORT
+	if opts.Port != 0 {
+		port = opts.Port
+	}
+	for _, h := range opts.Hosts {
+		if !strings.Contains(h, ":") {
+			hosts = append(hosts, h+":"+strconv.Itoa(port))
+		} else {
+			hosts = append(hosts, h)
+		}
+	}
+
+	var logger *slog.Logger
+	if opts.Logger != nil {
+		logger = opts.Logger.With("driver", MEMCACHED_DRIVER)
+	} else {
+		logger = slog.With("driver", MEMCACHED_DRIVER)
+	}
+
+	return &Memcached{
+		opts:   opts,
+		hosts:  hosts,
+		logger: logger,
+	}, nil
+}
+
+// Connect to every host, checking it answers
+func (m *Memcached) Connect(ctx context.Context) error {
+	m.logger.Debug("connecting")
+
+	if len(m.hosts) == 0 {
+		return fmt.Errorf("invalid memcached hosts")
+	}
+
+	m.clients = nil
+	for _, host := range m.hosts {
+		// Addresses are resolved when the client is created
+		client := memcache.New(host)
+		client.Timeout = time.Duration(m.opts.Timeout) * time.Second
+		client.MaxIdleConns = 1
+		if m.opts.TLS || m.opts.SkipVerify {
+			dialer := &tls.Dialer{
+				NetDialer: &net.Dialer{Timeout: client.Timeout},
+				Config:    &tls.Config{InsecureSkipVerify: m.opts.SkipVerify},
+			}
+			client.DialContext = dialer.DialContext
+		}
+		m.clients = append(m.clients, client)
+	}
+
+	err := m.each(ctx, func(i int, client *memcache.Client) error {
+		return client.Ping()
+	})
+	if err != nil {
+		return err
+	}
+
+	m.logger.Debug("connected")
+	return nil
+}
+
+// Run fn against every host concurrently, returning the errors of the hosts
+// that failed. Client methods do not take a context, so the hosts still
+// queried when the timeout expires or ctx is cancelled are left to their own
+// timeout instead of being waited for.
+func (m *Memcached) each(ctx context.Context, fn func(i int, client *memcache.Client) error) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
+	defer cancel()
+
+	results := make(chan error, len(m.clients))
+	for i, client := range m.clients {
+		go func() {
+			if err := fn(i, client); err != nil {
+				results <- fmt.Errorf("%s: %w", m.hosts[i], err)
+				return
+			}
+			results <- nil
+		}()
+	}
+
+	var errs []error
+	for range m.clients {
+		select {
+		case err := <-results:
+			errs = append(errs, err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Memcached) Read(ctx context.Context) error {
+	m.logger.Debug("reading")
+
+	return m.each(ctx, func(i int, client *memcache.Client) error {
+		item, err := client.Get(m.opts.Key)
+		if errors.Is(err, memcache.ErrCacheMiss) {
+			if m.opts.Create {
+				return m.set(i, client, time.Now().Format(time.RFC3339))
+			}
+			return ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		m.logger.Debug("read", slog.String("host", m.hosts[i]), slog.String("result", string(item.Value)))
+		return nil
+	})
+}
+
+func (m *Memcached) Write(ctx context.Context) error {
+	m.logger.Debug("writing")
+
+	ts := time.Now().Format(time.RFC3339)
+	return m.each(ctx, func(i int, client *memcache.Client) error {
+		return m.set(i, client, ts)
+	})
+}
+
+func (m *Memcached) set(i int, client *memcache.Client, value string) error {
+	err := client.Set(&memcache.Item{Key: m.opts.Key, Value: []byte(value), Expiration: int32(m.opts.TTL)})
+	if err != nil {
+		return err
+	}
+	m.logger.Debug("written", slog.String("host", m.hosts[i]), slog.String("value", value))
+	return nil
+}
+
+// WriteToken stores the token after the current time on every host, so the
+// value keeps starting with the timestamp written by Write
+func (m *Memcached) WriteToken(ctx context.Context, token string) error {
+	m.logger.Debug("writing token")
+
+	value := time.Now().Format(time.RFC3339Nano) + " " + token
+	return m.each(ctx, func(i int, client *memcache.Client) error {
+		return m.set(i, client, value)
+	})
+}
+
+// ReadToken returns the oldest token and timestamp stored on the hosts, so a
+// host that missed a write is reported as a mismatch, or an empty token when a
+// host does not have the key yet and create is enabled
+func (m *Memcached) ReadToken(ctx context.Context) (string, time.Time, error) {
+	// Filled by each host, a zero timestamp meaning the key is missing
+	tokens := make([]string, len(m.clients))
+	timestamps := make([]time.Time, len(m.clients))
+	err := m.each(ctx, func(i int, client *memcache.Client) error {
+		item, err := client.Get(m.opts.Key)
+		if errors.Is(err, memcache.ErrCacheMiss) && !m.opts.Create {
+			return ErrKeyNotFound
+		}
+		if errors.Is(err, memcache.ErrCacheMiss) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		value := string(item.Value)
+		s, token, _ := strings.Cut(value, " ")
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return fmt.Errorf("invalid value %q: %w", value, err)
+		}
+		tokens[i], timestamps[i] = token, ts
+		return nil
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	oldest := 0
+	for i, ts := range timestamps {
+		if ts.IsZero() {
+			return "", time.Time{}, nil
+		}
+		if ts.Before(timestamps[oldest]) {
+			oldest = i
+		}
+	}
+	return tokens[oldest], timestamps[oldest], nil
+}
+
+func (m *Memcached) Disconnect(ctx context.Context) error {
+	if m.clients != nil {
+		m.logger.Debug("disconnecting")
+		var errs []error
+		for _, client := range m.clients {
+			errs = append(errs, client.Close())
+		}
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+		m.logger.Debug("disconnected")
+	}
+	return nil
+}
+
+// Classify maps memcached client errors to a failure reason
+func (m *Memcached) Classify(err error) string {
+	var timeoutErr *memcache.ConnectTimeoutError
+	switch {
+	case errors.Is(err, memcache.ErrCacheMiss):
+		return REASON_NOT_FOUND
+	case errors.As(err, &timeoutErr):
+		return REASON_TIMEOUT
+	case errors.Is(err, memcache.ErrNoServers):
+		return REASON_CONNECTION
+	case errors.Is(err, memcache.ErrServerError), errors.Is(err, memcache.ErrNotStored):
+		return REASON_UNAVAILABLE
+	}
+	return ""
+}
@@ -0,0 +1,19 @@
+//go:build e2e
+
+package driver
+
+import "testing"
+
+func TestMemcachedE2E(t *testing.T) {
+	d, err := NewMemcached(MemcachedOpts{
+		Hosts:  []string{e2eHost("MEMCACHED", "127.0.0.1")},
+		Port:   e2ePort("MEMCACHED", 11211),
+		Key:    "canary_ng",
+		Create: true,
+	})
+	if err != nil {
+		t.Fatalf("new memcached: %v", err)
+	}
+
+	runDriverE2E(t, d)
+}
@@ -0,0 +1,209 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemcachedOpts(t *testing.T) {
+	tests := []struct {
+		name  string
+		input MemcachedOpts
+		hosts string
+		ttl   int
+		valid bool
+	}{
+		{"with defaults", MemcachedOpts{Hosts: []string{"127.0.0.1"}, Key: "canary_ng"}, "127.0.0.1:11211", 3600, true},
+		{"with port and ttl", MemcachedOpts{Hosts: []string{"192.168.0.1", "192.168.0.2:11212"}, Port: 11213, Key: "canary_ng", TTL: 60}, "192.168.0.1:11213,192.168.0.2:11212", 60, true},
+		{"without key", MemcachedOpts{Hosts: []string{"127.0.0.1"}}, "", 0, false},
+		{"with space in key", MemcachedOpts{Hosts: []string{"127.0.0.1"}, Key: "canary ng"}, "", 0, false},
+		{"with too long key", MemcachedOpts{Hosts: []string{"127.0.0.1"}, Key: strings.Repeat("a", MEMCACHED_KEY_MAX_LENGTH+1)}, "", 0, false},
+		{"with negative ttl", MemcachedOpts{Hosts: []string{"127.0.0.1"}, Key: "canary_ng", TTL: -1}, "", 0, false},
+		{"with longest ttl", MemcachedOpts{Hosts: []string{"127.0.0.1"}, Key: "canary_ng", TTL: MEMCACHED_TTL_MAX}, "127.0.0.1:11211", MEMCACHED_TTL_MAX, true},
+		{"with ttl read as a timestamp", MemcachedOpts{Hosts: []string{"127.0.0.1"}, Key: "canary_ng", TTL: MEMCACHED_TTL_MAX + 1}, "", 0, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := NewMemcached(tc.input)
+			if (err == nil) != tc.valid {
+				t.Fatalf("got error %v, expect valid %t", err, tc.valid)
+			}
+			if !tc.valid {
+				return
+			}
+
+			if got := strings.Join(m.hosts, ","); got != tc.hosts {
+				t.Errorf("got %s, expect %s", got, tc.hosts)
+			}
+			if m.opts.TTL != tc.ttl {
+				t.Errorf("got ttl %d, expect %d", m.opts.TTL, tc.ttl)
+			}
+		})
+	}
+}
+
+// Fake server answering the version, get and set commands of the text protocol
+type memcachedServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	items    map[string]string
+}
+
+func newMemcachedServer(t *testing.T) *memcachedServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	s := &memcachedServer{listener: listener, items: map[string]string{}}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *memcachedServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+
+		s.mu.Lock()
+		switch fields[0] {
+		case "version":
+			rw.WriteString("VERSION 1.6.0\r\n")
+		case "get", "gets":
+			if value, ok := s.items[fields[1]]; ok {
+				fmt.Fprintf(rw, "VALUE %s 0 %d 1\r\n%s\r\n", fields[1], len(value), value)
+			}
+			rw.WriteString("END\r\n")
+		case "set":
+			var size int
+			fmt.Sscan(fields[4], &size)
+			buf := make([]byte, size+2)
+			if _, err = io.ReadFull(rw, buf); err == nil {
+				s.items[fields[1]] = string(buf[:size])
+				rw.WriteString("STORED\r\n")
+			}
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		s.mu.Unlock()
+		rw.Flush()
+	}
+}
+
+func TestMemcachedHosts(t *testing.T) {
+	first, second := newMemcachedServer(t), newMemcachedServer(t)
+
+	ctx := context.Background()
+	m, err := NewMemcached(MemcachedOpts{Hosts: []string{first.listener.Addr().String(), second.listener.Addr().String()}, Key: "canary_ng"})
+	if err != nil {
+		t.Fatalf("new memcached: %v", err)
+	}
+	if err = m.Connect(ctx); err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer m.Disconnect(ctx)
+
+	if err = m.Read(ctx); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("got %v, expect %v", err, ErrKeyNotFound)
+	}
+
+	if err = m.WriteToken(ctx, "old"); err != nil {
+		t.Fatalf("could not write token: %v", err)
+	}
+	if err = m.Read(ctx); err != nil {
+		t.Errorf("could not read: %v", err)
+	}
+
+	// The second host misses the next write and keeps the old token
+	second.mu.Lock()
+	stale := second.items["canary_ng"]
+	second.mu.Unlock()
+	if err = m.WriteToken(ctx, "new"); err != nil {
+		t.Fatalf("could not write token: %v", err)
+	}
+	second.mu.Lock()
+	second.items["canary_ng"] = stale
+	second.mu.Unlock()
+
+	token, _, err := m.ReadToken(ctx)
+	if err != nil {
+		t.Fatalf("could not read token: %v", err)
+	}
+	if token != "old" {
+		t.Errorf("got %s, expect old", token)
+	}
+
+	// A host that lost the key fails the read, unless the key is created by
+	// the next write
+	second.mu.Lock()
+	delete(second.items, "canary_ng")
+	second.mu.Unlock()
+	if _, _, err = m.ReadToken(ctx); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("got %v, expect %v", err, ErrKeyNotFound)
+	}
+	m.opts.Create = true
+	if token, _, err = m.ReadToken(ctx); err != nil || token != "" {
+		t.Errorf("got %s and %v, expect empty token", token, err)
+	}
+}
+
+func TestMemcachedCancel(t *testing.T) {
+	// A host accepting connections without ever answering
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	server := newMemcachedServer(t)
+
+	m, err := NewMemcached(MemcachedOpts{Hosts: []string{server.listener.Addr().String(), silent.Addr().String()}, Key: "canary_ng", Timeout: 10})
+	if err != nil {
+		t.Fatalf("new memcached: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = m.Connect(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, expect %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("got %v to return, expect ctx to interrupt the hosts queried", elapsed)
+	}
+	m.Disconnect(context.Background())
+}
@@ -2,6 +2,7 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/url"
@@ -16,7 +17,8 @@ import (
 )
 
 const (
-	MONGODB_DRIVER = "mongodb"
+	MONGODB_DRIVER                      = "mongodb"
+	MONGODB_AUTHENTICATION_FAILED_ERROR = "(AuthenticationFailed)"
 )
 
 type MongodbOpts struct {
@@ -33,6 +35,7 @@ type MongodbOpts struct {
 	AuthSource    string
 	AuthMechanism string
 	ReplicaSet    string
+	Direct        bool
 	Collection    string
 	Document      string
 	Create        bool
@@ -47,8 +50,9 @@ type Mongodb struct {
 }
 
 type MongodbResult struct {
-	ID int                 `bson:"id"`
-	Ts primitive.Timestamp `bson:"ts"`
+	ID    int                 `bson:"id"`
+	Ts    primitive.Timestamp `bson:"ts"`
+	Token string              `bson:"token"`
 }
 
 func NewMongodb(opts MongodbOpts) (m *Mongodb, err error) {
@@ -64,6 +68,20 @@ func NewMongodb(opts MongodbOpts) (m *Mongodb, err error) {
 		return nil, fmt.Errorf("collection name is required")
 	}
 
+	// The database name ends up in the path of the connection string
+	if err = validateIdentifier(opts.Database); err != nil {
+		return nil, fmt.Errorf("invalid database name: %w", err)
+	}
+
+	// Collection names are not part of a query string, and may contain dots
+	// https://www.mongodb.com/docs/manual/reference/limits/#naming-restrictions
+	if strings.Contains(opts.Collection, "$") {
+		return nil, fmt.Errorf("invalid collection name %q, $ is not allowed", opts.Collection)
+	}
+	if strings.HasPrefix(opts.Collection, "system.") {
+		return nil, fmt.Errorf("invalid collection name %q, the system. prefix is reserved", opts.Collection)
+	}
+
 	var logger *slog.Logger
 	if opts.Logger != nil {
 		logger = opts.Logger.With("driver", MONGODB_DRIVER)
@@ -125,15 +143,21 @@ func (m *Mongodb) parseURI() (*url.URL, error) {
 		}
 	}
 
+	// Reach the given host even when it is a secondary, instead of discovering
+	// and routing to the primary of its replica set
+	if m.opts.Direct {
+		queryParams.Add("directConnection", "true")
+	}
+
 	url.RawQuery = queryParams.Encode()
 
 	return url, nil
 }
 
-func (m *Mongodb) Connect() (err error) {
+func (m *Mongodb) Connect(ctx context.Context) (err error) {
 	m.logger.Debug("connecting")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
 	defer cancel()
 
 	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
@@ -145,7 +169,7 @@ func (m *Mongodb) Connect() (err error) {
 	}
 	co := options.Client().ApplyURI(m.uri.String()).SetServerAPIOptions(serverAPI).SetAuth(credentials)
 
-	m.client, err = mongo.Connect(context.Background(), co)
+	m.client, err = mongo.Connect(ctx, co)
 	if err != nil {
 		return err
 	}
@@ -160,19 +184,19 @@ func (m *Mongodb) Connect() (err error) {
 	return nil
 }
 
-func (m *Mongodb) Read() error {
+func (m *Mongodb) Read(ctx context.Context) error {
 	m.logger.Debug("reading")
 
 	var result *MongodbResult
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
 	defer cancel()
 
 	collection := m.client.Database(m.opts.Database).Collection(m.opts.Collection)
 	if err := collection.FindOne(ctx, bson.M{"id": 1}).Decode(&result); err != nil {
 		if err.Error() == "mongo: no documents in result" && m.opts.Create {
 			m.logger.Debug("creating initial document")
-			if err = m.Write(); err != nil {
+			if err = m.Write(ctx); err != nil {
 				return err
 			}
 		}
@@ -183,10 +207,10 @@ func (m *Mongodb) Read() error {
 	return nil
 }
 
-func (m *Mongodb) Write() error {
+func (m *Mongodb) Write(ctx context.Context) error {
 	m.logger.Debug("writing")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
 	defer cancel()
 
 	collection := m.client.Database(m.opts.Database).Collection(m.opts.Collection)
@@ -205,10 +229,56 @@ func (m *Mongodb) Write() error {
 	return nil
 }
 
-func (m *Mongodb) Disconnect() error {
+func (m *Mongodb) WriteToken(ctx context.Context, token string) error {
+	m.logger.Debug("writing token")
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
+	defer cancel()
+
+	collection := m.client.Database(m.opts.Database).Collection(m.opts.Collection)
+
+	filter := bson.M{"id": 1}
+	ts := primitive.Timestamp{T: uint32(time.Now().Unix())}
+	update := bson.M{"$set": bson.M{"id": 1, "ts": ts, "token": token}}
+	opts := options.Update().SetUpsert(true)
+
+	if _, err := collection.UpdateOne(ctx, filter, update, opts); err != nil {
+		return err
+	}
+
+	m.logger.Debug("token written", slog.Any("token", token))
+	return nil
+}
+
+// ReadToken returns the token and timestamp of the canary document, or an
+// empty token when the document does not exist yet and create is enabled
+func (m *Mongodb) ReadToken(ctx context.Context) (string, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
+	defer cancel()
+
+	var result MongodbResult
+	collection := m.client.Database(m.opts.Database).Collection(m.opts.Collection)
+	err := collection.FindOne(ctx, bson.M{"id": 1}).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) && !m.opts.Create {
+		return "", time.Time{}, ErrKeyNotFound
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return result.Token, time.Unix(int64(result.Ts.T), 0), nil
+}
+
+func (m *Mongodb) Disconnect(ctx context.Context) error {
 	if m.client != nil {
 		m.logger.Debug("disconnecting")
-		err := m.client.Disconnect(context.Background())
+
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
+		defer cancel()
+
+		err := m.client.Disconnect(ctx)
 		if err != nil {
 			return err
 		}
@@ -216,3 +286,39 @@ func (m *Mongodb) Disconnect() error {
 	}
 	return nil
 }
+
+// Classify maps MongoDB server error codes to a failure reason
+func (m *Mongodb) Classify(err error) string {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return REASON_NOT_FOUND
+	}
+	// Authentication failures during the handshake are not surfaced as
+	// command errors
+	if strings.Contains(err.Error(), MONGODB_AUTHENTICATION_FAILED_ERROR) {
+		return REASON_AUTHENTICATION
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		switch {
+		case serverErr.HasErrorCode(18): // AuthenticationFailed
+			return REASON_AUTHENTICATION
+		case serverErr.HasErrorCode(13): // Unauthorized
+			return REASON_PERMISSION
+		case serverErr.HasErrorCode(26): // NamespaceNotFound
+			return REASON_NOT_FOUND
+		case serverErr.HasErrorCode(10107), serverErr.HasErrorCode(13435): // NotWritablePrimary, NotPrimaryNoSecondaryOk
+			return REASON_READ_ONLY
+		case serverErr.HasErrorCode(50): // MaxTimeMSExpired
+			return REASON_TIMEOUT
+		case serverErr.HasErrorCode(91), serverErr.HasErrorCode(189), serverErr.HasErrorCode(11600): // ShutdownInProgress, PrimarySteppedDown, InterruptedAtShutdown
+			return REASON_UNAVAILABLE
+		}
+	}
+	switch {
+	case mongo.IsTimeout(err):
+		return REASON_TIMEOUT
+	case mongo.IsNetworkError(err):
+		return REASON_CONNECTION
+	}
+	return ""
+}
@@ -1,6 +1,8 @@
 package driver
 
-import "testing"
+import (
+	"testing"
+)
 
 func TestMongodbURI(t *testing.T) {
 	tests := []struct {
@@ -14,6 +16,7 @@ func TestMongodbURI(t *testing.T) {
 		{"with scheme", MongodbOpts{Scheme: "mongodb+srv", Hosts: []string{"127.0.0.1"}, Username: "canary", Password: "password", Database: "canary", Collection: "canary"}, "mongodb+srv://127.0.0.1/canary"},
 		{"with tls", MongodbOpts{Hosts: []string{"127.0.0.1"}, Database: "canary", Collection: "canary", TLS: true}, "mongodb://127.0.0.1/canary?tls=true"},
 		{"with insecure tls", MongodbOpts{Hosts: []string{"127.0.0.1"}, Database: "canary", Collection: "canary", TLS: true, TLSInsecure: true}, "mongodb://127.0.0.1/canary?tls=true&tlsInsecure=true"},
+		{"with direct connection", MongodbOpts{Hosts: []string{"127.0.0.1"}, Database: "canary", Collection: "canary", Direct: true}, "mongodb://127.0.0.1/canary?directConnection=true"},
 	}
 
 	for _, tc := range tests {
@@ -61,3 +64,26 @@ func TestMongodbTimeout(t *testing.T) {
 		})
 	}
 }
+
+func TestMongodbCollection(t *testing.T) {
+	tests := []struct {
+		name       string
+		collection string
+		valid      bool
+	}{
+		{"with letters, digits, underscore and dash", "Canary_NG-1", true},
+		{"with dollar", "canary$ng", false},
+		{"with system prefix", "system.canary", false},
+		{"with dot", "canary.ng", true},
+		{"with empty name", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewMongodb(MongodbOpts{Hosts: []string{"127.0.0.1"}, Database: "canary", Collection: tc.collection})
+			if (err == nil) != tc.valid {
+				t.Errorf("got error %v, expect valid %t", err, tc.valid)
+			}
+		})
+	}
+}
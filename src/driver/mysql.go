@@ -3,6 +3,7 @@ package driver
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
@@ -13,8 +14,9 @@ import (
 )
 
 const (
-	MYSQL_DRIVER                       = "mysql"
-	MYSQL_TABLE_NOT_FOUND_ERROR_PREFIX = "Error 1146 (42S02)"
+	MYSQL_DRIVER                        = "mysql"
+	MYSQL_TABLE_NOT_FOUND_ERROR_PREFIX  = "Error 1146 (42S02)"
+	MYSQL_COLUMN_NOT_FOUND_ERROR_PREFIX = "Error 1054 (42S22)"
 )
 
 type MysqlOpts struct {
@@ -29,12 +31,18 @@ type MysqlOpts struct {
 	Timeout              int
 	Table                string
 	Create               bool
+	ReadQuery            string // replaces the canary table read
+	ReadParams           []any
+	WriteQuery           string // replaces the canary table write
+	WriteParams          []any
+	Assertions           []*Assertion
 	Logger               *slog.Logger
 }
 
 type Mysql struct {
 	db     *sql.DB
 	opts   MysqlOpts
+	table  string // quoted table name
 	logger *slog.Logger
 }
 
@@ -43,10 +51,25 @@ func NewMysql(opts MysqlOpts) (*Mysql, error) {
 		opts.Timeout = TIMEOUT
 	}
 
-	if opts.Table == "" {
+	if opts.Table == "" && opts.ReadQuery == "" && opts.WriteQuery == "" {
 		return nil, fmt.Errorf("table name is required")
 	}
 
+	var table string
+	if opts.Table != "" {
+		parts, err := parseTableName(opts.Table)
+		if err != nil {
+			return nil, err
+		}
+		table = quoteBackticks(parts...)
+	}
+
+	if opts.Database != "" {
+		if err := validateIdentifier(opts.Database); err != nil {
+			return nil, fmt.Errorf("invalid database name: %w", err)
+		}
+	}
+
 	if opts.DSN == "" {
 		host := opts.Host
 		if opts.Port > 0 && !strings.Contains(host, ":") {
@@ -74,11 +97,12 @@ func NewMysql(opts MysqlOpts) (*Mysql, error) {
 
 	return &Mysql{
 		opts:   opts,
+		table:  table,
 		logger: logger,
 	}, nil
 }
 
-func (m *Mysql) Connect() error {
+func (m *Mysql) Connect(ctx context.Context) error {
 	m.logger.Debug("openning connection")
 	db, err := sql.Open("mysql", m.opts.DSN)
 	if err != nil {
@@ -91,7 +115,9 @@ func (m *Mysql) Connect() error {
 	db.SetConnMaxLifetime(1 * time.Minute)
 
 	m.logger.Debug("ping")
-	err = db.Ping()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
+	defer cancel()
+	err = db.PingContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -101,17 +127,21 @@ func (m *Mysql) Connect() error {
 	return nil
 }
 
-func (m *Mysql) Read() error {
+func (m *Mysql) Read(ctx context.Context) error {
 	m.logger.Debug("reading")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
 	defer cancel()
 
+	if m.opts.ReadQuery != "" {
+		return m.readQuery(ctx)
+	}
+
 	var ts string
-	err := m.db.QueryRowContext(ctx, fmt.Sprintf("SELECT ts FROM `%s` WHERE id = 1", m.opts.Table)).Scan(&ts)
+	err := m.db.QueryRowContext(ctx, fmt.Sprintf("SELECT ts FROM %s WHERE id = 1", m.table)).Scan(&ts)
 	if err != nil {
 		if strings.HasPrefix(err.Error(), MYSQL_TABLE_NOT_FOUND_ERROR_PREFIX) && m.opts.Create {
-			return m.Write()
+			return m.Write(ctx)
 		}
 		return err
 	}
@@ -120,27 +150,77 @@ func (m *Mysql) Read() error {
 	return nil
 }
 
-func (m *Mysql) Write() error {
+// Run the custom read query and check its result against the assertions
+func (m *Mysql) readQuery(ctx context.Context) error {
+	rows, err := m.db.QueryContext(ctx, m.opts.ReadQuery, m.opts.ReadParams...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	result := Result{}
+	if result.Columns, err = rows.Columns(); err != nil {
+		return err
+	}
+	for rows.Next() {
+		// Scanning into interfaces copies the values without conversion
+		values := make([]any, len(result.Columns))
+		pointers := make([]any, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err = rows.Scan(pointers...); err != nil {
+			return err
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	m.logger.Debug("read", slog.Int("rows", len(result.Rows)))
+	return Assert(result, m.opts.Assertions)
+}
+
+func (m *Mysql) Write(ctx context.Context) error {
 	m.logger.Debug("writing")
-	err := m.insert()
+	if m.opts.WriteQuery != "" {
+		return m.writeQuery(ctx)
+	}
+	err := m.insert(ctx)
 	if err != nil && strings.HasPrefix(err.Error(), MYSQL_TABLE_NOT_FOUND_ERROR_PREFIX) && m.opts.Create {
-		if err = m.createTable(); err != nil {
+		if err = m.createTable(ctx); err != nil {
 			return err
 		}
-		return m.insert()
+		return m.insert(ctx)
+	}
+	if err != nil {
+		return err
 	}
 
 	m.logger.Debug("written")
 	return nil
 }
 
-func (m *Mysql) insert() error {
+// Run the custom write query, a statement or a stored procedure call
+func (m *Mysql) writeQuery(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
+	defer cancel()
+
+	if _, err := m.db.ExecContext(ctx, m.opts.WriteQuery, m.opts.WriteParams...); err != nil {
+		return err
+	}
+	m.logger.Debug("written")
+	return nil
+}
+
+func (m *Mysql) insert(ctx context.Context) error {
 	m.logger.Debug("inserting")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
 	defer cancel()
 
-	_, err := m.db.ExecContext(ctx, fmt.Sprintf("REPLACE INTO `%s` (id, ts) VALUES (1, now())", m.opts.Table))
+	_, err := m.db.ExecContext(ctx, fmt.Sprintf("REPLACE INTO %s (id, ts) VALUES (1, now())", m.table))
 	if err != nil {
 		return err
 	}
@@ -148,13 +228,13 @@ func (m *Mysql) insert() error {
 	return nil
 }
 
-func (m *Mysql) createTable() error {
+func (m *Mysql) createTable(ctx context.Context) error {
 	m.logger.Debug("creating table")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
 	defer cancel()
 
-	_, err := m.db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE `%s` (id TINYINT PRIMARY KEY, ts TIMESTAMP NOT NULL)", m.opts.Table))
+	_, err := m.db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (id TINYINT PRIMARY KEY, ts TIMESTAMP NOT NULL, token VARCHAR(64))", m.table))
 	if err != nil {
 		return err
 	}
@@ -162,7 +242,76 @@ func (m *Mysql) createTable() error {
 	return nil
 }
 
-func (m *Mysql) Disconnect() error {
+func (m *Mysql) WriteToken(ctx context.Context, token string) error {
+	m.logger.Debug("writing token")
+	err := m.replaceToken(ctx, token)
+	if err != nil && m.opts.Create {
+		switch {
+		case strings.HasPrefix(err.Error(), MYSQL_TABLE_NOT_FOUND_ERROR_PREFIX):
+			err = m.createTable(ctx)
+		case strings.HasPrefix(err.Error(), MYSQL_COLUMN_NOT_FOUND_ERROR_PREFIX):
+			err = m.addTokenColumn(ctx)
+		default:
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		err = m.replaceToken(ctx, token)
+	}
+	if err != nil {
+		return err
+	}
+
+	m.logger.Debug("token written", slog.Any("token", token))
+	return nil
+}
+
+func (m *Mysql) replaceToken(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, fmt.Sprintf("REPLACE INTO %s (id, ts, token) VALUES (1, now(), ?)", m.table), token)
+	return err
+}
+
+// Tables created before tokens were introduced lack the token column
+func (m *Mysql) addTokenColumn(ctx context.Context) error {
+	m.logger.Debug("adding token column")
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN token VARCHAR(64)", m.table))
+	return err
+}
+
+// ReadToken returns the token and timestamp of the canary row, or an empty
+// token when the row or the table does not exist yet and create is enabled
+func (m *Mysql) ReadToken(ctx context.Context) (token string, ts time.Time, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.opts.Timeout)*time.Second)
+	defer cancel()
+
+	// Scanning the unix timestamp avoids depending on parseTime in the DSN
+	var unix int64
+	err = m.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(token, ''), UNIX_TIMESTAMP(ts) FROM %s WHERE id = 1", m.table)).Scan(&token, &unix)
+	if errors.Is(err, sql.ErrNoRows) && !m.opts.Create {
+		return "", time.Time{}, ErrKeyNotFound
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", time.Time{}, nil
+	}
+	// The table or its token column are created by the next token write
+	if err != nil && m.opts.Create && (strings.HasPrefix(err.Error(), MYSQL_TABLE_NOT_FOUND_ERROR_PREFIX) || strings.HasPrefix(err.Error(), MYSQL_COLUMN_NOT_FOUND_ERROR_PREFIX)) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, time.Unix(unix, 0), nil
+}
+
+func (m *Mysql) Disconnect(ctx context.Context) error {
 	if m.db != nil {
 		m.logger.Debug("disconnecting")
 		if err := m.db.Close(); err != nil {
@@ -172,3 +321,29 @@ func (m *Mysql) Disconnect() error {
 	}
 	return nil
 }
+
+// Classify maps MySQL error numbers to a failure reason
+func (m *Mysql) Classify(err error) string {
+	if errors.Is(err, mysql.ErrInvalidConn) {
+		return REASON_CONNECTION
+	}
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return ""
+	}
+	switch myErr.Number {
+	case 1045: // ER_ACCESS_DENIED_ERROR
+		return REASON_AUTHENTICATION
+	case 1044, 1142, 1143, 1227: // database, table, column access denied, specific privilege required
+		return REASON_PERMISSION
+	case 1049, 1054, 1146: // unknown database, column, table
+		return REASON_NOT_FOUND
+	case 1290, 1792, 1836: // --read-only, read only transaction, read only mode
+		return REASON_READ_ONLY
+	case 1205, 3024: // lock wait timeout, max execution time exceeded
+		return REASON_TIMEOUT
+	case 1040, 1053, 1203: // too many connections, server shutdown, max user connections
+		return REASON_UNAVAILABLE
+	}
+	return ""
+}
@@ -0,0 +1,411 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OPENSEARCH_DRIVER        = "opensearch"
+	OPENSEARCH_PORT          = 9200
+	OPENSEARCH_DOCUMENT_ID   = "1"
+	OPENSEARCH_SHARDS        = 1
+	OPENSEARCH_REPLICAS      = 1
+	OPENSEARCH_USER_AGENT    = "canary-ng"
+	OPENSEARCH_INDEX_EXISTS  = "resource_already_exists_exception"
+	OPENSEARCH_CLUSTER_BLOCK = "cluster_block_exception"
+)
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/indices-create-index.html#indices-create-api-path-params
+var opensearchIndexRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,254}$`)
+
+type OpensearchOpts struct {
+	Hosts      []string
+	Port       int
+	Username   string
+	Password   string
+	APIKey     string
+	Timeout    int
+	Index      string
+	Create     bool
+	Shards     int  // of the index created when it does not exist
+	Replicas   *int // of the index created when it does not exist
+	Search     bool
+	TLS        bool
+	SkipVerify bool
+	Logger     *slog.Logger
+}
+
+// Opensearch indexes a canary document and fetches it back by id, through the
+// REST API shared by Elasticsearch and OpenSearch
+type Opensearch struct {
+	opts   OpensearchOpts
+	hosts  []string // base URLs
+	url    string   // base URL of the host reached by Connect
+	client *http.Client
+	logger *slog.Logger
+}
+
+// OpensearchError is returned when the API responds with an error status
+type OpensearchError struct {
+	Status int
+	Type   string
+	Reason string
+}
+
+func (e *OpensearchError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("status %d", e.Status)
+	}
+	return fmt.Sprintf("status %d: %s: %s", e.Status, e.Type, e.Reason)
+}
+
+// Canary document
+type opensearchDocument struct {
+	Ts    time.Time `json:"ts"`
+	Token string    `json:"token,omitempty"`
+}
+
+func NewOpensearch(opts OpensearchOpts) (*Opensearch, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = TIMEOUT
+	}
+
+	if opts.Index == "" {
+		return nil, fmt.Errorf("index is required")
+	}
+	if !opensearchIndexRegexp.MatchString(opts.Index) {
+		return nil, fmt.Errorf("invalid index name %q", opts.Index)
+	}
+	if opts.APIKey != "" && opts.Username != "" {
+		return nil, fmt.Errorf("api key and basic authentication are mutually exclusive")
+	}
+
+	if opts.Shards == 0 {
+		opts.Shards = OPENSEARCH_SHARDS
+	}
+	if opts.Shards < 0 {
+		return nil, fmt.Errorf("invalid number of shards %d", opts.Shards)
+	}
+	if opts.Replicas == nil {
+		replicas := OPENSEARCH_REPLICAS
+		opts.Replicas = &replicas
+	}
+	if *opts.Replicas < 0 {
+		return nil, fmt.Errorf("invalid number of replicas %d", *opts.Replicas)
+	}
+
+	scheme := "http"
+	if opts.TLS || opts.SkipVerify {
+		scheme = "https"
+	}
+
+	// OpenSearch hosts expect a port
+	var hosts []string
+	port := OPENSEARCH_PORT
+	if opts.Port != 0 {
+		port = opts.Port
+	}
+	for _, h := range opts.Hosts {
+		if !strings.Contains(h, ":") {
+			h = h + ":" + strconv.Itoa(port)
+		}
+		hosts = append(hosts, scheme+"://"+h)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.SkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	var logger *slog.Logger
+	if opts.Logger != nil {
+		logger = opts.Logger.With("driver", OPENSEARCH_DRIVER)
+	} else {
+		logger = slog.With("driver", OPENSEARCH_DRIVER)
+	}
+
+	return &Opensearch{
+		opts:   opts,
+		hosts:  hosts,
+		client: &http.Client{Transport: transport},
+		logger: logger,
+	}, nil
+}
+
+// Connect to the first host answering the API, and create the canary index
+// when it does not exist and create is enabled. The index is created before
+// any write, so it gets its settings instead of the ones of an automatic
+// creation.
+func (o *Opensearch) Connect(ctx context.Context) error {
+	o.logger.Debug("connecting")
+
+	if len(o.hosts) == 0 {
+		return fmt.Errorf("invalid opensearch hosts")
+	}
+
+	var err error
+	for _, host := range o.hosts {
+		o.url = host
+		if err = o.do(ctx, http.MethodGet, "/", nil, nil); err == nil {
+			break
+		}
+		o.logger.Debug("could not connect", slog.String("host", host), slog.Any("error", err))
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.opts.Create {
+		if err = o.createIndex(ctx); err != nil {
+			return err
+		}
+	}
+
+	o.logger.Debug("connected")
+	return nil
+}
+
+func (o *Opensearch) createIndex(ctx context.Context) error {
+	err := o.do(ctx, http.MethodHead, "/"+o.opts.Index, nil, nil)
+	var apiErr *OpensearchError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound {
+		return err
+	}
+
+	o.logger.Debug("creating index")
+	err = o.do(ctx, http.MethodPut, "/"+o.opts.Index, map[string]any{
+		"settings": map[string]any{
+			"index": map[string]any{
+				"number_of_shards":   o.opts.Shards,
+				"number_of_replicas": *o.opts.Replicas,
+			},
+		},
+		"mappings": map[string]any{
+			"properties": map[string]any{
+				"ts":    map[string]string{"type": "date"},
+				"token": map[string]string{"type": "keyword"},
+			},
+		},
+	}, nil)
+	// Another job may have created the index in the meantime
+	if errors.As(err, &apiErr) && apiErr.Type == OPENSEARCH_INDEX_EXISTS {
+		return nil
+	}
+	return err
+}
+
+// Send a request to the host reached by Connect, encoding body and decoding
+// the response into result when they are not nil
+func (o *Opensearch) do(ctx context.Context, method, path string, body any, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(o.opts.Timeout)*time.Second)
+	defer cancel()
+
+	var reader io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, o.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", OPENSEARCH_USER_AGENT)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if o.opts.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+o.opts.APIKey)
+	} else if o.opts.Username != "" {
+		req.SetBasicAuth(o.opts.Username, o.opts.Password)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		var response struct {
+			Found *bool `json:"found"`
+			Error struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		}
+		json.Unmarshal(buf, &response)
+		// A missing document is reported with a 404 status and found set to
+		// false, unlike a missing index
+		if resp.StatusCode != http.StatusNotFound || response.Found == nil {
+			return &OpensearchError{Status: resp.StatusCode, Type: response.Error.Type, Reason: response.Error.Reason}
+		}
+	}
+
+	if result != nil {
+		return json.Unmarshal(buf, result)
+	}
+	return nil
+}
+
+func (o *Opensearch) Read(ctx context.Context) error {
+	o.logger.Debug("reading")
+
+	document, err := o.get(ctx)
+	if errors.Is(err, ErrKeyNotFound) && o.opts.Create {
+		return o.Write(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.opts.Search {
+		if err = o.search(ctx); err != nil {
+			return err
+		}
+	}
+
+	o.logger.Debug("read", slog.Any("ts", document.Ts))
+	return nil
+}
+
+// Get the canary document by id
+func (o *Opensearch) get(ctx context.Context) (*opensearchDocument, error) {
+	var response struct {
+		Found  bool               `json:"found"`
+		Source opensearchDocument `json:"_source"`
+	}
+	if err := o.do(ctx, http.MethodGet, "/"+o.opts.Index+"/_doc/"+OPENSEARCH_DOCUMENT_ID, nil, &response); err != nil {
+		return nil, err
+	}
+	if !response.Found {
+		return nil, ErrKeyNotFound
+	}
+	return &response.Source, nil
+}
+
+// Search the canary document, going through the search path of the cluster
+// instead of the real-time get
+func (o *Opensearch) search(ctx context.Context) error {
+	o.logger.Debug("searching")
+
+	var response struct {
+		Hits struct {
+			Hits []json.RawMessage `json:"hits"`
+		} `json:"hits"`
+	}
+	query := map[string]any{
+		"size":  1,
+		"query": map[string]any{"ids": map[string]any{"values": []string{OPENSEARCH_DOCUMENT_ID}}},
+	}
+	if err := o.do(ctx, http.MethodPost, "/"+o.opts.Index+"/_search", query, &response); err != nil {
+		return err
+	}
+	if len(response.Hits.Hits) == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (o *Opensearch) Write(ctx context.Context) error {
+	o.logger.Debug("writing")
+
+	document := opensearchDocument{Ts: time.Now()}
+	if err := o.index(ctx, document); err != nil {
+		return err
+	}
+	o.logger.Debug("written", slog.Any("ts", document.Ts))
+	return nil
+}
+
+// Index the canary document, refreshing the index so it is visible to searches
+// as soon as the request returns
+func (o *Opensearch) index(ctx context.Context, document opensearchDocument) error {
+	return o.do(ctx, http.MethodPut, "/"+o.opts.Index+"/_doc/"+OPENSEARCH_DOCUMENT_ID+"?refresh=true", document, nil)
+}
+
+func (o *Opensearch) WriteToken(ctx context.Context, token string) error {
+	o.logger.Debug("writing token")
+
+	if err := o.index(ctx, opensearchDocument{Ts: time.Now(), Token: token}); err != nil {
+		return err
+	}
+	o.logger.Debug("token written", slog.Any("token", token))
+	return nil
+}
+
+// ReadToken returns the token and timestamp of the canary document, or an
+// empty token when it does not exist yet and create is enabled. The document
+// is searched too when search is enabled, as by Read.
+func (o *Opensearch) ReadToken(ctx context.Context) (string, time.Time, error) {
+	document, err := o.get(ctx)
+	if errors.Is(err, ErrKeyNotFound) && !o.opts.Create {
+		return "", time.Time{}, ErrKeyNotFound
+	}
+	if errors.Is(err, ErrKeyNotFound) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if o.opts.Search {
+		if err = o.search(ctx); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	return document.Token, document.Ts, nil
+}
+
+func (o *Opensearch) Disconnect(ctx context.Context) error {
+	o.logger.Debug("disconnecting")
+	o.client.CloseIdleConnections()
+	o.logger.Debug("disconnected")
+	return nil
+}
+
+// Classify maps API status codes to a failure reason
+func (o *Opensearch) Classify(err error) string {
+	var apiErr *OpensearchError
+	if !errors.As(err, &apiErr) {
+		return ""
+	}
+	switch apiErr.Status {
+	case http.StatusUnauthorized:
+		return REASON_AUTHENTICATION
+	case http.StatusForbidden:
+		// Indices are blocked for writes when disks are full
+		if apiErr.Type == OPENSEARCH_CLUSTER_BLOCK {
+			return REASON_READ_ONLY
+		}
+		return REASON_PERMISSION
+	case http.StatusNotFound:
+		return REASON_NOT_FOUND
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return REASON_TIMEOUT
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return REASON_UNAVAILABLE
+	}
+	return ""
+}
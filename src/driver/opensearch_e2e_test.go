@@ -0,0 +1,24 @@
+//go:build e2e
+
+package driver
+
+import "testing"
+
+func TestOpensearchE2E(t *testing.T) {
+	replicas := 0
+	d, err := NewOpensearch(OpensearchOpts{
+		Hosts:    []string{e2eHost("OPENSEARCH", "127.0.0.1")},
+		Port:     e2ePort("OPENSEARCH", 9200),
+		Username: e2eEnv("OPENSEARCH", "USERNAME", ""),
+		Password: e2eEnv("OPENSEARCH", "PASSWORD", ""),
+		Index:    "canary_ng",
+		Create:   true,
+		Replicas: &replicas,
+		Search:   true,
+	})
+	if err != nil {
+		t.Fatalf("new opensearch: %v", err)
+	}
+
+	runDriverE2E(t, d)
+}
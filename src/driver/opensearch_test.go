@@ -0,0 +1,178 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOpensearchOpts(t *testing.T) {
+	zero := 0
+	tests := []struct {
+		name     string
+		input    OpensearchOpts
+		hosts    string
+		replicas int
+		valid    bool
+	}{
+		{"with defaults", OpensearchOpts{Hosts: []string{"127.0.0.1"}, Index: "canary_ng"}, "http://127.0.0.1:9200", 1, true},
+		{"with tls and port", OpensearchOpts{Hosts: []string{"192.168.0.1", "192.168.0.2:9201"}, Port: 9243, Index: "canary-ng", TLS: true}, "https://192.168.0.1:9243,https://192.168.0.2:9201", 1, true},
+		{"without replicas", OpensearchOpts{Hosts: []string{"127.0.0.1"}, Index: "canary_ng", Replicas: &zero}, "http://127.0.0.1:9200", 0, true},
+		{"without index", OpensearchOpts{Hosts: []string{"127.0.0.1"}}, "", 0, false},
+		{"with upper case index", OpensearchOpts{Hosts: []string{"127.0.0.1"}, Index: "Canary"}, "", 0, false},
+		{"with hidden index", OpensearchOpts{Hosts: []string{"127.0.0.1"}, Index: ".canary"}, "", 0, false},
+		{"with api key and password", OpensearchOpts{Hosts: []string{"127.0.0.1"}, Index: "canary_ng", APIKey: "key", Username: "canary"}, "", 0, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o, err := NewOpensearch(tc.input)
+			if (err == nil) != tc.valid {
+				t.Fatalf("got error %v, expect valid %t", err, tc.valid)
+			}
+			if !tc.valid {
+				return
+			}
+
+			if got := strings.Join(o.hosts, ","); got != tc.hosts {
+				t.Errorf("got %s, expect %s", got, tc.hosts)
+			}
+			if *o.opts.Replicas != tc.replicas {
+				t.Errorf("got %d replicas, expect %d", *o.opts.Replicas, tc.replicas)
+			}
+		})
+	}
+}
+
+// Fake cluster storing the documents of a single index
+type opensearchServer struct {
+	mu        sync.Mutex
+	index     map[string]any // settings of the index, nil when it does not exist
+	documents map[string][]byte
+	searches  int
+}
+
+func (s *opensearchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "":
+		w.Write([]byte(`{"version":{"number":"2.18.0"}}`))
+	case len(parts) == 1 && r.Method == http.MethodHead:
+		if s.index == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		json.Unmarshal(body, &s.index)
+		w.Write([]byte(`{"acknowledged":true}`))
+	case s.index == nil:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"type":"index_not_found_exception","reason":"no such index"},"status":404}`))
+	case len(parts) == 3 && r.Method == http.MethodPut:
+		s.documents[parts[2]] = body
+		w.Write([]byte(`{"result":"created"}`))
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		document, ok := s.documents[parts[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"_id":"` + parts[2] + `","found":false}`))
+			return
+		}
+		w.Write([]byte(`{"_id":"` + parts[2] + `","found":true,"_source":` + string(document) + `}`))
+	case parts[1] == "_search":
+		s.searches++
+		hits := "[]"
+		if _, ok := s.documents[OPENSEARCH_DOCUMENT_ID]; ok {
+			hits = `[{"_id":"1"}]`
+		}
+		w.Write([]byte(`{"hits":{"hits":` + hits + `}}`))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestOpensearchReadWrite(t *testing.T) {
+	s := &opensearchServer{documents: map[string][]byte{}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	ctx := context.Background()
+	o, err := NewOpensearch(OpensearchOpts{Hosts: []string{"127.0.0.1:1", server.Listener.Addr().String()}, Index: "canary_ng", Search: true})
+	if err != nil {
+		t.Fatalf("new opensearch: %v", err)
+	}
+	if err = o.Connect(ctx); err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	if err = o.Read(ctx); o.Classify(err) != REASON_NOT_FOUND {
+		t.Errorf("got %v, expect missing index", err)
+	}
+
+	o.opts.Create = true
+	if err = o.Connect(ctx); err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	if s.index == nil {
+		t.Fatalf("index not created")
+	}
+	if err = o.Read(ctx); err != nil {
+		t.Fatalf("could not read: %v", err)
+	}
+	if _, ok := s.documents[OPENSEARCH_DOCUMENT_ID]; !ok {
+		t.Errorf("document not written by read with create")
+	}
+
+	if err = o.WriteToken(ctx, "token"); err != nil {
+		t.Fatalf("could not write token: %v", err)
+	}
+	searches := s.searches
+	token, ts, err := o.ReadToken(ctx)
+	if err != nil {
+		t.Fatalf("could not read token: %v", err)
+	}
+	if token != "token" || ts.IsZero() {
+		t.Errorf("got %s at %s, expect token", token, ts)
+	}
+	if s.searches != searches+1 {
+		t.Errorf("got %d searches, expect %d", s.searches, searches+1)
+	}
+	if err = o.Disconnect(ctx); err != nil {
+		t.Errorf("could not disconnect: %v", err)
+	}
+}
+
+func TestOpensearchMissingDocument(t *testing.T) {
+	s := &opensearchServer{index: map[string]any{}, documents: map[string][]byte{}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	ctx := context.Background()
+	o, err := NewOpensearch(OpensearchOpts{Hosts: []string{server.Listener.Addr().String()}, Index: "canary_ng"})
+	if err != nil {
+		t.Fatalf("new opensearch: %v", err)
+	}
+	if err = o.Connect(ctx); err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	if err = o.Read(ctx); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("got %v, expect %v", err, ErrKeyNotFound)
+	}
+	if _, _, err = o.ReadToken(ctx); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("got %v, expect %v", err, ErrKeyNotFound)
+	}
+	o.opts.Create = true
+	token, _, err := o.ReadToken(ctx)
+	if err != nil || token != "" {
+		t.Errorf("got %s and %v, expect empty token", token, err)
+	}
+}
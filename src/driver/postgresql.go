@@ -2,6 +2,7 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/url"
@@ -10,31 +11,40 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 const (
-	POSTGRESQL_DRIVER                       = "postgresql"
-	POSTGRESQL_TABLE_NOT_FOUND_ERROR_SUFFIX = "(SQLSTATE 42P01)"
-	POSTGRESQL_NO_ROWS_ERROR                = "no rows in result set"
+	POSTGRESQL_DRIVER                        = "postgresql"
+	POSTGRESQL_TABLE_NOT_FOUND_ERROR_SUFFIX  = "(SQLSTATE 42P01)"
+	POSTGRESQL_COLUMN_NOT_FOUND_ERROR_SUFFIX = "(SQLSTATE 42703)"
+	POSTGRESQL_NO_ROWS_ERROR                 = "no rows in result set"
 )
 
 type PostgresqlOpts struct {
-	DSN      string
-	Hosts    []string
-	Port     int
-	Username string
-	Password string
-	Database string
-	Timeout  int
-	SSLMode  string
-	Table    string
-	Create   bool
-	Logger   *slog.Logger
+	DSN         string
+	Hosts       []string
+	Port        int
+	Username    string
+	Password    string
+	Database    string
+	Timeout     int
+	SSLMode     string
+	Table       string
+	Create      bool
+	ReadQuery   string // replaces the canary table read
+	ReadParams  []any
+	WriteQuery  string // replaces the canary table write
+	WriteParams []any
+	Assertions  []*Assertion
+	Logger      *slog.Logger
 }
 
 type Postgresql struct {
 	conn   *pgx.Conn
 	opts   PostgresqlOpts
+	table  string // quoted table name
 	logger *slog.Logger
 }
 
@@ -43,10 +53,27 @@ func NewPostgresql(opts PostgresqlOpts) (*Postgresql, error) {
 		opts.Timeout = TIMEOUT
 	}
 
-	if opts.Table == "" {
+	if opts.Table == "" && opts.ReadQuery == "" && opts.WriteQuery == "" {
 		return nil, fmt.Errorf("table name is required")
 	}
 
+	// Quoted names are case sensitive, so they are folded to lower case as
+	// unquoted names are, to keep targeting the same table
+	var table string
+	if opts.Table != "" {
+		parts, err := parseTableName(strings.ToLower(opts.Table))
+		if err != nil {
+			return nil, err
+		}
+		table = pgx.Identifier(parts).Sanitize()
+	}
+
+	if opts.Database != "" {
+		if err := validateIdentifier(opts.Database); err != nil {
+			return nil, fmt.Errorf("invalid database name: %w", err)
+		}
+	}
+
 	var logger *slog.Logger
 	if opts.Logger != nil {
 		logger = opts.Logger.With("driver", POSTGRESQL_DRIVER)
@@ -56,6 +83,7 @@ func NewPostgresql(opts PostgresqlOpts) (*Postgresql, error) {
 
 	p := &Postgresql{
 		opts:   opts,
+		table:  table,
 		logger: logger,
 	}
 
@@ -122,10 +150,10 @@ func (p *Postgresql) parseDSN() (*url.URL, error) {
 	return url, nil
 }
 
-func (p *Postgresql) Connect() error {
+func (p *Postgresql) Connect(ctx context.Context) error {
 	p.logger.Debug("connecting")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.opts.Timeout)*time.Second)
 	defer cancel()
 
 	conn, err := pgx.Connect(ctx, p.opts.DSN)
@@ -138,17 +166,21 @@ func (p *Postgresql) Connect() error {
 	return nil
 }
 
-func (p *Postgresql) Read() error {
+func (p *Postgresql) Read(ctx context.Context) error {
 	p.logger.Debug("reading")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.opts.Timeout)*time.Second)
 	defer cancel()
 
+	if p.opts.ReadQuery != "" {
+		return p.readQuery(ctx)
+	}
+
 	var ts string
-	err := p.conn.QueryRow(ctx, fmt.Sprintf("SELECT to_char(ts, 'YYYY-MM-DD HH24:MI:SSOF') FROM %s WHERE id = 1", p.opts.Table)).Scan(&ts)
+	err := p.conn.QueryRow(ctx, fmt.Sprintf("SELECT to_char(ts, 'YYYY-MM-DD HH24:MI:SSOF') FROM %s WHERE id = 1", p.table)).Scan(&ts)
 	if err != nil {
 		if strings.HasSuffix(err.Error(), POSTGRESQL_TABLE_NOT_FOUND_ERROR_SUFFIX) && p.opts.Create {
-			return p.Write()
+			return p.Write(ctx)
 		}
 		return err
 	}
@@ -157,27 +189,80 @@ func (p *Postgresql) Read() error {
 	return nil
 }
 
-func (p *Postgresql) Write() error {
+// Run the custom read query and check its result against the assertions
+func (p *Postgresql) readQuery(ctx context.Context) error {
+	rows, err := p.conn.Query(ctx, p.opts.ReadQuery, p.opts.ReadParams...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	result := Result{}
+	for _, field := range rows.FieldDescriptions() {
+		result.Columns = append(result.Columns, field.Name)
+	}
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			// Numeric columns are decoded to an arbitrary precision type, compared as floats
+			if n, ok := v.(pgtype.Numeric); ok {
+				if f, err := n.Float64Value(); err == nil && f.Valid {
+					values[i] = f.Float64
+				}
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	p.logger.Debug("read", slog.Int("rows", len(result.Rows)))
+	return Assert(result, p.opts.Assertions)
+}
+
+func (p *Postgresql) Write(ctx context.Context) error {
 	p.logger.Debug("writing")
-	err := p.insert()
+	if p.opts.WriteQuery != "" {
+		return p.writeQuery(ctx)
+	}
+	err := p.insert(ctx)
 	if err != nil && strings.HasSuffix(err.Error(), POSTGRESQL_TABLE_NOT_FOUND_ERROR_SUFFIX) && p.opts.Create {
-		if err = p.createTable(); err != nil {
+		if err = p.createTable(ctx); err != nil {
 			return err
 		}
-		return p.insert()
+		return p.insert(ctx)
+	}
+	if err != nil {
+		return err
 	}
 
 	p.logger.Debug("written")
 	return nil
 }
 
-func (p *Postgresql) insert() error {
+// Run the custom write query, a statement or a stored procedure call
+func (p *Postgresql) writeQuery(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.opts.Timeout)*time.Second)
+	defer cancel()
+
+	if _, err := p.conn.Exec(ctx, p.opts.WriteQuery, p.opts.WriteParams...); err != nil {
+		return err
+	}
+	p.logger.Debug("written")
+	return nil
+}
+
+func (p *Postgresql) insert(ctx context.Context) error {
 	p.logger.Debug("inserting")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.opts.Timeout)*time.Second)
 	defer cancel()
 
-	_, err := p.conn.Exec(ctx, fmt.Sprintf("INSERT INTO %s (id, ts) VALUES (1, now()) ON CONFLICT (id) DO UPDATE SET ts = now()", p.opts.Table))
+	_, err := p.conn.Exec(ctx, fmt.Sprintf("INSERT INTO %s (id, ts) VALUES (1, now()) ON CONFLICT (id) DO UPDATE SET ts = now()", p.table))
 	if err != nil {
 		return err
 	}
@@ -185,13 +270,13 @@ func (p *Postgresql) insert() error {
 	return nil
 }
 
-func (p *Postgresql) createTable() error {
+func (p *Postgresql) createTable(ctx context.Context) error {
 	p.logger.Debug("creating table")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.opts.Timeout)*time.Second)
 	defer cancel()
 
-	_, err := p.conn.Exec(ctx, fmt.Sprintf("CREATE TABLE %s (id smallint primary key, ts timestamp with time zone)", p.opts.Table))
+	_, err := p.conn.Exec(ctx, fmt.Sprintf("CREATE TABLE %s (id smallint primary key, ts timestamp with time zone, token text)", p.table))
 	if err != nil {
 		return err
 	}
@@ -199,11 +284,78 @@ func (p *Postgresql) createTable() error {
 	return nil
 }
 
-func (p *Postgresql) Disconnect() error {
+func (p *Postgresql) WriteToken(ctx context.Context, token string) error {
+	p.logger.Debug("writing token")
+	err := p.upsertToken(ctx, token)
+	if err != nil && p.opts.Create {
+		switch {
+		case strings.HasSuffix(err.Error(), POSTGRESQL_TABLE_NOT_FOUND_ERROR_SUFFIX):
+			err = p.createTable(ctx)
+		case strings.HasSuffix(err.Error(), POSTGRESQL_COLUMN_NOT_FOUND_ERROR_SUFFIX):
+			err = p.addTokenColumn(ctx)
+		default:
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		err = p.upsertToken(ctx, token)
+	}
+	if err != nil {
+		return err
+	}
+
+	p.logger.Debug("token written", slog.Any("token", token))
+	return nil
+}
+
+func (p *Postgresql) upsertToken(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.opts.Timeout)*time.Second)
+	defer cancel()
+
+	_, err := p.conn.Exec(ctx, fmt.Sprintf("INSERT INTO %s (id, ts, token) VALUES (1, now(), $1) ON CONFLICT (id) DO UPDATE SET ts = now(), token = $1", p.table), token)
+	return err
+}
+
+// Tables created before tokens were introduced lack the token column
+func (p *Postgresql) addTokenColumn(ctx context.Context) error {
+	p.logger.Debug("adding token column")
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.opts.Timeout)*time.Second)
+	defer cancel()
+
+	_, err := p.conn.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS token text", p.table))
+	return err
+}
+
+// ReadToken returns the token and timestamp of the canary row, or an empty
+// token when the row or the table does not exist yet and create is enabled
+func (p *Postgresql) ReadToken(ctx context.Context) (token string, ts time.Time, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.opts.Timeout)*time.Second)
+	defer cancel()
+
+	err = p.conn.QueryRow(ctx, fmt.Sprintf("SELECT coalesce(token, ''), ts FROM %s WHERE id = 1", p.table)).Scan(&token, &ts)
+	if errors.Is(err, pgx.ErrNoRows) && !p.opts.Create {
+		return "", time.Time{}, ErrKeyNotFound
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", time.Time{}, nil
+	}
+	// The table or its token column are created by the next token write
+	if err != nil && p.opts.Create && (strings.HasSuffix(err.Error(), POSTGRESQL_TABLE_NOT_FOUND_ERROR_SUFFIX) || strings.HasSuffix(err.Error(), POSTGRESQL_COLUMN_NOT_FOUND_ERROR_SUFFIX)) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, ts, nil
+}
+
+func (p *Postgresql) Disconnect(ctx context.Context) error {
 	if p.conn != nil {
 		p.logger.Debug("disconnecting")
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.opts.Timeout)*time.Second)
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(p.opts.Timeout)*time.Second)
 		defer cancel()
 
 		err := p.conn.Close(ctx)
@@ -214,3 +366,28 @@ func (p *Postgresql) Disconnect() error {
 	}
 	return nil
 }
+
+// Classify maps SQLSTATE codes to a failure reason
+func (p *Postgresql) Classify(err error) string {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(pgErr.Code, "28"): // invalid_authorization_specification
+		return REASON_AUTHENTICATION
+	case pgErr.Code == "42501": // insufficient_privilege
+		return REASON_PERMISSION
+	case pgErr.Code == "42P01", pgErr.Code == "42703", pgErr.Code == "3D000", pgErr.Code == "3F000": // undefined table, column, database, schema
+		return REASON_NOT_FOUND
+	case pgErr.Code == "25006": // read_only_sql_transaction
+		return REASON_READ_ONLY
+	case pgErr.Code == "57014": // query_canceled, raised by statement_timeout
+		return REASON_TIMEOUT
+	case strings.HasPrefix(pgErr.Code, "08"): // connection_exception
+		return REASON_CONNECTION
+	case strings.HasPrefix(pgErr.Code, "53"), strings.HasPrefix(pgErr.Code, "57P"): // insufficient resources, shutdown or startup
+		return REASON_UNAVAILABLE
+	}
+	return ""
+}
@@ -57,7 +57,7 @@ func promQuery(t *testing.T, base, query string) promQueryResponse {
 func TestPrometheusE2E(t *testing.T) {
 	base := fmt.Sprintf("http://%s:%d", e2eHost("PROMETHEUS", "127.0.0.1"), e2ePort("PROMETHEUS", 9090))
 
-	jobs := []string{"postgresql", "mysql", "mongodb", "clickhouse", "valkey"}
+	jobs := []string{"postgresql", "mysql", "mongodb", "clickhouse", "valkey", "cassandra", "kafka", "rabbitmq", "opensearch", "memcached"}
 	metrics := []string{"canary_ng_jobs", "canary_ng_queries", "canary_ng_duration_count"}
 
 	deadline := time.Now().Add(90 * time.Second)
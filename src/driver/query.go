@@ -0,0 +1,213 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Layouts tried to parse timestamps returned as text, as MySQL does without
+// parseTime in the DSN
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// Returned when the result of a custom read query does not satisfy an
+// assertion
+var ErrAssertion = errors.New("assertion failed")
+
+// Result of a custom read query, with the values of each row in the order of
+// the columns
+type Result struct {
+	Columns []string
+	Rows    [][]any
+}
+
+type AssertionOpts struct {
+	Rows        *int // exact number of rows
+	MinRows     *int
+	Column      string
+	Equals      *string
+	GreaterThan *float64
+	MaxAge      time.Duration // maximum age of a timestamp column
+}
+
+// Assertion checks the result of a custom read query, either its number of
+// rows or the value of a column in every row
+type Assertion struct {
+	opts AssertionOpts
+}
+
+func NewAssertion(opts AssertionOpts) (*Assertion, error) {
+	checks := 0
+	for _, set := range []bool{opts.Rows != nil, opts.MinRows != nil, opts.Equals != nil, opts.GreaterThan != nil, opts.MaxAge > 0} {
+		if set {
+			checks++
+		}
+	}
+	if checks != 1 {
+		return nil, fmt.Errorf("assertion requires exactly one of rows, min_rows, equals, greater_than or max_age")
+	}
+
+	rows := opts.Rows != nil || opts.MinRows != nil
+	if rows && opts.Column != "" {
+		return nil, fmt.Errorf("row count assertion does not apply to a column")
+	}
+	if !rows && opts.Column == "" {
+		return nil, fmt.Errorf("column is required")
+	}
+
+	return &Assertion{opts: opts}, nil
+}
+
+// Check returns an error wrapping ErrAssertion when the result does not
+// satisfy the assertion
+func (a *Assertion) Check(result Result) error {
+	switch {
+	case a.opts.Rows != nil:
+		if len(result.Rows) != *a.opts.Rows {
+			return fmt.Errorf("%w: got %d rows, expect %d", ErrAssertion, len(result.Rows), *a.opts.Rows)
+		}
+		return nil
+	case a.opts.MinRows != nil:
+		if len(result.Rows) < *a.opts.MinRows {
+			return fmt.Errorf("%w: got %d rows, expect at least %d", ErrAssertion, len(result.Rows), *a.opts.MinRows)
+		}
+		return nil
+	}
+
+	index := -1
+	for i, name := range result.Columns {
+		if name == a.opts.Column {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("%w: column %s not found", ErrAssertion, a.opts.Column)
+	}
+	if len(result.Rows) == 0 {
+		return fmt.Errorf("%w: no rows to check column %s", ErrAssertion, a.opts.Column)
+	}
+
+	for _, row := range result.Rows {
+		if err := a.checkValue(normalize(row[index])); err != nil {
+			return fmt.Errorf("%w: column %s %w", ErrAssertion, a.opts.Column, err)
+		}
+	}
+	return nil
+}
+
+func (a *Assertion) checkValue(value any) error {
+	if value == nil {
+		return fmt.Errorf("is null")
+	}
+
+	switch {
+	case a.opts.Equals != nil:
+		expected := *a.opts.Equals
+		// Numbers are compared by value so 1.0 equals 1
+		if f, err := toFloat(value); err == nil {
+			if e, err := strconv.ParseFloat(expected, 64); err == nil && f == e {
+				return nil
+			}
+		}
+		if got := fmt.Sprint(value); got != expected {
+			return fmt.Errorf("is %s, expect %s", got, expected)
+		}
+	case a.opts.GreaterThan != nil:
+		f, err := toFloat(value)
+		if err != nil {
+			return err
+		}
+		if f <= *a.opts.GreaterThan {
+			return fmt.Errorf("is %v, expect greater than %v", f, *a.opts.GreaterThan)
+		}
+	case a.opts.MaxAge > 0:
+		ts, err := toTime(value)
+		if err != nil {
+			return err
+		}
+		if age := time.Since(ts); age > a.opts.MaxAge {
+			return fmt.Errorf("is %s old, expect at most %s", age.Truncate(time.Second), a.opts.MaxAge)
+		}
+	}
+	return nil
+}
+
+// Assert checks a result against assertions, returning the first failure
+func Assert(result Result, assertions []*Assertion) error {
+	for _, a := range assertions {
+		if err := a.Check(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dereference the values scanned into pointers, and convert the raw bytes
+// returned by database/sql drivers to strings
+func normalize(value any) any {
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	v := reflect.ValueOf(value)
+	for v.IsValid() && v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	if b, ok := v.Interface().([]byte); ok {
+		return string(b)
+	}
+	return v.Interface()
+}
+
+func toFloat(value any) (float64, error) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return 0, fmt.Errorf("is %q, expect a number", v.String())
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("is %v, expect a number", value)
+}
+
+// Timestamps are either native, text or unix seconds
+func toTime(value any) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		for _, layout := range timestampLayouts {
+			if ts, err := time.Parse(layout, v); err == nil {
+				return ts, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("is %q, expect a timestamp", v)
+	}
+	f, err := toFloat(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("is %v, expect a timestamp", value)
+	}
+	return time.Unix(int64(f), 0), nil
+}
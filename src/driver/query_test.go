@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewAssertion(t *testing.T) {
+	one := 1
+	value := "ok"
+	tests := []struct {
+		name  string
+		input AssertionOpts
+		valid bool
+	}{
+		{"with rows", AssertionOpts{Rows: &one}, true},
+		{"with column equals", AssertionOpts{Column: "status", Equals: &value}, true},
+		{"with column max age", AssertionOpts{Column: "ts", MaxAge: time.Minute}, true},
+		{"without check", AssertionOpts{Column: "status"}, false},
+		{"with several checks", AssertionOpts{Column: "status", Equals: &value, MaxAge: time.Minute}, false},
+		{"with rows and column", AssertionOpts{Rows: &one, Column: "status"}, false},
+		{"with equals and without column", AssertionOpts{Equals: &value}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAssertion(tc.input)
+			if (err == nil) != tc.valid {
+				t.Errorf("got error %v, expect valid %t", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestAssertionCheck(t *testing.T) {
+	one := 1
+	two := 2
+	equals := "1"
+	threshold := 10.0
+	count := int64(42)
+	result := Result{
+		Columns: []string{"id", "status", "count", "ts", "epoch"},
+		Rows: [][]any{
+			{int64(1), []byte("1.0"), &count, time.Now().Add(-time.Second), "2000-01-01 00:00:00"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		input  AssertionOpts
+		result Result
+		pass   bool
+	}{
+		{"with matching rows", AssertionOpts{Rows: &one}, result, true},
+		{"with mismatching rows", AssertionOpts{Rows: &two}, result, false},
+		{"with min rows", AssertionOpts{MinRows: &one}, result, true},
+		{"with no rows", AssertionOpts{MinRows: &one}, Result{Columns: result.Columns}, false},
+		{"with number equal to integer", AssertionOpts{Column: "id", Equals: &equals}, result, true},
+		{"with text number equal to integer", AssertionOpts{Column: "status", Equals: &equals}, result, true},
+		{"with pointer greater than", AssertionOpts{Column: "count", GreaterThan: &threshold}, result, true},
+		{"with lower value", AssertionOpts{Column: "id", GreaterThan: &threshold}, result, false},
+		{"with recent timestamp", AssertionOpts{Column: "ts", MaxAge: time.Minute}, result, true},
+		{"with old text timestamp", AssertionOpts{Column: "epoch", MaxAge: time.Minute}, result, false},
+		{"with missing column", AssertionOpts{Column: "missing", Equals: &equals}, result, false},
+		{"with null value", AssertionOpts{Column: "id", Equals: &equals}, Result{Columns: []string{"id"}, Rows: [][]any{{nil}}}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAssertion(tc.input)
+			if err != nil {
+				t.Fatalf("could not create assertion: %v", err)
+			}
+
+			err = a.Check(tc.result)
+			if tc.pass && err != nil {
+				t.Errorf("got %v, expect no error", err)
+			}
+			if !tc.pass && !errors.Is(err, ErrAssertion) {
+				t.Errorf("got %v, expect %v", err, ErrAssertion)
+			}
+		})
+	}
+}
@@ -0,0 +1,429 @@
+package driver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	RABBITMQ_DRIVER        = "rabbitmq"
+	RABBITMQ_PORT          = 5672
+	RABBITMQ_TLS_PORT      = 5671
+	RABBITMQ_VHOST         = "/"
+	RABBITMQ_EXCHANGE_KIND = "direct"
+	RABBITMQ_MESSAGE_TTL   = 3600 // seconds before a canary message left in the queue expires
+)
+
+// https://www.rabbitmq.com/docs/queues#names
+var rabbitmqNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,255}$`)
+
+type RabbitmqOpts struct {
+	Hosts      []string
+	Port       int
+	Username   string
+	Password   string
+	Vhost      string
+	Timeout    int
+	Exchange   string // the default exchange is used when empty
+	Queue      string
+	RoutingKey string // name of the queue when empty
+	Create     bool
+	TLS        bool
+	SkipVerify bool
+	Logger     *slog.Logger
+}
+
+// Rabbitmq publishes canary messages with publisher confirms and consumes
+// them back from the canary queue. Messages are published with the identifier
+// of the driver as application id, so the messages of another canary-ng
+// instance sharing the queue are left to it.
+type Rabbitmq struct {
+	opts      RabbitmqOpts
+	hosts     []string
+	config    amqp.Config
+	conn      *amqp.Connection
+	channel   *amqp.Channel
+	returns   chan amqp.Return
+	id        string
+	published uint64 // sequence of the message ids
+	logger    *slog.Logger
+}
+
+func NewRabbitmq(opts RabbitmqOpts) (*Rabbitmq, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = TIMEOUT
+	}
+
+	if opts.Queue == "" {
+		return nil, fmt.Errorf("queue is required")
+	}
+	if err := validateRabbitmqName(opts.Queue); err != nil {
+		return nil, fmt.Errorf("invalid queue name: %w", err)
+	}
+	if opts.Exchange != "" {
+		if err := validateRabbitmqName(opts.Exchange); err != nil {
+			return nil, fmt.Errorf("invalid exchange name: %w", err)
+		}
+	}
+	if opts.RoutingKey == "" {
+		opts.RoutingKey = opts.Queue
+	}
+	// Only the queue named by the routing key is reachable from the default
+	// exchange
+	if opts.Exchange == "" && opts.RoutingKey != opts.Queue {
+		return nil, fmt.Errorf("routing key must be the queue name with the default exchange")
+	}
+	if opts.Vhost == "" {
+		opts.Vhost = RABBITMQ_VHOST
+	}
+
+	// RabbitMQ hosts expect a port
+	var hosts []string
+	port := RABBITMQ_PORT
+	if opts.TLS || opts.SkipVerify {
+		port = RABBITMQ_TLS_PORT
+	}
+	if opts.Port != 0 {
+		port = opts.Port
+	}
+	for _, h := range opts.Hosts {
+		if !strings.Contains(h, ":") {
+			hosts = append(hosts, h+":"+strconv.Itoa(port))
+		} else {
+			hosts = append(hosts, h)
+		}
+	}
+
+	config := amqp.Config{
+		Vhost: opts.Vhost,
+		Dial:  amqp.DefaultDial(time.Duration(opts.Timeout) * time.Second),
+	}
+	if opts.Username != "" {
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: opts.Username, Password: opts.Password}}
+	}
+	if opts.TLS || opts.SkipVerify {
+		config.TLSClientConfig = &tls.Config{}
+		if opts.SkipVerify {
+			config.TLSClientConfig.InsecureSkipVerify = true
+		}
+	}
+
+	var logger *slog.Logger
+	if opts.Logger != nil {
+		logger = opts.Logger.With("driver", RABBITMQ_DRIVER)
+	} else {
+		logger = slog.With("driver", RABBITMQ_DRIVER)
+	}
+
+	return &Rabbitmq{
+		opts:   opts,
+		hosts:  hosts,
+		config: config,
+		id:     rand.Text(),
+		logger: logger,
+	}, nil
+}
+
+// Names starting with amq. are reserved by the broker
+func validateRabbitmqName(name string) error {
+	if !rabbitmqNameRegexp.MatchString(name) {
+		return fmt.Errorf("name %q contains characters other than letters, digits, ., _, : and -", name)
+	}
+	if strings.HasPrefix(name, "amq.") {
+		return fmt.Errorf("name %q uses the reserved amq. prefix", name)
+	}
+	return nil
+}
+
+// Connect to the first reachable host, open a channel in confirm mode and
+// declare the canary queue and exchange when create is enabled
+func (r *Rabbitmq) Connect(ctx context.Context) error {
+	r.logger.Debug("connecting")
+
+	if len(r.hosts) == 0 {
+		return fmt.Errorf("invalid rabbitmq hosts")
+	}
+
+	scheme := "amqp"
+	if r.config.TLSClientConfig != nil {
+		scheme = "amqps"
+	}
+
+	var conn *amqp.Connection
+	var err error
+	for _, host := range r.hosts {
+		u := url.URL{Scheme: scheme, Host: host, Path: "/"}
+		// The server name of the TLS configuration is set to each host
+		config := r.config
+		config.TLSClientConfig = r.config.TLSClientConfig.Clone()
+		if conn, err = amqp.DialConfig(u.String(), config); err == nil {
+			break
+		}
+		r.logger.Debug("could not connect", slog.String("host", host), slog.Any("error", err))
+	}
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+
+	if err = r.open(ctx); err != nil {
+		conn.Close()
+		return err
+	}
+	r.logger.Debug("connected")
+	return nil
+}
+
+// Open a channel in confirm mode
+func (r *Rabbitmq) open(ctx context.Context) (err error) {
+	defer r.withDeadline(ctx)()
+
+	if r.channel, err = r.conn.Channel(); err != nil {
+		return err
+	}
+	if err = r.channel.Confirm(false); err != nil {
+		return err
+	}
+	// Unroutable messages are returned before being confirmed
+	r.returns = r.channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	if r.opts.Create {
+		return r.declare()
+	}
+	return nil
+}
+
+func (r *Rabbitmq) declare() error {
+	r.logger.Debug("declaring queue")
+	if _, err := r.channel.QueueDeclare(r.opts.Queue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if r.opts.Exchange == "" {
+		return nil
+	}
+
+	r.logger.Debug("declaring exchange")
+	if err := r.channel.ExchangeDeclare(r.opts.Exchange, RABBITMQ_EXCHANGE_KIND, true, false, false, false, nil); err != nil {
+		return err
+	}
+	return r.channel.QueueBind(r.opts.Queue, r.opts.RoutingKey, r.opts.Exchange, false, nil)
+}
+
+// AMQP methods do not take a context, so the connection is closed to
+// interrupt them when the timeout expires
+func (r *Rabbitmq) withDeadline(ctx context.Context) func() {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(r.opts.Timeout)*time.Second)
+	conn := r.conn
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	return func() {
+		stop()
+		cancel()
+	}
+}
+
+func (r *Rabbitmq) Read(ctx context.Context) error {
+	r.logger.Debug("reading")
+
+	value, err := r.consume(ctx)
+	if errors.Is(err, ErrKeyNotFound) && r.opts.Create {
+		return r.Write(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.logger.Debug("read", slog.String("result", value))
+	return nil
+}
+
+// Consume and acknowledge the messages of the queue, returning the latest one,
+// so messages left by failed reads do not pile up. Messages published by
+// another canary-ng instance are requeued once the queue is drained, so they
+// are not got again, while messages published by other applications, without
+// application id, are consumed.
+func (r *Rabbitmq) consume(ctx context.Context) (string, error) {
+	defer r.withDeadline(ctx)()
+
+	var others []amqp.Delivery
+	defer func() {
+		for _, message := range others {
+			if err := message.Nack(false, true); err != nil {
+				r.logger.Debug("could not requeue message", slog.String("app_id", message.AppId), slog.Any("error", err))
+			}
+		}
+	}()
+
+	var value string
+	found := false
+	for {
+		message, ok, err := r.channel.Get(r.opts.Queue, false)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			break
+		}
+		if message.AppId != "" && message.AppId != r.id {
+			others = append(others, message)
+		} else {
+			if err = message.Ack(false); err != nil {
+				return "", err
+			}
+			value, found = string(message.Body), true
+		}
+		if message.MessageCount == 0 {
+			break
+		}
+	}
+	if !found {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (r *Rabbitmq) Write(ctx context.Context) error {
+	r.logger.Debug("writing")
+
+	ts := time.Now().Format(time.RFC3339Nano)
+	if err := r.publish(ctx, ts); err != nil {
+		return err
+	}
+	r.logger.Debug("written", slog.Any("ts", ts))
+	return nil
+}
+
+// Publish a persistent message and wait for the broker to confirm it. A
+// message left in the queue expires, so the messages of an instance that
+// stopped do not pile up.
+func (r *Rabbitmq) publish(ctx context.Context, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(r.opts.Timeout)*time.Second)
+	defer cancel()
+
+	// Returns of previous messages whose confirmation was not waited for,
+	// which would otherwise fill the channel and block the connection
+	for drained := false; !drained; {
+		select {
+		case <-r.returns:
+		default:
+			drained = true
+		}
+	}
+
+	r.published++
+	id := r.id + "-" + strconv.FormatUint(r.published, 10)
+	confirmation, err := r.channel.PublishWithDeferredConfirmWithContext(ctx, r.opts.Exchange, r.opts.RoutingKey, true, false, amqp.Publishing{
+		ContentType:  "text/plain",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		AppId:        r.id,
+		MessageId:    id,
+		Expiration:   strconv.Itoa(RABBITMQ_MESSAGE_TTL * 1000),
+		Body:         []byte(value),
+	})
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Returned before being confirmed, after the returns of previous messages
+	for drained := false; !drained; {
+		select {
+		case returned := <-r.returns:
+			if returned.MessageId == id {
+				return fmt.Errorf("message returned: %s", returned.ReplyText)
+			}
+		default:
+			drained = true
+		}
+	}
+	if !acked {
+		return fmt.Errorf("message not acknowledged by the broker")
+	}
+	return nil
+}
+
+// WriteToken publishes a message made of the current time and the token, as
+// the value written by Write followed by the token
+func (r *Rabbitmq) WriteToken(ctx context.Context, token string) error {
+	r.logger.Debug("writing token")
+
+	if err := r.publish(ctx, time.Now().Format(time.RFC3339Nano)+" "+token); err != nil {
+		return err
+	}
+	r.logger.Debug("token written", slog.Any("token", token))
+	return nil
+}
+
+// ReadToken returns the token and publication time of the latest message, or
+// an empty token when the queue is empty
+func (r *Rabbitmq) ReadToken(ctx context.Context) (string, time.Time, error) {
+	value, err := r.consume(ctx)
+	if errors.Is(err, ErrKeyNotFound) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	ts, token, _ := strings.Cut(value, " ")
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid message %q: %w", value, err)
+	}
+	return token, t, nil
+}
+
+// Messages are consumed right after being published, so the age of the token
+// read is the publish-to-consume latency
+func (r *Rabbitmq) Queued() {}
+
+func (r *Rabbitmq) Disconnect(ctx context.Context) error {
+	if r.conn != nil {
+		r.logger.Debug("disconnecting")
+		if err := r.conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+		r.logger.Debug("disconnected")
+	}
+	return nil
+}
+
+// Classify maps AMQP reply codes to a failure reason
+func (r *Rabbitmq) Classify(err error) string {
+	if errors.Is(err, amqp.ErrCredentials) {
+		return REASON_AUTHENTICATION
+	}
+	if errors.Is(err, amqp.ErrClosed) {
+		return REASON_CONNECTION
+	}
+
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		return ""
+	}
+	switch amqpErr.Code {
+	case amqp.AccessRefused:
+		return REASON_PERMISSION
+	case amqp.NotFound:
+		return REASON_NOT_FOUND
+	case amqp.ConnectionForced, amqp.ResourceError, amqp.InternalError:
+		return REASON_UNAVAILABLE
+	}
+	return ""
+}
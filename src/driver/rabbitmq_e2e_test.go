@@ -0,0 +1,22 @@
+//go:build e2e
+
+package driver
+
+import "testing"
+
+func TestRabbitmqE2E(t *testing.T) {
+	d, err := NewRabbitmq(RabbitmqOpts{
+		Hosts:    []string{e2eHost("RABBITMQ", "127.0.0.1")},
+		Port:     e2ePort("RABBITMQ", 5672),
+		Username: e2eEnv("RABBITMQ", "USERNAME", "canary"),
+		Password: e2eEnv("RABBITMQ", "PASSWORD", "canary"),
+		Vhost:    e2eEnv("RABBITMQ", "VHOST", "/"),
+		Queue:    "canary_ng",
+		Create:   true,
+	})
+	if err != nil {
+		t.Fatalf("new rabbitmq: %v", err)
+	}
+
+	runDriverE2E(t, d)
+}
@@ -0,0 +1,342 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRabbitmqOpts(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      RabbitmqOpts
+		hosts      string
+		routingKey string
+		valid      bool
+	}{
+		{"with defaults", RabbitmqOpts{Hosts: []string{"127.0.0.1"}, Queue: "canary_ng"}, "127.0.0.1:5672", "canary_ng", true},
+		{"with tls", RabbitmqOpts{Hosts: []string{"192.168.0.1", "192.168.0.2:5673"}, Queue: "canary.ng", TLS: true}, "192.168.0.1:5671,192.168.0.2:5673", "canary.ng", true},
+		{"with exchange", RabbitmqOpts{Hosts: []string{"127.0.0.1"}, Port: 5673, Queue: "canary_ng", Exchange: "canary", RoutingKey: "probe"}, "127.0.0.1:5673", "probe", true},
+		{"without queue", RabbitmqOpts{Hosts: []string{"127.0.0.1"}}, "", "", false},
+		{"with invalid queue", RabbitmqOpts{Hosts: []string{"127.0.0.1"}, Queue: "canary ng"}, "", "", false},
+		{"with reserved exchange", RabbitmqOpts{Hosts: []string{"127.0.0.1"}, Queue: "canary_ng", Exchange: "amq.direct"}, "", "", false},
+		{"with routing key on default exchange", RabbitmqOpts{Hosts: []string{"127.0.0.1"}, Queue: "canary_ng", RoutingKey: "probe"}, "", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRabbitmq(tc.input)
+			if (err == nil) != tc.valid {
+				t.Fatalf("got error %v, expect valid %t", err, tc.valid)
+			}
+			if !tc.valid {
+				return
+			}
+
+			if got := strings.Join(r.hosts, ","); got != tc.hosts {
+				t.Errorf("got %s, expect %s", got, tc.hosts)
+			}
+			if r.opts.RoutingKey != tc.routingKey {
+				t.Errorf("got %s, expect %s", r.opts.RoutingKey, tc.routingKey)
+			}
+		})
+	}
+}
+
+// Fake broker answering the handshake, confirm mode, publish, get, ack and nack
+// methods of AMQP 0-9-1 for a single queue. Published messages are nacked, or
+// returned as unroutable, instead of being queued when set.
+type rabbitmqServer struct {
+	listener   net.Listener
+	mu         sync.Mutex
+	messages   []rabbitmqMessage
+	acked      int // deliveries acknowledged by the client
+	nack       bool
+	unroutable bool
+}
+
+// A queued message, with the property flags and list of its content header
+type rabbitmqMessage struct {
+	properties []byte
+	body       string
+}
+
+func newRabbitmqServer(t *testing.T) *rabbitmqServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	s := &rabbitmqServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func amqpShortString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func amqpLongString(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+func amqpMethod(class, method uint16, args ...[]byte) []byte {
+	payload := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, class), method)
+	for _, arg := range args {
+		payload = append(payload, arg...)
+	}
+	return payload
+}
+
+func writeAMQPFrame(w io.Writer, kind byte, channel uint16, payload []byte) {
+	frame := binary.BigEndian.AppendUint16([]byte{kind}, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	w.Write(append(append(frame, payload...), 0xce))
+}
+
+// Write a method followed by the header and body frames of its content
+func writeAMQPContent(w io.Writer, channel uint16, method []byte, message rabbitmqMessage) {
+	writeAMQPFrame(w, 1, channel, method)
+	header := amqpMethod(60, 0, binary.BigEndian.AppendUint64(nil, uint64(len(message.body))), message.properties)
+	writeAMQPFrame(w, 2, channel, header)
+	writeAMQPFrame(w, 3, channel, []byte(message.body))
+}
+
+func (s *rabbitmqServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	protocol := make([]byte, 8)
+	if _, err := io.ReadFull(r, protocol); err != nil {
+		return
+	}
+	writeAMQPFrame(conn, 1, 0, amqpMethod(10, 10, []byte{0, 9}, []byte{0, 0, 0, 0}, amqpLongString("PLAIN"), amqpLongString("en_US")))
+
+	var published uint64 // delivery tag of the confirms
+	var delivered uint64 // delivery tag of the messages got
+	var size uint64      // of the body of the message being published
+	var properties, body []byte
+	unacked := map[uint64]rabbitmqMessage{}
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		channel := binary.BigEndian.Uint16(header[1:3])
+		payload := make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		payload = payload[:len(payload)-1]
+
+		s.mu.Lock()
+		switch header[0] {
+		case 1:
+			switch class, method := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]); {
+			case class == 10 && method == 11: // connection.start-ok
+				writeAMQPFrame(conn, 1, 0, amqpMethod(10, 30, []byte{0, 0}, binary.BigEndian.AppendUint32(nil, 131072), []byte{0, 0}))
+			case class == 10 && method == 40: // connection.open
+				writeAMQPFrame(conn, 1, 0, amqpMethod(10, 41, amqpShortString("")))
+			case class == 10 && method == 50: // connection.close
+				writeAMQPFrame(conn, 1, 0, amqpMethod(10, 51))
+				s.mu.Unlock()
+				return
+			case class == 20 && method == 10: // channel.open
+				writeAMQPFrame(conn, 1, channel, amqpMethod(20, 11, amqpLongString("")))
+			case class == 85 && method == 10: // confirm.select
+				writeAMQPFrame(conn, 1, channel, amqpMethod(85, 11))
+			case class == 60 && method == 70: // basic.get
+				if len(s.messages) == 0 {
+					writeAMQPFrame(conn, 1, channel, amqpMethod(60, 72, amqpShortString("")))
+					break
+				}
+				message := s.messages[0]
+				s.messages = s.messages[1:]
+				delivered++
+				unacked[delivered] = message
+				writeAMQPContent(conn, channel, amqpMethod(60, 71, binary.BigEndian.AppendUint64(nil, delivered), []byte{0},
+					amqpShortString(""), amqpShortString("canary_ng"), binary.BigEndian.AppendUint32(nil, uint32(len(s.messages)))), message)
+			case class == 60 && method == 80: // basic.ack
+				delete(unacked, binary.BigEndian.Uint64(payload[4:12]))
+				s.acked++
+			case class == 60 && method == 120: // basic.nack, requeued at the head of the queue
+				tag := binary.BigEndian.Uint64(payload[4:12])
+				if payload[12]&0x02 != 0 {
+					s.messages = append([]rabbitmqMessage{unacked[tag]}, s.messages...)
+				}
+				delete(unacked, tag)
+			}
+		case 2: // content header of basic.publish
+			size, properties, body = binary.BigEndian.Uint64(payload[4:12]), payload[12:], nil
+		case 3: // content body of basic.publish
+			body = append(body, payload...)
+			if uint64(len(body)) < size {
+				break
+			}
+			published++
+			message := rabbitmqMessage{properties: properties, body: string(body)}
+			ack := amqpMethod(60, 80, binary.BigEndian.AppendUint64(nil, published), []byte{0})
+			switch {
+			case s.unroutable:
+				writeAMQPContent(conn, channel, amqpMethod(60, 50, []byte{0x01, 0x38}, amqpShortString("NO_ROUTE"), amqpShortString(""), amqpShortString("canary_ng")), message)
+				writeAMQPFrame(conn, 1, channel, ack)
+			case s.nack:
+				writeAMQPFrame(conn, 1, channel, amqpMethod(60, 120, binary.BigEndian.AppendUint64(nil, published), []byte{0}))
+			default:
+				s.messages = append(s.messages, message)
+				writeAMQPFrame(conn, 1, channel, ack)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestRabbitmqPublishConsume(t *testing.T) {
+	s := newRabbitmqServer(t)
+
+	ctx := context.Background()
+	r, err := NewRabbitmq(RabbitmqOpts{Hosts: []string{s.listener.Addr().String()}, Queue: "canary_ng", Timeout: 1})
+	if err != nil {
+		t.Fatalf("new rabbitmq: %v", err)
+	}
+	if err = r.Connect(ctx); err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer r.Disconnect(ctx)
+
+	if err = r.Read(ctx); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("got %v, expect %v", err, ErrKeyNotFound)
+	}
+
+	// The queue is drained, every message being acknowledged, and the latest
+	// one returned
+	for _, token := range []string{"old", "new"} {
+		if err = r.WriteToken(ctx, token); err != nil {
+			t.Fatalf("could not write token: %v", err)
+		}
+	}
+	token, ts, err := r.ReadToken(ctx)
+	if err != nil {
+		t.Fatalf("could not read token: %v", err)
+	}
+	if token != "new" || ts.IsZero() {
+		t.Errorf("got %s at %s, expect new", token, ts)
+	}
+	// Answered once the acknowledgements sent before are processed
+	if err = r.Read(ctx); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("got %v, expect %v", err, ErrKeyNotFound)
+	}
+	s.mu.Lock()
+	left, acked := len(s.messages), s.acked
+	s.mu.Unlock()
+	if left != 0 || acked != 2 {
+		t.Errorf("got %d messages left and %d acknowledged, expect 0 and 2", left, acked)
+	}
+
+	tests := []struct {
+		name       string
+		nack       bool
+		unroutable bool
+		expected   string
+	}{
+		{"with message nacked", true, false, "message not acknowledged by the broker"},
+		{"with message returned", false, true, "message returned: NO_ROUTE"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s.mu.Lock()
+			s.nack, s.unroutable = tc.nack, tc.unroutable
+			s.mu.Unlock()
+
+			err := r.WriteToken(ctx, "token")
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("got %v, expect %s", err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRabbitmqSharedQueue(t *testing.T) {
+	s := newRabbitmqServer(t)
+
+	ctx := context.Background()
+	var drivers []*Rabbitmq
+	for range 2 {
+		r, err := NewRabbitmq(RabbitmqOpts{Hosts: []string{s.listener.Addr().String()}, Queue: "canary_ng", Timeout: 1})
+		if err != nil {
+			t.Fatalf("new rabbitmq: %v", err)
+		}
+		if err = r.Connect(ctx); err != nil {
+			t.Fatalf("could not connect: %v", err)
+		}
+		defer r.Disconnect(ctx)
+		drivers = append(drivers, r)
+	}
+	r, peer := drivers[0], drivers[1]
+
+	if err := peer.WriteToken(ctx, "peer"); err != nil {
+		t.Fatalf("could not write token: %v", err)
+	}
+	if err := r.WriteToken(ctx, "own"); err != nil {
+		t.Fatalf("could not write token: %v", err)
+	}
+
+	// The message of the peer is requeued instead of being consumed
+	token, _, err := r.ReadToken(ctx)
+	if err != nil || token != "own" {
+		t.Errorf("got %s and %v, expect own", token, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		left := len(s.messages)
+		s.mu.Unlock()
+		if left == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	token, _, err = peer.ReadToken(ctx)
+	if err != nil || token != "peer" {
+		t.Errorf("got %s and %v, expect peer", token, err)
+	}
+}
+
+func TestRabbitmqStaleReturn(t *testing.T) {
+	s := newRabbitmqServer(t)
+
+	ctx := context.Background()
+	r, err := NewRabbitmq(RabbitmqOpts{Hosts: []string{s.listener.Addr().String()}, Queue: "canary_ng", Timeout: 1})
+	if err != nil {
+		t.Fatalf("new rabbitmq: %v", err)
+	}
+	if err = r.Connect(ctx); err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer r.Disconnect(ctx)
+
+	// Left by a previous message whose confirmation timed out
+	r.returns <- amqp.Return{MessageId: "previous", ReplyText: "NO_ROUTE"}
+	if err = r.WriteToken(ctx, "token"); err != nil {
+		t.Errorf("got %v, expect the stale return to be ignored", err)
+	}
+}
@@ -3,6 +3,7 @@ package driver
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
@@ -104,7 +105,7 @@ func NewValkey(opts ValkeyOpts) (v *Valkey, err error) {
 	}, nil
 }
 
-func (v *Valkey) Connect() error {
+func (v *Valkey) Connect(ctx context.Context) error {
 	v.logger.Debug("connecting")
 
 	client, err := valkey.NewClient(v.co)
@@ -116,19 +117,19 @@ func (v *Valkey) Connect() error {
 	return nil
 }
 
-func (v *Valkey) Read() error {
+func (v *Valkey) Read(ctx context.Context) error {
 	v.logger.Debug("reading")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(v.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(v.opts.Timeout)*time.Second)
 	defer cancel()
 
 	r, err := v.client.Do(ctx, v.client.B().Get().Key(v.opts.Key).Build()).ToString()
 
 	if err == valkey.Nil {
 		if v.opts.Create {
-			return v.Write()
+			return v.Write(ctx)
 		} else {
-			return fmt.Errorf("key does not exist")
+			return ErrKeyNotFound
 		}
 	}
 
@@ -140,10 +141,10 @@ func (v *Valkey) Read() error {
 	return nil
 }
 
-func (v *Valkey) Write() error {
+func (v *Valkey) Write(ctx context.Context) error {
 	v.logger.Debug("writing")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(v.opts.Timeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(v.opts.Timeout)*time.Second)
 	defer cancel()
 
 	ts := time.Now().Format(time.RFC3339)
@@ -155,7 +156,48 @@ func (v *Valkey) Write() error {
 	return nil
 }
 
-func (v *Valkey) Disconnect() error {
+// WriteToken stores the token after the current time, so the value keeps
+// starting with the timestamp written by Write
+func (v *Valkey) WriteToken(ctx context.Context, token string) error {
+	v.logger.Debug("writing token")
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(v.opts.Timeout)*time.Second)
+	defer cancel()
+
+	value := time.Now().Format(time.RFC3339Nano) + " " + token
+	if err := v.client.Do(ctx, v.client.B().Set().Key(v.opts.Key).Value(value).Build()).Error(); err != nil {
+		return err
+	}
+	v.logger.Debug("token written", slog.Any("token", token))
+	return nil
+}
+
+// ReadToken returns the token and timestamp stored in the key, or an empty
+// token when the key does not exist yet and create is enabled
+func (v *Valkey) ReadToken(ctx context.Context) (string, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(v.opts.Timeout)*time.Second)
+	defer cancel()
+
+	value, err := v.client.Do(ctx, v.client.B().Get().Key(v.opts.Key).Build()).ToString()
+	if valkey.IsValkeyNil(err) && !v.opts.Create {
+		return "", time.Time{}, ErrKeyNotFound
+	}
+	if valkey.IsValkeyNil(err) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	ts, token, _ := strings.Cut(value, " ")
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid value %q: %w", value, err)
+	}
+	return token, t, nil
+}
+
+func (v *Valkey) Disconnect(ctx context.Context) error {
 	if v.client != nil {
 		v.logger.Debug("disconnecting")
 		v.client.Close()
@@ -163,3 +205,23 @@ func (v *Valkey) Disconnect() error {
 	}
 	return nil
 }
+
+// Classify maps Valkey error replies to a failure reason
+func (v *Valkey) Classify(err error) string {
+	var valkeyErr *valkey.ValkeyError
+	if !errors.As(err, &valkeyErr) || valkeyErr.IsNil() {
+		return ""
+	}
+	code, _, _ := strings.Cut(valkeyErr.Error(), " ")
+	switch code {
+	case "NOAUTH", "WRONGPASS":
+		return REASON_AUTHENTICATION
+	case "NOPERM":
+		return REASON_PERMISSION
+	case "READONLY":
+		return REASON_READ_ONLY
+	case "LOADING", "MASTERDOWN", "CLUSTERDOWN", "TRYAGAIN", "BUSY":
+		return REASON_UNAVAILABLE
+	}
+	return ""
+}
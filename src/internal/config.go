@@ -9,18 +9,34 @@ import (
 )
 
 type Config struct {
-	ListenAddr     string            `yaml:"listen_addr"`
-	Route          string            `yaml:"route"`
-	Jobs           []JobConfig       `yaml:"jobs"`
-	JobLabelName   string            `yaml:"job_label_name"`
-	Buckets        []float64         `yaml:"buckets"`
-	DurationMetric string            `yaml:"duration_metric"`
-	FailuresMetric string            `yaml:"failures_metric"`
-	JobsMetric     string            `yaml:"jobs_metric"`
-	QueriesMetric  string            `yaml:"queries_metric"`
-	QueryLabels    QueryLabelsConfig `yaml:"query_labels"`
-	LogLevel       string            `yaml:"log_level"`
-	LogFormat      string            `yaml:"log_format"`
+	ListenAddr                string            `yaml:"listen_addr"`
+	Route                     string            `yaml:"route"`
+	ProbeRoute                string            `yaml:"probe_route"`
+	ShutdownTimeout           int               `yaml:"shutdown_timeout"`
+	Jobs                      []JobConfig       `yaml:"jobs"`
+	JobLabelName              string            `yaml:"job_label_name"`
+	Buckets                   []float64         `yaml:"buckets"`
+	DurationMetric            string            `yaml:"duration_metric"`
+	FailuresMetric            string            `yaml:"failures_metric"`
+	JobsMetric                string            `yaml:"jobs_metric"`
+	QueriesMetric             string            `yaml:"queries_metric"`
+	MismatchesMetric          string            `yaml:"mismatches_metric"`
+	ReadAgeMetric             string            `yaml:"read_age_metric"`
+	ReplicationMetric         string            `yaml:"replication_metric"`
+	UpMetric                  string            `yaml:"up_metric"`
+	LastSuccessMetric         string            `yaml:"last_success_metric"`
+	LastFailureMetric         string            `yaml:"last_failure_metric"`
+	ConsecutiveFailuresMetric string            `yaml:"consecutive_failures_metric"`
+	ReplicaLabelName          string            `yaml:"replica_label_name"`
+	PhaseLabelName            string            `yaml:"phase_label_name"`
+	ReasonLabelName           string            `yaml:"reason_label_name"`
+	ReloadSuccessMetric       string            `yaml:"reload_success_metric"`
+	ReloadTimestampMetric     string            `yaml:"reload_timestamp_metric"`
+	DiscoveredJobsMetric      string            `yaml:"discovered_jobs_metric"`
+	QueryLabels               QueryLabelsConfig `yaml:"query_labels"`
+	Sharding                  ShardingConfig    `yaml:"sharding"`
+	LogLevel                  string            `yaml:"log_level"`
+	LogFormat                 string            `yaml:"log_format"`
 }
 
 type QueryLabelsConfig struct {
@@ -42,6 +58,7 @@ type JobConfig struct {
 	Password             string            `yaml:"password"`
 	Host                 string            `yaml:"host"`
 	Hosts                []string          `yaml:"hosts"`
+	ReplicaHosts         []string          `yaml:"replica_hosts"`
 	CacheHostnames       bool              `yaml:"cache_hostnames"`
 	HostsDiscovery       DiscoveryConfig   `yaml:"hosts_discovery"`
 	JobPerHost           bool              `yaml:"job_per_host"`
@@ -49,14 +66,30 @@ type JobConfig struct {
 	NameSeparator        string            `yaml:"name_separator"` // used when prefix_name_with_host is defined
 	Port                 int               `yaml:"port"`
 	QueryType            string            `yaml:"query_type"`
+	ConnectionMode       string            `yaml:"connection_mode"`
 	Timeout              int               `yaml:"timeout"`
 	Database             string            `yaml:"database"`
+	Keyspace             string            `yaml:"keyspace"`
 	AuthSource           string            `yaml:"auth_source"`
 	AuthMechanism        string            `yaml:"auth_mechanism"`
 	Collection           string            `yaml:"collection"`
 	Table                string            `yaml:"table"`
 	Cluster              string            `yaml:"cluster"`
 	Key                  string            `yaml:"key"`
+	TTL                  int               `yaml:"ttl"`
+	Topic                string            `yaml:"topic"`
+	Partition            int               `yaml:"partition"`
+	Acks                 string            `yaml:"acks"`
+	ReplicationFactor    int               `yaml:"replication_factor"`
+	Vhost                string            `yaml:"vhost"`
+	Exchange             string            `yaml:"exchange"`
+	Queue                string            `yaml:"queue"`
+	RoutingKey           string            `yaml:"routing_key"`
+	Index                string            `yaml:"index"`
+	Shards               int               `yaml:"shards"`
+	Replicas             *int              `yaml:"replicas"`
+	Search               bool              `yaml:"search"`
+	APIKey               string            `yaml:"api_key"`
 	Create               bool              `yaml:"create"`
 	Secure               bool              `yaml:"secure"`
 	SkipVerify           bool              `yaml:"skip_verify"`
@@ -66,34 +99,106 @@ type JobConfig struct {
 	TLSConfig            string            `yaml:"tls_config"`
 	AllowNativePasswords bool              `yaml:"allow_native_passwords"`
 	MasterSet            string            `yaml:"master_set"`
+	DirectConnection     bool              `yaml:"direct_connection"`
+	Datacenter           string            `yaml:"datacenter"`
+	ReadConsistency      string            `yaml:"read_consistency"`
+	WriteConsistency     string            `yaml:"write_consistency"`
+	ReadQuery            string            `yaml:"read_query"`
+	ReadParams           []any             `yaml:"read_params"`
+	WriteQuery           string            `yaml:"write_query"`
+	WriteParams          []any             `yaml:"write_params"`
+	Assertions           []AssertionConfig `yaml:"assertions"`
+}
+
+// Check of the result of a custom read query, either its number of rows or the
+// value of a column in every row
+type AssertionConfig struct {
+	Rows        *int     `yaml:"rows"`
+	MinRows     *int     `yaml:"min_rows"`
+	Column      string   `yaml:"column"`
+	Equals      *string  `yaml:"equals"`
+	GreaterThan *float64 `yaml:"greater_than"`
+	MaxAge      int      `yaml:"max_age"` // seconds
 }
 
 type DiscoveryConfig struct {
-	Type        string            `yaml:"type"`
-	Interval    int               `yaml:"interval"`
-	Addresses   []string          `yaml:"addresses"`
-	Datacenter  string            `yaml:"datacenter"`
-	Scheme      string            `yaml:"scheme"`
-	SkipVerify  bool              `yaml:"skip_verify"`
-	Token       string            `yaml:"token"`
-	NodeMeta    map[string]string `yaml:"node_meta"`
-	ReturnMeta  string            `yaml:"return_meta"`
-	ReturnMetas []string          `yaml:"return_metas"`
+	Type          string            `yaml:"type"`
+	Interval      int               `yaml:"interval"`
+	Addresses     []string          `yaml:"addresses"`
+	Datacenter    string            `yaml:"datacenter"`
+	Scheme        string            `yaml:"scheme"`
+	SkipVerify    bool              `yaml:"skip_verify"`
+	Token         string            `yaml:"token"`
+	NodeMeta      map[string]string `yaml:"node_meta"`
+	ReturnMeta    string            `yaml:"return_meta"`
+	ReturnMetas   []string          `yaml:"return_metas"`
+	Service       string            `yaml:"service"`
+	Tags          []string          `yaml:"tags"`
+	PassingOnly   bool              `yaml:"passing_only"`
+	Names         []string          `yaml:"names"`
+	Resolver      string            `yaml:"resolver"`
+	Resolve       bool              `yaml:"resolve"`
+	Files         []string          `yaml:"files"`
+	URL           string            `yaml:"url"`
+	Username      string            `yaml:"username"`
+	Password      string            `yaml:"password"`
+	CAFile        string            `yaml:"ca_file"`
+	Kubeconfig    string            `yaml:"kubeconfig"`
+	Role          string            `yaml:"role"`
+	Namespaces    []string          `yaml:"namespaces"`
+	LabelSelector string            `yaml:"label_selector"`
+	Labels        map[string]string `yaml:"labels"`       // label names mapped to the metadata labels of the targets
+	GracePeriod   int               `yaml:"grace_period"` // seconds before deleting the metrics of a vanished host
+	Relabel       []RelabelConfig   `yaml:"relabel_configs"`
 }
 
-func NewConfig(file string) (config *Config, err error) {
+// Split of the discovered hosts between several instances, either by a static
+// shard index and count or between the peers returned by a discovery
+type ShardingConfig struct {
+	Index          int             `yaml:"index"`
+	Count          int             `yaml:"count"`
+	Instance       string          `yaml:"instance"` // host of this instance among the peers
+	PeersDiscovery DiscoveryConfig `yaml:"peers_discovery"`
+}
+
+// Relabeling step applied to the discovered targets, as in Prometheus
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	TargetLabel  string   `yaml:"target_label"`
+	Regex        string   `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+}
 
-	// Default configuration
-	config = &Config{
-		ListenAddr:     ":8080",
-		Route:          "/metrics",
-		LogLevel:       "warn",
-		LogFormat:      "text",
-		JobLabelName:   "job_name",
-		DurationMetric: "canary_ng_duration",
-		FailuresMetric: "canary_ng_failures",
-		JobsMetric:     "canary_ng_jobs",
-		QueriesMetric:  "canary_ng_queries",
+// Default configuration, overridden by the configuration file
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:                ":8080",
+		Route:                     "/metrics",
+		ProbeRoute:                "/probe",
+		ShutdownTimeout:           SHUTDOWN_TIMEOUT,
+		LogLevel:                  "warn",
+		LogFormat:                 "text",
+		JobLabelName:              "job_name",
+		DurationMetric:            "canary_ng_duration",
+		FailuresMetric:            "canary_ng_failures",
+		JobsMetric:                "canary_ng_jobs",
+		QueriesMetric:             "canary_ng_queries",
+		MismatchesMetric:          "canary_ng_mismatches",
+		ReadAgeMetric:             "canary_ng_read_age_seconds",
+		ReplicationMetric:         "canary_ng_replication_lag",
+		UpMetric:                  "canary_ng_up",
+		LastSuccessMetric:         "canary_ng_last_success_timestamp_seconds",
+		LastFailureMetric:         "canary_ng_last_failure_timestamp_seconds",
+		ConsecutiveFailuresMetric: "canary_ng_consecutive_failures",
+		ReplicaLabelName:          "replica",
+		PhaseLabelName:            "phase",
+		ReasonLabelName:           "reason",
+		ReloadSuccessMetric:       "canary_ng_config_last_reload_successful",
+		ReloadTimestampMetric:     "canary_ng_config_last_reload_success_timestamp_seconds",
+		DiscoveredJobsMetric:      "canary_ng_discovered_jobs",
 		QueryLabels: QueryLabelsConfig{
 			Name:            "query",
 			ConnectValue:    QUERY_TYPE_CONNECT,
@@ -102,6 +207,10 @@ func NewConfig(file string) (config *Config, err error) {
 			DisconnectValue: QUERY_TYPE_DISCONNECT,
 		},
 	}
+}
+
+func NewConfig(file string) (config *Config, err error) {
+	config = defaultConfig()
 
 	buf, err := os.ReadFile(file)
 	if err != nil {
@@ -114,16 +223,117 @@ func NewConfig(file string) (config *Config, err error) {
 
 	// Ensure query types are valid
 	for _, job := range config.Jobs {
-		if !utils.In([]string{QUERY_TYPE_READ, QUERY_TYPE_WRITE, QUERY_TYPE_READ_WRITE}, job.QueryType) {
+		if !utils.In([]string{QUERY_TYPE_READ, QUERY_TYPE_WRITE, QUERY_TYPE_READ_WRITE, QUERY_TYPE_REPLICATION}, job.QueryType) {
 			return nil, fmt.Errorf("invalid query type %s for job %s", job.QueryType, job.Name)
 		}
+		if !utils.In([]string{"", CONNECTION_MODE_CYCLE, CONNECTION_MODE_PERSISTENT}, job.ConnectionMode) {
+			return nil, fmt.Errorf("invalid connection mode %s for job %s", job.ConnectionMode, job.Name)
+		}
 	}
 
-	// Ensure jobs have a name
+	// Ensure replication jobs know their replicas: discovered hosts come in no
+	// particular order, and a job per host has a single one
+	for _, job := range config.Jobs {
+		if job.QueryType != QUERY_TYPE_REPLICATION || len(job.ReplicaHosts) > 0 {
+			continue
+		}
+		if job.HostsDiscovery.Type != "" {
+			return nil, fmt.Errorf("replica_hosts is required with hosts_discovery and query type replication for job %s", job.Name)
+		}
+		if job.JobPerHost {
+			return nil, fmt.Errorf("replica_hosts is required with job_per_host and query type replication for job %s", job.Name)
+		}
+	}
+
+	// Ensure Kafka messages are acknowledged before being consumed back, the
+	// read following the write could miss them otherwise
+	for _, job := range config.Jobs {
+		if job.Type == JOB_TYPE_KAFKA && job.Acks == "0" && job.QueryType == QUERY_TYPE_READ_WRITE {
+			return nil, fmt.Errorf("acks 0 is not supported with query type read_write for job %s", job.Name)
+		}
+	}
+
+	// Ensure labels do not collide with the labels set by the metrics
+	reserved := []string{config.QueryLabels.Name, config.PhaseLabelName, config.ReasonLabelName, config.ReplicaLabelName}
+	for _, job := range config.Jobs {
+		for name := range job.Labels {
+			if utils.In(reserved, name) {
+				return nil, fmt.Errorf("label %s of job %s is reserved", name, job.Name)
+			}
+		}
+		for name := range job.HostsDiscovery.Labels {
+			if utils.In(reserved, name) {
+				return nil, fmt.Errorf("discovery label %s of job %s is reserved", name, job.Name)
+			}
+		}
+		for _, name := range relabelLabelNames(job.HostsDiscovery) {
+			if utils.In(reserved, name) {
+				return nil, fmt.Errorf("relabel target label %s of job %s is reserved", name, job.Name)
+			}
+		}
+	}
+
+	// Ensure relabeling steps are valid
+	for _, job := range config.Jobs {
+		if _, err := newRelabels(job.HostsDiscovery); err != nil {
+			return nil, fmt.Errorf("invalid relabel_configs for job %s: %w", job.Name, err)
+		}
+	}
+
+	// Ensure custom queries apply to a SQL driver and a query type that does
+	// not rely on tokens
+	for _, job := range config.Jobs {
+		if job.ReadQuery == "" && job.WriteQuery == "" && len(job.Assertions) == 0 {
+			continue
+		}
+		if !utils.In([]string{JOB_TYPE_CLICKHOUSE, JOB_TYPE_MYSQL, JOB_TYPE_POSTGRESQL}, job.Type) {
+			return nil, fmt.Errorf("custom queries are not supported by %s for job %s", job.Type, job.Name)
+		}
+		if !utils.In([]string{QUERY_TYPE_READ, QUERY_TYPE_WRITE}, job.QueryType) {
+			return nil, fmt.Errorf("custom queries are not supported with query type %s for job %s", job.QueryType, job.Name)
+		}
+		// The table is queried when the query of the query type is not set
+		if job.QueryType == QUERY_TYPE_READ && job.ReadQuery == "" && job.Table == "" {
+			return nil, fmt.Errorf("read query or table is required with query type read for job %s", job.Name)
+		}
+		if job.QueryType == QUERY_TYPE_WRITE && job.WriteQuery == "" && job.Table == "" {
+			return nil, fmt.Errorf("write query or table is required with query type write for job %s", job.Name)
+		}
+		if len(job.Assertions) > 0 && job.QueryType != QUERY_TYPE_READ {
+			return nil, fmt.Errorf("assertions require query type read for job %s", job.Name)
+		}
+		if len(job.Assertions) > 0 && job.ReadQuery == "" {
+			return nil, fmt.Errorf("assertions require a read query for job %s", job.Name)
+		}
+		if _, err := newAssertions(job); err != nil {
+			return nil, fmt.Errorf("invalid assertions for job %s: %w", job.Name, err)
+		}
+	}
+
+	// Ensure sharding is either static or discovered
+	sharding := config.Sharding
+	switch {
+	case sharding.Count > 0 && sharding.PeersDiscovery.Type != "":
+		return nil, fmt.Errorf("sharding count and peers discovery are mutually exclusive")
+	case sharding.Count < 0 || sharding.Index < 0 || sharding.Count > 0 && sharding.Index >= sharding.Count:
+		return nil, fmt.Errorf("invalid shard index %d for %d shards", sharding.Index, sharding.Count)
+	case sharding.PeersDiscovery.Type != "" && sharding.Instance == "":
+		return nil, fmt.Errorf("sharding instance is required with peers discovery")
+	}
+	if _, err := newRelabels(sharding.PeersDiscovery); err != nil {
+		return nil, fmt.Errorf("invalid relabel_configs for peers discovery: %w", err)
+	}
+
+	// Ensure jobs have a unique name, used to reconcile jobs on reload
+	names := map[string]bool{}
 	for _, job := range config.Jobs {
 		if job.Name == "" {
 			return nil, fmt.Errorf("job without name")
 		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("duplicate job name %s", job.Name)
+		}
+		names[job.Name] = true
 	}
 
 	return config, nil
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewConfigCustomQueries(t *testing.T) {
+	tests := []struct {
+		name  string
+		job   string
+		valid bool
+	}{
+		{"read query with query type read", "query_type: read\n    read_query: SELECT 1", true},
+		{"table with query type write", "query_type: write\n    table: canary_ng\n    read_query: SELECT 1", true},
+		{"read query only with query type write", "query_type: write\n    read_query: SELECT 1", false},
+		{"write query only with query type read", "query_type: read\n    write_query: INSERT INTO canary_ng VALUES (1)", false},
+		{"invalid query type", "query_type: connect\n    table: canary_ng", false},
+		{"assertions with query type write", "query_type: write\n    read_query: SELECT 1\n    write_query: INSERT INTO canary_ng VALUES (1)\n    assertions:\n      - rows: 1", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "canary-ng.yaml")
+			content := "jobs:\n  - name: a\n    type: postgresql\n    host: 127.0.0.1\n    " + tc.job + "\n"
+			if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+				t.Fatalf("could not write configuration: %v", err)
+			}
+			_, err := NewConfig(file)
+			if (err == nil) != tc.valid {
+				t.Errorf("got error %v, expect valid %t", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestNewConfigKafkaAcks(t *testing.T) {
+	tests := []struct {
+		name  string
+		job   string
+		valid bool
+	}{
+		{"acks 0 with query type write", "query_type: write\n    acks: \"0\"", true},
+		{"acks 1 with query type read_write", "query_type: read_write\n    acks: \"1\"", true},
+		{"acks 0 with query type read_write", "query_type: read_write\n    acks: \"0\"", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "canary-ng.yaml")
+			content := "jobs:\n  - name: a\n    type: kafka\n    host: 127.0.0.1\n    topic: canary_ng\n    " + tc.job + "\n"
+			if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+				t.Fatalf("could not write configuration: %v", err)
+			}
+			_, err := NewConfig(file)
+			if (err == nil) != tc.valid {
+				t.Errorf("got error %v, expect valid %t", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestNewConfigReplication(t *testing.T) {
+	tests := []struct {
+		name  string
+		job   string
+		valid bool
+	}{
+		{"with hosts", "hosts: [192.168.0.1, 192.168.0.2]", true},
+		{"with discovery and replica hosts", "hosts_discovery:\n      type: consul\n    replica_hosts: [192.168.0.2]", true},
+		{"with discovery", "hosts_discovery:\n      type: consul", false},
+		{"with job per host", "hosts: [192.168.0.1, 192.168.0.2]\n    job_per_host: true", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "canary-ng.yaml")
+			content := "jobs:\n  - name: a\n    type: postgresql\n    query_type: replication\n    table: canary_ng\n    " + tc.job + "\n"
+			if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+				t.Fatalf("could not write configuration: %v", err)
+			}
+			_, err := NewConfig(file)
+			if (err == nil) != tc.valid {
+				t.Errorf("got error %v, expect valid %t", err, tc.valid)
+			}
+		})
+	}
+}
@@ -1,81 +1,278 @@
 package internal
 
 import (
+	"context"
 	"log/slog"
+	"maps"
+	"slices"
 	"time"
+
+	"github.com/ovh/canary-ng/discover"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // DiscoveryManager keeps the running jobs of a discovery-based job configuration
-// in sync with the hosts currently returned by discovery. It re-discovers on an
-// interval so hosts appearing or disappearing are picked up without restarting
-// the application.
+// in sync with the hosts currently returned by discovery. Providers able to
+// watch push the hosts as they change, others are re-discovered on an interval,
+// so hosts appearing or disappearing are picked up without restarting the
+// application.
 type DiscoveryManager struct {
 	config       JobConfig
 	metrics      *Metrics
 	queryLabels  QueryLabelsConfig
 	jobLabelName string
 	interval     time.Duration
+	grace        time.Duration
 	logger       *slog.Logger
-	running      map[string]chan struct{}
-	discover     func() ([]string, error)
+	running      map[string]*runningJob
+	stale        []*staleJob
+	discover     func() ([]discover.Target, error)
+	watch        func(ctx context.Context, updates chan<- []discover.Target) error
+	ttl          func() time.Duration
+	close        func()
+	relabels     []*discover.Relabel
+	sharder      *Sharder
+	// Targets of the last discovery, assigned again when the shard members
+	// change, which closes sharded
+	last    []discover.Target
+	sharded <-chan struct{}
+}
+
+// A job started by the discovery manager, with the means to stop it and to
+// wait for its in-flight measurement to complete
+type runningJob struct {
+	job    *Job
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// A job stopped for a vanished host, or for a host whose labels changed, whose
+// metrics are deleted once the grace period has elapsed
+type staleJob struct {
+	*runningJob
+	host    string
+	expires time.Time
+}
+
+func startJob(ctx context.Context, job *Job) *runningJob {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &runningJob{
+		job:    job,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		job.Run(ctx)
+	}()
+	return r
 }
 
-func NewDiscoveryManager(config JobConfig, metrics *Metrics, queryLabels QueryLabelsConfig, jobLabelName string) *DiscoveryManager {
+func NewDiscoveryManager(config JobConfig, metrics *Metrics, queryLabels QueryLabelsConfig, jobLabelName string, sharder *Sharder) *DiscoveryManager {
 	interval := config.HostsDiscovery.Interval
 	if interval == 0 {
 		interval = DISCOVERY_INTERVAL
 	}
 
+	// A provider failing to be created fails every discovery, which is
+	// reported by the fallback polling
+	discoverTargets := func() ([]discover.Target, error) { return DiscoverTargets(config.HostsDiscovery) }
+	var watch func(ctx context.Context, updates chan<- []discover.Target) error
+	var ttl func() time.Duration
+	var closeProvider func()
+	if dh, err := newDiscover(config.HostsDiscovery); err == nil {
+		discoverTargets = dh.Discover
+		if w, ok := dh.(discover.Watcher); ok {
+			watch = w.Watch
+		}
+		if e, ok := dh.(discover.Expirer); ok {
+			ttl = e.TTL
+		}
+		if c, ok := dh.(discover.Closer); ok {
+			closeProvider = c.Close
+		}
+	}
+
+	// Relabeling steps are validated with the configuration
+	relabels, err := newRelabels(config.HostsDiscovery)
+	if err != nil {
+		slog.Warn("could not create relabeling, targets are not relabeled", slog.String("job", config.Name), slog.Any("error", err))
+	}
+
 	return &DiscoveryManager{
 		config:       config,
 		metrics:      metrics,
 		queryLabels:  queryLabels,
 		jobLabelName: jobLabelName,
 		interval:     time.Duration(interval) * time.Second,
+		grace:        time.Duration(config.HostsDiscovery.GracePeriod) * time.Second,
 		logger:       slog.With("job", config.Name),
-		running:      map[string]chan struct{}{},
-		discover:     func() ([]string, error) { return DiscoverHosts(config.HostsDiscovery) },
+		running:      map[string]*runningJob{},
+		discover:     discoverTargets,
+		watch:        watch,
+		ttl:          ttl,
+		close:        closeProvider,
+		relabels:     relabels,
+		sharder:      sharder,
 	}
 }
 
-func (s *DiscoveryManager) Run() {
-	s.logger.Info("discovery manager started", slog.Duration("interval", s.interval))
-	s.reconcile()
+// Run reconciles the running jobs on each change pushed by the provider, or on
+// the discovery interval when it cannot watch or its watch failed, until ctx is
+// cancelled, then stops every job and waits for them to return. Providers
+// returning records with a TTL are discovered again when the records expire
+// instead. The metrics of stopped jobs are deleted once their grace period has
+// elapsed, even when no discovery happens in between. The provider is closed
+// once stopped.
+func (s *DiscoveryManager) Run(ctx context.Context) {
+	updates := make(chan []discover.Target)
+	watchErr := make(chan error, 1)
+	var timer, cleanupTimer *time.Timer
+	var tick, cleanupTick <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		if cleanupTimer != nil {
+			cleanupTimer.Stop()
+		}
+	}()
+	poll := func() {
+		s.reconcile(ctx)
+		timer = time.NewTimer(s.next())
+		tick = timer.C
+	}
+
+	if s.watch != nil {
+		s.logger.Info("discovery manager started, watching changes")
+		go func() {
+			if err := s.watch(ctx, updates); err != nil {
+				watchErr <- err
+			}
+		}()
+	} else {
+		s.logger.Info("discovery manager started", slog.Duration("interval", s.interval))
+		poll()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.stopAll()
+			if s.close != nil {
+				s.close()
+			}
+			s.logger.Info("discovery manager stopped")
+			return
+		case <-tick:
+			s.reconcile(ctx)
+			timer.Reset(s.next())
+		case targets := <-updates:
+			s.apply(ctx, targets)
+		case <-s.sharded:
+			// Cleared first as it is not renewed when discovery returned no host
+			s.sharded = nil
+			s.apply(ctx, s.last)
+		case err := <-watchErr:
+			s.logger.Error("could not watch discovery, polling instead", slog.Duration("interval", s.interval), slog.Any("error", err))
+			poll()
+		case <-cleanupTick:
+			s.cleanup()
+		}
 
-	ticker := time.NewTicker(s.interval)
-	defer ticker.Stop()
+		// Armed only while stopped jobs are waiting for their metrics to be
+		// deleted
+		if cleanupTimer != nil {
+			cleanupTimer.Stop()
+		}
+		cleanupTick = nil
+		if len(s.stale) > 0 {
+			cleanupTimer = time.NewTimer(s.nextCleanup())
+			cleanupTick = cleanupTimer.C
+		}
+	}
+}
 
-	for range ticker.C {
-		s.reconcile()
+// nextCleanup returns the delay until the earliest grace period of the stopped
+// jobs elapses, or a short retry when one already elapsed while its in-flight
+// measurement is not completed
+func (s *DiscoveryManager) nextCleanup() time.Duration {
+	next := time.Duration(0)
+	for i, r := range s.stale {
+		if delay := time.Until(r.expires); i == 0 || delay < next {
+			next = delay
+		}
+	}
+	if next <= 0 {
+		return DISCOVERY_CLEANUP_RETRY * time.Second
 	}
+	return next
+}
+
+// next returns the delay until the next discovery: the TTL of the discovered
+// records when the provider has one, the discovery interval otherwise
+func (s *DiscoveryManager) next() time.Duration {
+	if s.ttl != nil {
+		if ttl := s.ttl(); ttl > 0 {
+			return max(ttl, DISCOVERY_MIN_INTERVAL*time.Second)
+		}
+	}
+	return s.interval
 }
 
 // reconcile discovers the current hosts and aligns the running jobs with them.
 // On a discovery failure the existing jobs are left running so a transient
 // outage does not interrupt monitoring.
-func (s *DiscoveryManager) reconcile() {
-	hosts, err := s.discover()
+func (s *DiscoveryManager) reconcile(ctx context.Context) {
+	targets, err := s.discover()
 	if err != nil {
 		s.logger.Warn("could not discover hosts", slog.Any("error", err))
 		return
 	}
-	if len(hosts) == 0 {
+	s.apply(ctx, targets)
+}
+
+// apply aligns the running jobs with the given targets, keeping only the ones
+// assigned to this instance when sharding
+func (s *DiscoveryManager) apply(ctx context.Context, targets []discover.Target) {
+	s.last = targets
+	targets = discover.ApplyRelabel(targets, s.relabels)
+	if len(targets) == 0 {
 		s.logger.Warn("0 host found by discovery")
 		return
 	}
 
-	desired, err := BuildJobs(s.config, hosts, s.metrics, s.queryLabels, s.jobLabelName)
-	if err != nil {
-		s.logger.Warn("could not build jobs", slog.Any("error", err))
-		return
+	if s.sharder != nil {
+		targets, s.sharded = s.sharder.Filter(targets)
+	}
+
+	desired := map[string]*Job{}
+	if len(targets) > 0 {
+		var err error
+		desired, err = BuildJobs(s.config, targets, s.metrics, s.queryLabels, s.jobLabelName)
+		if err != nil {
+			s.logger.Warn("could not build jobs", slog.Any("error", err))
+			return
+		}
+	} else {
+		s.logger.Info("no host assigned to this instance")
 	}
 
-	for key, stop := range s.running {
-		if _, ok := desired[key]; !ok {
+	// Jobs of hosts whose metadata changed the labels are restarted, so their
+	// metrics are exported with the new labels
+	for key, r := range s.running {
+		job, ok := desired[key]
+		if ok && maps.Equal(job.labels, r.job.labels) {
+			continue
+		}
+		if ok {
+			s.logger.Info("restarting job for host with changed labels", slog.String("host", key))
+		} else {
 			s.logger.Info("stopping job for vanished host", slog.String("host", key))
-			close(stop)
-			delete(s.running, key)
 		}
+		r.cancel()
+		delete(s.running, key)
+		s.stale = append(s.stale, &staleJob{runningJob: r, host: key, expires: time.Now().Add(s.grace)})
 	}
 
 	for key, job := range desired {
@@ -83,8 +280,65 @@ func (s *DiscoveryManager) reconcile() {
 			continue
 		}
 		s.logger.Info("starting job for discovered host", slog.String("host", key))
-		stop := make(chan struct{})
-		s.running[key] = stop
-		go job.Run(stop)
+		s.running[key] = startJob(ctx, job)
+	}
+
+	s.metrics.discovered.With(prometheus.Labels{s.jobLabelName: s.config.Name}).Set(float64(len(s.running)))
+	s.cleanup()
+}
+
+// cleanup deletes the metrics of the jobs stopped for longer than the grace
+// period, so vanished hosts do not stay exported forever. Jobs whose in-flight
+// measurement has not completed yet, which would otherwise export them again,
+// are retried on the next pass instead of blocking discovery. Metrics shared
+// with a running job, when jobs are not named after their host or when the host
+// reappeared, are kept.
+func (s *DiscoveryManager) cleanup() {
+	now := time.Now()
+	s.stale = slices.DeleteFunc(s.stale, func(r *staleJob) bool {
+		if now.Before(r.expires) {
+			return false
+		}
+		select {
+		case <-r.done:
+		default:
+			return false
+		}
+		if !s.inUse(r.job.labels) {
+			s.logger.Info("deleting metrics of stopped job", slog.String("host", r.host))
+			s.metrics.deleteJob(r.job.labels)
+		}
+		return true
+	})
+}
+
+// inUse returns whether a running job exports metrics with the given labels
+func (s *DiscoveryManager) inUse(labels prometheus.Labels) bool {
+	for _, r := range s.running {
+		if maps.Equal(r.job.labels, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// stopAll stops every running job, waits for the in-flight measurement of the
+// running and stale jobs to complete, and deletes their metrics along with the
+// discovered jobs count, so a discovery removed or changed by a reload does not
+// stay exported
+func (s *DiscoveryManager) stopAll() {
+	for _, r := range s.running {
+		r.cancel()
+	}
+	for key, r := range s.running {
+		<-r.done
+		delete(s.running, key)
+		s.metrics.deleteJob(r.job.labels)
+	}
+	for _, r := range s.stale {
+		<-r.done
+		s.metrics.deleteJob(r.job.labels)
 	}
+	s.stale = nil
+	s.metrics.discovered.Delete(prometheus.Labels{s.jobLabelName: s.config.Name})
 }
@@ -1,29 +1,25 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ovh/canary-ng/discover"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func testMetrics() *Metrics {
-	config := &Config{
-		JobLabelName:   "job_name",
-		DurationMetric: "canary_ng_duration",
-		FailuresMetric: "canary_ng_failures",
-		JobsMetric:     "canary_ng_jobs",
-		QueriesMetric:  "canary_ng_queries",
-		QueryLabels:    QueryLabelsConfig{Name: "query"},
-	}
-	return NewMetrics(prometheus.NewRegistry(), config)
+	return NewMetrics(prometheus.NewRegistry(), defaultConfig())
 }
 
-func newTestDiscoveryManager(discover func() ([]string, error)) *DiscoveryManager {
+func newTestDiscoveryManager(discoverHosts func() ([]string, error)) *DiscoveryManager {
 	config := JobConfig{
 		Name:           "discovery",
 		Type:           JOB_TYPE_POSTGRESQL,
@@ -42,8 +38,11 @@ func newTestDiscoveryManager(discover func() ([]string, error)) *DiscoveryManage
 		jobLabelName: "job_name",
 		interval:     time.Second,
 		logger:       slog.With("job", config.Name),
-		running:      map[string]chan struct{}{},
-		discover:     discover,
+		running:      map[string]*runningJob{},
+		discover: func() ([]discover.Target, error) {
+			hosts, err := discoverHosts()
+			return discover.Targets(hosts), err
+		},
 	}
 }
 
@@ -56,11 +55,11 @@ func runningKeys(s *DiscoveryManager) []string {
 	return keys
 }
 
-func isClosed(ch chan struct{}) bool {
+func isStopped(r *runningJob) bool {
 	select {
-	case <-ch:
+	case <-r.done:
 		return true
-	default:
+	case <-time.After(time.Second):
 		return false
 	}
 }
@@ -73,9 +72,10 @@ func TestDiscoveryManagerReconcile(t *testing.T) {
 	discover := func() ([]string, error) { return hosts, discoverErr }
 
 	s := newTestDiscoveryManager(discover)
+	ctx := context.Background()
 
 	t.Run("starts a job per discovered host", func(t *testing.T) {
-		s.reconcile()
+		s.reconcile(ctx)
 		got := runningKeys(s)
 		want := []string{"127.0.0.1", "127.0.0.2"}
 		if fmt.Sprint(got) != fmt.Sprint(want) {
@@ -88,7 +88,7 @@ func TestDiscoveryManagerReconcile(t *testing.T) {
 		vanished := s.running["127.0.0.1"]
 
 		hosts = []string{"127.0.0.2", "127.0.0.3"}
-		s.reconcile()
+		s.reconcile(ctx)
 
 		got := runningKeys(s)
 		want := []string{"127.0.0.2", "127.0.0.3"}
@@ -98,7 +98,7 @@ func TestDiscoveryManagerReconcile(t *testing.T) {
 		if s.running["127.0.0.2"] != survivor {
 			t.Error("surviving host job was restarted instead of kept")
 		}
-		if !isClosed(vanished) {
+		if !isStopped(vanished) {
 			t.Error("vanished host job was not stopped")
 		}
 	})
@@ -107,7 +107,7 @@ func TestDiscoveryManagerReconcile(t *testing.T) {
 		before := runningKeys(s)
 
 		discoverErr = fmt.Errorf("consul unreachable")
-		s.reconcile()
+		s.reconcile(ctx)
 		discoverErr = nil
 
 		if got := runningKeys(s); fmt.Sprint(got) != fmt.Sprint(before) {
@@ -119,7 +119,7 @@ func TestDiscoveryManagerReconcile(t *testing.T) {
 		before := runningKeys(s)
 
 		hosts = []string{}
-		s.reconcile()
+		s.reconcile(ctx)
 		hosts = []string{"127.0.0.2", "127.0.0.3"}
 
 		if got := runningKeys(s); fmt.Sprint(got) != fmt.Sprint(before) {
@@ -127,7 +127,304 @@ func TestDiscoveryManagerReconcile(t *testing.T) {
 		}
 	})
 
-	for _, ch := range s.running {
-		close(ch)
+	s.stopAll()
+	if len(s.running) != 0 {
+		t.Errorf("got %d running jobs after stopping all, expect 0", len(s.running))
+	}
+}
+
+func TestDiscoveryManagerDeletesVanishedMetrics(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name   string
+		prefix bool
+		grace  time.Duration
+		kept   bool
+	}{
+		{"with jobs named after their host", true, 0, false},
+		{"with grace period", true, time.Hour, true},
+		{"with jobs sharing their labels", false, 0, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hosts := []string{"127.0.0.1", "127.0.0.2"}
+			s := newTestDiscoveryManager(func() ([]string, error) { return hosts, nil })
+			s.config.PrefixNameWithHost = tc.prefix
+			s.grace = tc.grace
+			defer s.stopAll()
+
+			s.reconcile(context.Background())
+			vanished := s.running["127.0.0.1"]
+			labels := vanished.job.labels
+			s.metrics.jobs.With(labels).Add(1)
+
+			hosts = []string{"127.0.0.2"}
+			s.reconcile(context.Background())
+			// Retried once the in-flight measurement completed
+			<-vanished.done
+			s.cleanup()
+
+			discovered := testutil.ToFloat64(s.metrics.discovered.With(prometheus.Labels{"job_name": "discovery"}))
+			if discovered != 1 {
+				t.Errorf("got %v discovered jobs, expect 1", discovered)
+			}
+			kept := false
+			for _, l := range collectLabels(t, s.metrics.jobs) {
+				if l["job_name"] == labels["job_name"] {
+					kept = true
+				}
+			}
+			if kept != tc.kept {
+				t.Errorf("got metrics kept %v, expect %v", kept, tc.kept)
+			}
+		})
+	}
+}
+
+func TestDiscoveryManagerRestartsChangedLabels(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	zone := "a"
+	s := newTestDiscoveryManager(nil)
+	s.config.HostsDiscovery.Labels = map[string]string{"az": "__meta_az"}
+	config := defaultConfig()
+	config.Jobs = []JobConfig{s.config}
+	s.metrics = NewMetrics(prometheus.NewRegistry(), config)
+	s.discover = func() ([]discover.Target, error) {
+		return []discover.Target{{Host: "127.0.0.1", Labels: map[string]string{"__meta_az": zone}}}, nil
+	}
+	defer s.stopAll()
+
+	s.reconcile(context.Background())
+	before := s.running["127.0.0.1"]
+
+	t.Run("keeps the job when its labels are unchanged", func(t *testing.T) {
+		s.reconcile(context.Background())
+		if s.running["127.0.0.1"] != before {
+			t.Error("job restarted while its labels are unchanged")
+		}
+	})
+
+	t.Run("restarts the job when its labels changed", func(t *testing.T) {
+		zone = "b"
+		s.reconcile(context.Background())
+
+		after := s.running["127.0.0.1"]
+		if after == before {
+			t.Fatal("job kept while its labels changed")
+		}
+		if got := after.job.labels["az"]; got != "b" {
+			t.Errorf("got %s, expect b", got)
+		}
+		if !isStopped(before) {
+			t.Error("job with the former labels was not stopped")
+		}
+		if len(s.stale) != 1 || s.stale[0].runningJob != before {
+			t.Error("job with the former labels not kept until its metrics are deleted")
+		}
+	})
+}
+
+func TestDiscoveryManagerCleanupSkipsInFlight(t *testing.T) {
+	s := newTestDiscoveryManager(func() ([]string, error) { return nil, nil })
+	labels := prometheus.Labels{"job_name": "127.0.0.1"}
+	s.metrics.jobs.With(labels).Add(1)
+	r := &runningJob{job: &Job{labels: labels}, cancel: func() {}, done: make(chan struct{})}
+	s.stale = []*staleJob{{runningJob: r, host: "127.0.0.1"}}
+
+	cleaned := make(chan struct{})
+	go func() {
+		s.cleanup()
+		close(cleaned)
+	}()
+	select {
+	case <-cleaned:
+	case <-time.After(time.Second):
+		t.Fatal("cleanup blocked on an in-flight measurement")
+	}
+	if len(s.stale) != 1 {
+		t.Error("in-flight stale job removed before its measurement completed")
+	}
+
+	close(r.done)
+	s.cleanup()
+	if len(s.stale) != 0 {
+		t.Error("stale job kept after its measurement completed")
+	}
+	if got := testutil.CollectAndCount(s.metrics.jobs); got != 0 {
+		t.Errorf("got %d series, expect 0", got)
+	}
+}
+
+func TestDiscoveryManagerStopAllDeletesMetrics(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	hosts := []string{"127.0.0.1", "127.0.0.2"}
+	s := newTestDiscoveryManager(func() ([]string, error) { return hosts, nil })
+	s.config.PrefixNameWithHost = true
+	s.grace = time.Hour
+
+	s.reconcile(context.Background())
+	for _, r := range s.running {
+		s.metrics.jobs.With(r.job.labels).Add(1)
+	}
+	hosts = []string{"127.0.0.2"}
+	s.reconcile(context.Background())
+	if len(s.stale) != 1 {
+		t.Fatalf("got %d stale jobs, expect 1", len(s.stale))
+	}
+
+	s.stopAll()
+	if len(s.stale) != 0 {
+		t.Errorf("got %d stale jobs after stopping all, expect 0", len(s.stale))
+	}
+	if got := testutil.CollectAndCount(s.metrics.jobs); got != 0 {
+		t.Errorf("got %d jobs series after stopping all, expect 0", got)
+	}
+	if got := testutil.CollectAndCount(s.metrics.discovered); got != 0 {
+		t.Errorf("got %d discovered series after stopping all, expect 0", got)
+	}
+}
+
+// collectLabels returns the label set of every series of a collector
+func collectLabels(t *testing.T, c prometheus.Collector) []map[string]string {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("could not gather metrics: %v", err)
+	}
+
+	var labels []map[string]string
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			l := map[string]string{}
+			for _, pair := range m.GetLabel() {
+				l[pair.GetName()] = pair.GetValue()
+			}
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+func TestDiscoveryManagerWatch(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	s := newTestDiscoveryManager(func() ([]string, error) {
+		return nil, fmt.Errorf("polled instead of watched")
+	})
+	s.interval = time.Millisecond
+	s.watch = func(ctx context.Context, updates chan<- []discover.Target) error {
+		for _, hosts := range [][]string{{"127.0.0.1"}, {"127.0.0.1", "127.0.0.2"}} {
+			select {
+			case updates <- discover.Targets(hosts):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		<-ctx.Done()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	discovered := s.metrics.discovered.With(prometheus.Labels{"job_name": "discovery"})
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(discovered) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(discovered); got != 2 {
+		t.Errorf("got %v discovered jobs, expect 2", got)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestDiscoveryManagerWatchDeletesVanishedMetrics(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	s := newTestDiscoveryManager(nil)
+	s.config.PrefixNameWithHost = true
+	s.grace = 10 * time.Millisecond
+	vanished := make(chan struct{})
+	s.watch = func(ctx context.Context, updates chan<- []discover.Target) error {
+		updates <- discover.Targets([]string{"127.0.0.1", "127.0.0.2"})
+		select {
+		case <-vanished:
+		case <-ctx.Done():
+			return nil
+		}
+		// No further update arrives once the host vanished
+		updates <- discover.Targets([]string{"127.0.0.2"})
+		<-ctx.Done()
+		return nil
+	}
+
+	exported := func(host string) bool {
+		for _, l := range collectLabels(t, s.metrics.jobs) {
+			if strings.Contains(l["job_name"], host) {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor := func(cond func() bool) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return cond()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	if !waitFor(func() bool { return exported("127.0.0.1") }) {
+		t.Fatal("job of the discovered host not exported")
+	}
+	close(vanished)
+	if !waitFor(func() bool { return !exported("127.0.0.1") }) {
+		t.Error("metrics of the vanished host still exported without further update")
+	}
+	if !exported("127.0.0.2") {
+		t.Error("metrics of the remaining host deleted")
+	}
+
+	cancel()
+	<-done
+}
+
+func TestDiscoveryManagerNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      func() time.Duration
+		expected time.Duration
+	}{
+		{"without ttl", nil, time.Minute},
+		{"with ttl", func() time.Duration { return 30 * time.Second }, 30 * time.Second},
+		{"with unknown ttl", func() time.Duration { return 0 }, time.Minute},
+		{"with low ttl", func() time.Duration { return time.Millisecond }, time.Second},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &DiscoveryManager{interval: time.Minute, ttl: tc.ttl}
+			if got := s.next(); got != tc.expected {
+				t.Errorf("got %v, expect %v", got, tc.expected)
+			}
+		})
 	}
 }
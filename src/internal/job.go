@@ -1,9 +1,12 @@
 package internal
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
 	"log/slog"
 	"net"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -15,21 +18,36 @@ import (
 )
 
 const (
-	JOB_INTERVAL          = 1
-	DISCOVERY_INTERVAL    = 60
-	JOB_NAME_SEPARATOR    = "/"
-	JOB_TYPE_CLICKHOUSE   = "clickhouse"
-	JOB_TYPE_ETCD         = "etcd"
-	JOB_TYPE_MONGODB      = "mongodb"
-	JOB_TYPE_MYSQL        = "mysql"
-	JOB_TYPE_POSTGRESQL   = "postgresql"
-	JOB_TYPE_VALKEY       = "valkey"
-	QUERY_TYPE_CONNECT    = "connect"
-	QUERY_TYPE_READ       = "read"
-	QUERY_TYPE_WRITE      = "write"
-	QUERY_TYPE_READ_WRITE = "read_write"
-	QUERY_TYPE_DISCONNECT = "disconnect"
-	DISCOVER_TYPE_CONSUL  = "consul"
+	JOB_INTERVAL               = 1
+	DISCOVERY_INTERVAL         = 60
+	DISCOVERY_MIN_INTERVAL     = 1
+	DISCOVERY_CLEANUP_RETRY    = 1
+	SHUTDOWN_TIMEOUT           = 10
+	JOB_NAME_SEPARATOR         = "/"
+	JOB_TYPE_CASSANDRA         = "cassandra"
+	JOB_TYPE_CLICKHOUSE        = "clickhouse"
+	JOB_TYPE_ETCD              = "etcd"
+	JOB_TYPE_KAFKA             = "kafka"
+	JOB_TYPE_MEMCACHED         = "memcached"
+	JOB_TYPE_MONGODB           = "mongodb"
+	JOB_TYPE_MYSQL             = "mysql"
+	JOB_TYPE_OPENSEARCH        = "opensearch"
+	JOB_TYPE_POSTGRESQL        = "postgresql"
+	JOB_TYPE_RABBITMQ          = "rabbitmq"
+	JOB_TYPE_VALKEY            = "valkey"
+	QUERY_TYPE_CONNECT         = "connect"
+	QUERY_TYPE_READ            = "read"
+	QUERY_TYPE_WRITE           = "write"
+	QUERY_TYPE_READ_WRITE      = "read_write"
+	QUERY_TYPE_REPLICATION     = "replication"
+	QUERY_TYPE_DISCONNECT      = "disconnect"
+	CONNECTION_MODE_CYCLE      = "cycle"
+	CONNECTION_MODE_PERSISTENT = "persistent"
+	DISCOVER_TYPE_CONSUL       = "consul"
+	DISCOVER_TYPE_DNS_SRV      = "dns_srv"
+	DISCOVER_TYPE_FILE         = "file"
+	DISCOVER_TYPE_HTTP         = "http"
+	DISCOVER_TYPE_KUBERNETES   = "kubernetes"
 )
 
 type Job struct {
@@ -38,19 +56,28 @@ type Job struct {
 	labels      prometheus.Labels
 	queryLabels QueryLabelsConfig
 	driver      driver.Driver
+	replicas    []*replica
 	discover    *discover.Discover
 	logger      *slog.Logger
 	start       time.Time
+
+	// Token written by the previous read_write measurement, checked by the
+	// next read
+	lastToken string
+
+	// Whether the driver is connected by a previous measurement, kept in the
+	// persistent connection mode
+	connected bool
 }
 
 // Create multiple jobs
 func NewJobs(config JobConfig, metrics *Metrics, queryLabels QueryLabelsConfig, jobLabelName string) (jobs []*Job, err error) {
-	hosts, err := ResolveHosts(config)
+	targets, err := ResolveTargets(config)
 	if err != nil {
 		return nil, err
 	}
 
-	jobMap, err := BuildJobs(config, hosts, metrics, queryLabels, jobLabelName)
+	jobMap, err := BuildJobs(config, targets, metrics, queryLabels, jobLabelName)
 	if err != nil {
 		return nil, err
 	}
@@ -62,50 +89,69 @@ func NewJobs(config JobConfig, metrics *Metrics, queryLabels QueryLabelsConfig,
 	return jobs, nil
 }
 
-// Resolve the list of hosts a job targets, querying discovery when configured
-func ResolveHosts(config JobConfig) (hosts []string, err error) {
+// Resolve the list of targets a job measures, querying discovery when configured
+func ResolveTargets(config JobConfig) (targets []discover.Target, err error) {
 	switch {
 	case config.Host != "":
-		return []string{config.Host}, nil
+		return discover.Targets([]string{config.Host}), nil
 	case len(config.Hosts) > 0:
-		return config.Hosts, nil
+		return discover.Targets(config.Hosts), nil
 	case config.HostsDiscovery.Type != "":
-		hosts, err = DiscoverHosts(config.HostsDiscovery)
+		targets, err = DiscoverTargets(config.HostsDiscovery)
+		if err != nil {
+			return nil, err
+		}
+		relabels, err := newRelabels(config.HostsDiscovery)
 		if err != nil {
 			return nil, err
 		}
-		if len(hosts) == 0 {
+		targets = discover.ApplyRelabel(targets, relabels)
+		if len(targets) == 0 {
 			return nil, fmt.Errorf("0 host found by discovery")
 		}
-		return hosts, nil
+		return targets, nil
 	case config.DSN == "":
 		return nil, fmt.Errorf("host, hosts, hosts_discovery or dsn required for job %s", config.Name)
 	}
 	return nil, nil
 }
 
-// Build the jobs targeting the given hosts, keyed by a stable identity so a
-// discovery manager can reconcile a running set against a freshly discovered one
-func BuildJobs(config JobConfig, hosts []string, metrics *Metrics, queryLabels QueryLabelsConfig, jobLabelName string) (map[string]*Job, error) {
+// Build the jobs measuring the given targets, keyed by a stable identity so a
+// discovery manager can reconcile a running set against a freshly discovered
+// one. With a job per host, the labels of each target selected by the labels of
+// the discovery or set by its relabeling steps are added to the labels of its
+// job.
+func BuildJobs(config JobConfig, targets []discover.Target, metrics *Metrics, queryLabels QueryLabelsConfig, jobLabelName string) (map[string]*Job, error) {
 	jobs := map[string]*Job{}
 
-	if config.JobPerHost && len(hosts) > 0 {
-		for _, h := range hosts {
-			// Save original name because it could be changed by the prefix
+	// Memcached hosts are independent caches, so each one is measured by its
+	// own job named after it
+	if config.Type == JOB_TYPE_MEMCACHED && (len(targets) > 1 || config.HostsDiscovery.Type != "") {
+		config.JobPerHost = true
+		config.PrefixNameWithHost = true
+	}
+
+	if config.JobPerHost && len(targets) > 0 {
+		for _, t := range targets {
+			// Save original name and labels because they could be changed
 			name := config.Name
-			config.Hosts = []string{h}
+			labels := config.Labels
+			config.Hosts = []string{t.Host}
 			config.Name = AddHostPrefix(config)
+			config.Labels = targetLabels(labels, config.HostsDiscovery.Labels, t.Labels, metrics.labelNames)
 			j, err := NewJob(config, metrics, queryLabels, jobLabelName)
 			if err != nil {
 				return nil, err
 			}
-			jobs[h] = j
-			// Restore original name
+			jobs[t.Host] = j
+			// Restore original name and labels
 			config.Name = name
+			config.Labels = labels
 		}
 		return jobs, nil
 	}
 
+	hosts := discover.Hosts(targets)
 	config.Hosts = hosts
 	config.Name = AddHostPrefix(config)
 	j, err := NewJob(config, metrics, queryLabels, jobLabelName)
@@ -116,6 +162,28 @@ func BuildJobs(config JobConfig, hosts []string, metrics *Metrics, queryLabels Q
 	return jobs, nil
 }
 
+// Merge the labels of a target into the labels of a job. Only the labels
+// registered on the metrics are kept, metadata labels prefixed with __ are
+// not unless selected by the discovery, and the labels of the job take
+// precedence.
+func targetLabels(labels map[string]string, discovery map[string]string, target map[string]string, names []string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range target {
+		if !strings.HasPrefix(k, "__") && slices.Contains(names, k) {
+			merged[k] = v
+		}
+	}
+	for name, meta := range discovery {
+		if v, ok := target[meta]; ok {
+			merged[name] = v
+		}
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return merged
+}
+
 // Stable key for a set of hosts, independent of discovery ordering
 func hostsKey(hosts []string) string {
 	sorted := append([]string{}, hosts...)
@@ -136,9 +204,16 @@ func AddHostPrefix(config JobConfig) string {
 func NewJob(config JobConfig, metrics *Metrics, queryLabels QueryLabelsConfig, jobLabelName string) (j *Job, err error) {
 	logger := slog.With("job", config.Name)
 
+	// Every label registered on the metrics must be set, even when empty
 	l := prometheus.Labels{}
-
+	for _, name := range metrics.labelNames {
+		l[name] = ""
+	}
 	for k, v := range config.Labels {
+		if _, ok := l[k]; !ok {
+			logger.Warn("ignoring label missing from the metrics, a restart is required to add it", slog.String("label", k))
+			continue
+		}
 		l[k] = v
 	}
 	if jobLabelName == "" {
@@ -150,54 +225,168 @@ func NewJob(config JobConfig, metrics *Metrics, queryLabels QueryLabelsConfig, j
 		if config.Scheme == "mongodb+srv" {
 			slog.Warn("skipping cache_hostnames for mongodb+srv scheme")
 		} else {
-			hosts := []string{}
-			for _, host := range config.Hosts {
-				if net.ParseIP(host) == nil {
-					slog.Debug("resolving hostname", slog.Any("host", host))
-					resolvedHosts, err := net.LookupIP(host)
-					if err != nil {
-						return nil, err
-					}
-					for _, resolvedHost := range resolvedHosts {
-						slog.Debug("resolved host", slog.Any("host", host), slog.Any("resolved", resolvedHost))
-						hosts = append(hosts, resolvedHost.String())
-					}
-				}
+			hosts, err := resolveHosts(config.Hosts)
+			if err != nil {
+				return nil, err
 			}
 			config.Hosts = hosts
 		}
 	}
 
-	var d driver.Driver
+	var replicas []*replica
+	if config.QueryType == QUERY_TYPE_REPLICATION {
+		config, replicas, err = newReplicas(config, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := newDriver(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Interval == 0 {
+		config.Interval = JOB_INTERVAL
+	}
+
+	return &Job{
+		config:      config,
+		driver:      d,
+		replicas:    replicas,
+		metrics:     metrics,
+		labels:      l,
+		queryLabels: queryLabels,
+		logger:      logger,
+	}, nil
+}
+
+// resolveHosts replaces hostnames by their addresses, keeping the port of
+// hosts discovered with one, such as Consul services. IP addresses are kept
+// as is.
+func resolveHosts(hosts []string) ([]string, error) {
+	resolved := []string{}
+	for _, host := range hosts {
+		name, port, err := net.SplitHostPort(host)
+		if err != nil {
+			name, port = host, ""
+		}
+		if net.ParseIP(name) != nil {
+			resolved = append(resolved, host)
+			continue
+		}
+		slog.Debug("resolving hostname", slog.Any("host", name))
+		addrs, err := net.LookupIP(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			slog.Debug("resolved host", slog.Any("host", name), slog.Any("resolved", addr))
+			if port != "" {
+				resolved = append(resolved, net.JoinHostPort(addr.String(), port))
+			} else {
+				resolved = append(resolved, addr.String())
+			}
+		}
+	}
+	return resolved, nil
+}
+
+// Create the driver performing the queries of a job
+func newDriver(config JobConfig, logger *slog.Logger) (d driver.Driver, err error) {
+	assertions, err := newAssertions(config)
+	if err != nil {
+		return nil, err
+	}
 
 	switch config.Type {
+	case JOB_TYPE_CASSANDRA:
+		d, err = driver.NewCassandra(driver.CassandraOpts{
+			Hosts:            config.Hosts,
+			Port:             config.Port,
+			Username:         config.Username,
+			Password:         config.Password,
+			Timeout:          config.Timeout,
+			Keyspace:         config.Keyspace,
+			Table:            config.Table,
+			Create:           config.Create,
+			ReadConsistency:  config.ReadConsistency,
+			WriteConsistency: config.WriteConsistency,
+			Datacenter:       config.Datacenter,
+			TLS:              config.TLS,
+			SkipVerify:       config.SkipVerify,
+			Logger:           logger,
+		})
+		if err != nil {
+			return nil, err
+		}
 	case JOB_TYPE_CLICKHOUSE:
 		d, err = driver.NewClickhouse(driver.ClickhousebOpts{
-			DSN:        config.DSN,
+			DSN:         config.DSN,
+			Hosts:       config.Hosts,
+			Port:        config.Port,
+			Username:    config.Username,
+			Password:    config.Password,
+			Timeout:     config.Timeout,
+			Database:    config.Database,
+			Table:       config.Table,
+			Create:      config.Create,
+			Cluster:     config.Cluster,
+			Secure:      config.Secure,
+			SkipVerify:  config.SkipVerify,
+			ReadQuery:   config.ReadQuery,
+			ReadParams:  config.ReadParams,
+			WriteQuery:  config.WriteQuery,
+			WriteParams: config.WriteParams,
+			Assertions:  assertions,
+			Logger:      logger,
+		})
+		if err != nil {
+			return nil, err
+		}
+	case JOB_TYPE_ETCD:
+		d, err = driver.NewEtcd(driver.EtcdOpts{
 			Hosts:      config.Hosts,
 			Port:       config.Port,
 			Username:   config.Username,
 			Password:   config.Password,
 			Timeout:    config.Timeout,
-			Database:   config.Database,
-			Table:      config.Table,
+			Key:        config.Key,
 			Create:     config.Create,
-			Cluster:    config.Cluster,
-			Secure:     config.Secure,
+			TLS:        config.TLS,
 			SkipVerify: config.SkipVerify,
 			Logger:     logger,
 		})
 		if err != nil {
 			return nil, err
 		}
-	case JOB_TYPE_ETCD:
-		d, err = driver.NewEtcd(driver.EtcdOpts{
+	case JOB_TYPE_KAFKA:
+		d, err = driver.NewKafka(driver.KafkaOpts{
+			Hosts:             config.Hosts,
+			Port:              config.Port,
+			Username:          config.Username,
+			Password:          config.Password,
+			Mechanism:         config.AuthMechanism,
+			Timeout:           config.Timeout,
+			Topic:             config.Topic,
+			Partition:         config.Partition,
+			Acks:              config.Acks,
+			Create:            config.Create,
+			ReplicationFactor: config.ReplicationFactor,
+			TLS:               config.TLS,
+			SkipVerify:        config.SkipVerify,
+			Logger:            logger,
+		})
+		if err != nil {
+			return nil, err
+		}
+	case JOB_TYPE_MEMCACHED:
+		d, err = driver.NewMemcached(driver.MemcachedOpts{
 			Hosts:      config.Hosts,
 			Port:       config.Port,
-			Username:   config.Username,
-			Password:   config.Password,
 			Timeout:    config.Timeout,
 			Key:        config.Key,
+			TTL:        config.TTL,
 			Create:     config.Create,
 			TLS:        config.TLS,
 			SkipVerify: config.SkipVerify,
@@ -222,6 +411,7 @@ func NewJob(config JobConfig, metrics *Metrics, queryLabels QueryLabelsConfig, j
 			Database:      config.Database,
 			Collection:    config.Collection,
 			Create:        config.Create,
+			Direct:        config.DirectConnection,
 			Logger:        logger,
 		})
 		if err != nil {
@@ -248,24 +438,73 @@ func NewJob(config JobConfig, metrics *Metrics, queryLabels QueryLabelsConfig, j
 			Table:                config.Table,
 			Create:               config.Create,
 			AllowNativePasswords: config.AllowNativePasswords,
+			ReadQuery:            config.ReadQuery,
+			ReadParams:           config.ReadParams,
+			WriteQuery:           config.WriteQuery,
+			WriteParams:          config.WriteParams,
+			Assertions:           assertions,
 			Logger:               logger,
 		})
 		if err != nil {
 			return nil, err
 		}
+	case JOB_TYPE_OPENSEARCH:
+		d, err = driver.NewOpensearch(driver.OpensearchOpts{
+			Hosts:      config.Hosts,
+			Port:       config.Port,
+			Username:   config.Username,
+			Password:   config.Password,
+			APIKey:     config.APIKey,
+			Timeout:    config.Timeout,
+			Index:      config.Index,
+			Create:     config.Create,
+			Shards:     config.Shards,
+			Replicas:   config.Replicas,
+			Search:     config.Search,
+			TLS:        config.TLS,
+			SkipVerify: config.SkipVerify,
+			Logger:     logger,
+		})
+		if err != nil {
+			return nil, err
+		}
 	case JOB_TYPE_POSTGRESQL:
 		d, err = driver.NewPostgresql(driver.PostgresqlOpts{
-			DSN:      config.DSN,
-			Hosts:    config.Hosts,
-			Port:     config.Port,
-			Username: config.Username,
-			Password: config.Password,
-			SSLMode:  config.SSLMode,
-			Timeout:  config.Timeout,
-			Database: config.Database,
-			Table:    config.Table,
-			Create:   config.Create,
-			Logger:   logger,
+			DSN:         config.DSN,
+			Hosts:       config.Hosts,
+			Port:        config.Port,
+			Username:    config.Username,
+			Password:    config.Password,
+			SSLMode:     config.SSLMode,
+			Timeout:     config.Timeout,
+			Database:    config.Database,
+			Table:       config.Table,
+			Create:      config.Create,
+			ReadQuery:   config.ReadQuery,
+			ReadParams:  config.ReadParams,
+			WriteQuery:  config.WriteQuery,
+			WriteParams: config.WriteParams,
+			Assertions:  assertions,
+			Logger:      logger,
+		})
+		if err != nil {
+			return nil, err
+		}
+	case JOB_TYPE_RABBITMQ:
+		d, err = driver.NewRabbitmq(driver.RabbitmqOpts{
+			Hosts:      config.Hosts,
+			Port:       config.Port,
+			Username:   config.Username,
+			Password:   config.Password,
+			Vhost:      config.Vhost,
+			Timeout:    config.Timeout,
+			Exchange:   config.Exchange,
+			Queue:      config.Queue,
+			RoutingKey: config.RoutingKey,
+			Create:     config.Create,
+			TLS:        config.TLS,
+			SkipVerify: config.SkipVerify,
+			Logger:     logger,
 		})
 		if err != nil {
 			return nil, err
@@ -299,23 +538,82 @@ func NewJob(config JobConfig, metrics *Metrics, queryLabels QueryLabelsConfig, j
 	default:
 		return nil, fmt.Errorf("unsupported job type %s", config.Type)
 	}
+	return d, nil
+}
 
-	if config.Interval == 0 {
-		config.Interval = JOB_INTERVAL
+// Create the assertions checking the result of the custom read query of a job
+func newAssertions(config JobConfig) (assertions []*driver.Assertion, err error) {
+	for _, ac := range config.Assertions {
+		a, err := driver.NewAssertion(driver.AssertionOpts{
+			Rows:        ac.Rows,
+			MinRows:     ac.MinRows,
+			Column:      ac.Column,
+			Equals:      ac.Equals,
+			GreaterThan: ac.GreaterThan,
+			MaxAge:      time.Duration(ac.MaxAge) * time.Second,
+		})
+		if err != nil {
+			return nil, err
+		}
+		assertions = append(assertions, a)
 	}
+	return assertions, nil
+}
 
-	return &Job{
-		config:      config,
-		driver:      d,
-		metrics:     metrics,
-		labels:      l,
-		queryLabels: queryLabels,
-		logger:      logger,
-	}, nil
+func DiscoverTargets(config DiscoveryConfig) (targets []discover.Target, err error) {
+	dh, err := newDiscover(config)
+	if err != nil {
+		return []discover.Target{}, err
+	}
+	if c, ok := dh.(discover.Closer); ok {
+		defer c.Close()
+	}
+
+	targets, err = dh.Discover()
+	if err != nil {
+		return []discover.Target{}, err
+	}
+	return targets, nil
+}
+
+// Compile the relabeling steps of a discovery configuration
+func newRelabels(config DiscoveryConfig) (relabels []*discover.Relabel, err error) {
+	for _, rc := range config.Relabel {
+		r, err := discover.NewRelabel(discover.RelabelOpts{
+			SourceLabels: rc.SourceLabels,
+			Separator:    rc.Separator,
+			TargetLabel:  rc.TargetLabel,
+			Regex:        rc.Regex,
+			Modulus:      rc.Modulus,
+			Replacement:  rc.Replacement,
+			Action:       rc.Action,
+		})
+		if err != nil {
+			return nil, err
+		}
+		relabels = append(relabels, r)
+	}
+	return relabels, nil
+}
+
+// Label names set by the relabeling steps of a discovery configuration, the
+// ones that are not metadata nor built from the regex groups, to register
+// them on the metrics
+func relabelLabelNames(config DiscoveryConfig) (names []string) {
+	for _, rc := range config.Relabel {
+		if rc.Action != "" && rc.Action != discover.RELABEL_ACTION_REPLACE && rc.Action != discover.RELABEL_ACTION_HASHMOD {
+			continue
+		}
+		if rc.TargetLabel == "" || strings.HasPrefix(rc.TargetLabel, "__") || strings.Contains(rc.TargetLabel, "$") {
+			continue
+		}
+		names = append(names, rc.TargetLabel)
+	}
+	return names
 }
 
-func DiscoverHosts(config DiscoveryConfig) (hosts []string, err error) {
-	var dh discover.Discover
+// Create the discovery provider of a discovery configuration
+func newDiscover(config DiscoveryConfig) (dh discover.Discover, err error) {
 	switch config.Type {
 	case DISCOVER_TYPE_CONSUL:
 		dh, err = discover.NewConsul(discover.ConsulOpts{
@@ -327,92 +625,285 @@ func DiscoverHosts(config DiscoveryConfig) (hosts []string, err error) {
 			NodeMeta:    config.NodeMeta,
 			ReturnMeta:  config.ReturnMeta,
 			ReturnMetas: config.ReturnMetas,
+			Service:     config.Service,
+			Tags:        config.Tags,
+			PassingOnly: config.PassingOnly,
 		})
 		if err != nil {
-			return []string{}, err
+			return nil, err
+		}
+	case DISCOVER_TYPE_DNS_SRV:
+		dh, err = discover.NewDNSSRV(discover.DNSSRVOpts{
+			Names:    config.Names,
+			Resolver: config.Resolver,
+			Resolve:  config.Resolve,
+		})
+		if err != nil {
+			return nil, err
+		}
+	case DISCOVER_TYPE_FILE:
+		dh, err = discover.NewFile(discover.FileOpts{
+			Files: config.Files,
+		})
+		if err != nil {
+			return nil, err
+		}
+	case DISCOVER_TYPE_HTTP:
+		dh, err = discover.NewHTTP(discover.HTTPOpts{
+			URL:         config.URL,
+			BearerToken: config.Token,
+			Username:    config.Username,
+			Password:    config.Password,
+			CAFile:      config.CAFile,
+			SkipVerify:  config.SkipVerify,
+		})
+		if err != nil {
+			return nil, err
+		}
+	case DISCOVER_TYPE_KUBERNETES:
+		dh, err = discover.NewKubernetes(discover.KubernetesOpts{
+			Kubeconfig:    config.Kubeconfig,
+			Role:          config.Role,
+			Namespaces:    config.Namespaces,
+			LabelSelector: config.LabelSelector,
+		})
+		if err != nil {
+			return nil, err
 		}
 	default:
-		return []string{}, fmt.Errorf("unsupported discovery type %s", config.Type)
-	}
-
-	hosts, err = dh.Discover()
-	if err != nil {
-		return []string{}, err
+		return nil, fmt.Errorf("unsupported discovery type %s", config.Type)
 	}
-	return hosts, nil
+	return dh, nil
 }
 
-func (j *Job) Measure() {
+// Measure performs a single connect, query and disconnect cycle, recording its
+// metrics, and returns the error that failed it if any
+func (j *Job) Measure(ctx context.Context) error {
 	j.logger.Debug("starting to measure")
 
-	j.StartMeasurement()
-	err := j.driver.Connect()
-	if err != nil {
-		j.IncrFailures()
-		j.logger.Warn("could not connect", slog.Any("error", err))
-		return
+	// In the persistent connection mode, the connection of the previous
+	// measurement is reused
+	if !j.connected {
+		j.StartMeasurement()
+		err := j.driver.Connect(ctx)
+		if err != nil {
+			j.IncrFailures(QUERY_TYPE_CONNECT, err)
+			j.logger.Warn("could not connect", slog.Any("error", err))
+			return err
+		}
+		j.EndMeasurement(QUERY_TYPE_CONNECT)
+		j.connected = true
 	}
-	j.EndMeasurement(QUERY_TYPE_CONNECT)
 
 	switch j.config.QueryType {
 	case QUERY_TYPE_READ:
 		j.StartMeasurement()
-		if err := j.driver.Read(); err != nil {
-			j.IncrFailures()
+		if err := j.driver.Read(ctx); err != nil {
+			j.IncrFailures(QUERY_TYPE_READ, err)
 			j.logger.Warn("could not read", slog.Any("error", err))
-			return
+			j.drop(ctx)
+			return err
 		}
 		j.EndMeasurement(QUERY_TYPE_READ)
 
 	case QUERY_TYPE_WRITE:
 		j.StartMeasurement()
-		if err := j.driver.Write(); err != nil {
-			j.IncrFailures()
+		if err := j.driver.Write(ctx); err != nil {
+			j.IncrFailures(QUERY_TYPE_WRITE, err)
 			j.logger.Warn("could not write", slog.Any("error", err))
-			return
+			j.drop(ctx)
+			return err
 		}
 		j.EndMeasurement(QUERY_TYPE_WRITE)
 
 	case QUERY_TYPE_READ_WRITE:
-		j.StartMeasurement()
-		if err := j.driver.Read(); err != nil {
-			j.IncrFailures()
-			j.logger.Warn("could not read", slog.Any("error", err))
-			return
+		// Queues deliver what was just produced, so the read follows the write
+		// and the age of the value read is the produce-to-consume latency
+		if _, ok := j.driver.(driver.Queued); ok {
+			if err := j.measureWriteToken(ctx); err != nil {
+				return err
+			}
+			if err := j.measureReadAndVerify(ctx); err != nil {
+				return err
+			}
+			break
+		}
+		if err := j.measureReadAndVerify(ctx); err != nil {
+			return err
+		}
+		if err := j.measureWriteToken(ctx); err != nil {
+			return err
 		}
-		j.EndMeasurement(QUERY_TYPE_READ)
 
-		j.StartMeasurement()
-		if err := j.driver.Write(); err != nil {
-			j.IncrFailures()
-			j.logger.Warn("could not write", slog.Any("error", err))
-			return
+	case QUERY_TYPE_REPLICATION:
+		if phase, err := j.measureReplication(ctx); err != nil {
+			j.IncrFailures(phase, err)
+			j.logger.Warn("could not measure replication", slog.Any("error", err))
+			j.drop(ctx)
+			return err
 		}
-		j.EndMeasurement(QUERY_TYPE_WRITE)
 
 	default:
-		j.IncrFailures()
-		j.driver.Disconnect()
-		return
+		// Rejected by NewConfig, not recorded as it is not a phase
+		j.drop(ctx)
+		return fmt.Errorf("invalid query type %s", j.config.QueryType)
 	}
 
+	if j.persistent() {
+		j.SetSuccess()
+		j.IncrJobs()
+		return nil
+	}
+
+	err := j.disconnect(ctx)
+	if err != nil {
+		return err
+	}
+	j.SetSuccess()
+	j.IncrJobs()
+	return nil
+}
+
+// Whether the connection is kept across measurements
+func (j *Job) persistent() bool {
+	return j.config.ConnectionMode == CONNECTION_MODE_PERSISTENT
+}
+
+// Drop the connection after a failure, so the next measurement connects again
+// instead of reusing a connection that may be broken
+func (j *Job) drop(ctx context.Context) {
+	j.connected = false
+	if err := j.driver.Disconnect(ctx); err != nil {
+		j.logger.Debug("could not disconnect", slog.Any("error", err))
+	}
+}
+
+// Close the connection kept by the persistent connection mode, along with the
+// ones of the replicas
+func (j *Job) Close(ctx context.Context) {
+	for _, r := range j.replicas {
+		if r.connected {
+			r.connected = false
+			if err := r.driver.Disconnect(ctx); err != nil {
+				j.logger.Warn("could not disconnect from replica", slog.String("replica", r.host), slog.Any("error", err))
+			}
+		}
+	}
+	if j.connected {
+		j.disconnect(ctx)
+	}
+}
+
+// Disconnect the driver, recording the duration of the disconnection
+func (j *Job) disconnect(ctx context.Context) error {
+	j.connected = false
 	j.StartMeasurement()
-	err = j.driver.Disconnect()
+	err := j.driver.Disconnect(ctx)
 	if err != nil {
 		j.logger.Warn("could not disconnect", slog.Any("error", err))
-		j.IncrFailures()
-		return
+		j.IncrFailures(QUERY_TYPE_DISCONNECT, err)
+		return err
 	}
 	j.EndMeasurement(QUERY_TYPE_DISCONNECT)
-	j.IncrJobs()
+	return nil
+}
+
+// Measure the read of a read_write measurement, dropping the connection on
+// failure
+func (j *Job) measureReadAndVerify(ctx context.Context) error {
+	j.StartMeasurement()
+	if err := j.readAndVerify(ctx); err != nil {
+		j.IncrFailures(QUERY_TYPE_READ, err)
+		j.logger.Warn("could not read", slog.Any("error", err))
+		j.drop(ctx)
+		return err
+	}
+	j.EndMeasurement(QUERY_TYPE_READ)
+	return nil
+}
+
+// Measure the write of a read_write measurement, dropping the connection on
+// failure
+func (j *Job) measureWriteToken(ctx context.Context) error {
+	j.StartMeasurement()
+	if err := j.writeToken(ctx); err != nil {
+		j.IncrFailures(QUERY_TYPE_WRITE, err)
+		j.logger.Warn("could not write", slog.Any("error", err))
+		j.drop(ctx)
+		return err
+	}
+	j.EndMeasurement(QUERY_TYPE_WRITE)
+	return nil
 }
 
-func (j *Job) IncrFailures() {
-	j.metrics.failures.With(j.labels).Add(1)
+// readAndVerify reads the canary value and, when the driver supports tokens,
+// checks it is the token written by the previous measurement. A stale or
+// mismatching value is not a failure but is counted apart, along with the age
+// of the value read.
+func (j *Job) readAndVerify(ctx context.Context) error {
+	d, ok := j.driver.(driver.Tokenized)
+	if !ok {
+		return j.driver.Read(ctx)
+	}
+
+	token, ts, err := d.ReadToken(ctx)
+	if err != nil {
+		return err
+	}
+	if !ts.IsZero() {
+		j.metrics.readAge.With(j.labels).Set(time.Since(ts).Seconds())
+	}
+	if j.lastToken != "" && token != j.lastToken {
+		j.metrics.mismatches.With(j.labels).Add(1)
+		j.logger.Warn("read value does not match the previous write", slog.String("expected", j.lastToken), slog.String("got", token))
+	}
+
+	j.logger.Debug("read", slog.String("token", token), slog.Time("ts", ts))
+	return nil
+}
+
+// writeToken writes a new token for the next measurement to verify, or the
+// canary value when the driver does not support tokens
+func (j *Job) writeToken(ctx context.Context) error {
+	d, ok := j.driver.(driver.Tokenized)
+	if !ok {
+		return j.driver.Write(ctx)
+	}
+
+	// A failed write may or may not have been applied, skip the next check
+	j.lastToken = ""
+	token := rand.Text()
+	if err := d.WriteToken(ctx, token); err != nil {
+		return err
+	}
+	j.lastToken = token
+	return nil
+}
+
+// IncrFailures counts a failed execution along with the phase it failed in and
+// the reason the driver gives for the error
+func (j *Job) IncrFailures(phase string, err error) {
+	labels := prometheus.Labels{}
+	for k, v := range j.labels {
+		labels[k] = v
+	}
+	labels[j.metrics.phaseLabelName] = phase
+	labels[j.metrics.reasonLabelName] = driver.Reason(j.driver, err)
+	j.metrics.failures.With(labels).Add(1)
+	j.metrics.up.With(j.labels).Set(0)
+	j.metrics.lastFailure.With(j.labels).SetToCurrentTime()
+	j.metrics.consecutive.With(j.labels).Inc()
 	j.IncrQueries()
 	j.IncrJobs()
 }
 
+// SetSuccess records a successful execution, resetting the consecutive failures
+func (j *Job) SetSuccess() {
+	j.metrics.up.With(j.labels).Set(1)
+	j.metrics.lastSuccess.With(j.labels).SetToCurrentTime()
+	j.metrics.consecutive.With(j.labels).Set(0)
+}
+
 func (j *Job) IncrQueries() {
 	j.metrics.queries.With(j.labels).Add(1)
 }
@@ -454,30 +945,58 @@ func (j *Job) EndMeasurement(queryType string) {
 	j.IncrQueries()
 }
 
-// Run measures on the job interval until stop is closed. A nil stop channel
-// runs for the lifetime of the process.
-func (j *Job) Run(stop <-chan struct{}) {
-	j.loop(stop, time.Duration(j.config.Interval)*time.Second)
+// Run measures on the job interval until ctx is cancelled. A measurement
+// already in flight when ctx is cancelled is given the job timeout as a grace
+// period to complete, so connections are closed instead of abandoned
+// mid-query, and is interrupted past it.
+func (j *Job) Run(ctx context.Context) {
+	j.loop(ctx, time.Duration(j.config.Interval)*time.Second)
 }
 
 // The interval is a cooldown applied after each measurement completes, not a
 // fixed tick rate. A ticker would coalesce ticks that elapse during a slow
 // measurement and fire the next one immediately, reconnecting back to back and
 // storming a process-per-connection backend such as PostgreSQL.
-func (j *Job) loop(stop <-chan struct{}, interval time.Duration) {
+func (j *Job) loop(ctx context.Context, interval time.Duration) {
 	j.logger.Info("job started")
 
+	measureCtx, cancel := graceContext(ctx, j.grace())
+	defer cancel()
+
 	for {
-		j.Measure()
+		j.Measure(measureCtx)
 		j.logger.Info("measurement performed")
 
 		timer := time.NewTimer(interval)
 		select {
-		case <-stop:
+		case <-ctx.Done():
 			timer.Stop()
+			j.Close(measureCtx)
 			j.logger.Info("job stopped")
 			return
 		case <-timer.C:
 		}
 	}
 }
+
+// The grace period of the measurement in flight when a job is stopped
+func (j *Job) grace() time.Duration {
+	timeout := j.config.Timeout
+	if timeout == 0 {
+		timeout = driver.TIMEOUT
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// graceContext returns a context cancelled once grace has elapsed after ctx is
+// cancelled
+func graceContext(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(grace, cancel)
+	})
+	return graceCtx, func() {
+		stop()
+		cancel()
+	}
+}
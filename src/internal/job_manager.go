@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// JobManager runs the jobs of a configuration and keeps them in sync with it
+// when the configuration is reloaded. Jobs are reconciled by name: removed and
+// changed jobs are stopped and their metrics deleted, new and changed jobs are
+// started and unchanged jobs keep running with their counters.
+type JobManager struct {
+	mu      sync.RWMutex
+	config  *Config
+	metrics *Metrics
+	sharder *Sharder
+	running map[string]*managedJob
+	wg      sync.WaitGroup
+}
+
+// The jobs started for a single job configuration, either static jobs or a
+// discovery manager, with the means to stop them and to wait for their
+// in-flight measurements to complete
+type managedJob struct {
+	config JobConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+	// Static jobs, whose metrics are deleted once stopped. Discovery managers
+	// delete the metrics of their jobs themselves.
+	jobs []*Job
+}
+
+// NewJobManager returns a manager running the jobs of config. Discovered hosts
+// are split with the other instances by sharder, unless it is nil.
+func NewJobManager(config *Config, metrics *Metrics, sharder *Sharder) *JobManager {
+	return &JobManager{
+		config:  config,
+		metrics: metrics,
+		sharder: sharder,
+		running: map[string]*managedJob{},
+	}
+}
+
+// Reconcile aligns the running jobs with the given job configurations. Jobs to
+// stop are waited for before starting the new ones, so the old and new
+// instances of a changed job never measure at the same time. The jobs that
+// could not be started are returned as errors, and are started again by the
+// next reconciliation.
+func (m *JobManager) Reconcile(ctx context.Context, configs []JobConfig) error {
+	desired := map[string]JobConfig{}
+	for _, config := range configs {
+		desired[config.Name] = config
+	}
+
+	for name, r := range m.running {
+		if config, ok := desired[name]; ok && reflect.DeepEqual(config, r.config) {
+			continue
+		}
+		slog.Info("stopping job", slog.String("job", name))
+		m.stop(r)
+		delete(m.running, name)
+	}
+
+	var errs []error
+	for _, config := range configs {
+		if _, ok := m.running[config.Name]; ok {
+			continue
+		}
+		if err := m.start(ctx, config); err != nil {
+			slog.Error("could not create job", slog.Any("job", config.Name), slog.Any("error", err))
+			errs = append(errs, fmt.Errorf("job %s: %w", config.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *JobManager) start(ctx context.Context, config JobConfig) error {
+	slog.Info("starting job", slog.String("job", config.Name))
+
+	if config.HostsDiscovery.Type != "" {
+		ctx, cancel := context.WithCancel(ctx)
+		dm := NewDiscoveryManager(config, m.metrics, m.config.QueryLabels, m.config.JobLabelName, m.sharder)
+		done := make(chan struct{})
+		m.wg.Go(func() {
+			defer close(done)
+			dm.Run(ctx)
+		})
+		m.running[config.Name] = &managedJob{config: config, cancel: cancel, done: done}
+		return nil
+	}
+
+	jobs, err := NewJobs(config, m.metrics, m.config.QueryLabels, m.config.JobLabelName)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Go(func() { j.Run(ctx) })
+	}
+	done := make(chan struct{})
+	m.wg.Go(func() {
+		wg.Wait()
+		close(done)
+	})
+	m.running[config.Name] = &managedJob{config: config, cancel: cancel, done: done, jobs: jobs}
+	return nil
+}
+
+// stop cancels the jobs of a configuration, waits for their in-flight
+// measurements to complete, which would otherwise export them again, and
+// deletes their metrics
+func (m *JobManager) stop(r *managedJob) {
+	r.cancel()
+	<-r.done
+	for _, j := range r.jobs {
+		m.metrics.deleteJob(j.labels)
+	}
+}
+
+// Reload parses the configuration file again and reconciles the running jobs
+// with it. Only the jobs are reloaded, other settings require a restart. The
+// running jobs are left untouched when the file is invalid or adds labels,
+// which are not registered on the metrics until a restart. A configuration
+// without jobs stops every job. The reload is reported as failed when a job
+// could not be started.
+func (m *JobManager) Reload(ctx context.Context, file string) error {
+	config, err := NewConfig(file)
+	if err != nil {
+		m.metrics.reload.Set(0)
+		return err
+	}
+
+	// Metrics are registered with the label names known at startup
+	added := slices.DeleteFunc(labelNames(config), func(name string) bool {
+		return slices.Contains(m.metrics.labelNames, name)
+	})
+	if len(added) > 0 {
+		m.metrics.reload.Set(0)
+		return fmt.Errorf("labels %s are only registered by a restart", strings.Join(added, ", "))
+	}
+
+	reloaded := *m.config
+	reloaded.Jobs = config.Jobs
+	if !reflect.DeepEqual(reloaded, *config) {
+		slog.Warn("configuration changes outside of jobs are ignored until restart")
+	}
+
+	err = m.Reconcile(ctx, config.Jobs)
+
+	m.mu.Lock()
+	m.config = &reloaded
+	m.mu.Unlock()
+
+	if err != nil {
+		m.metrics.reload.Set(0)
+		return err
+	}
+	m.metrics.reload.Set(1)
+	m.metrics.reloadTs.SetToCurrentTime()
+	return nil
+}
+
+// Config returns the configuration the running jobs were started from
+func (m *JobManager) Config() *Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.config
+}
+
+// Wait blocks until every job started by the manager has returned
+func (m *JobManager) Wait() {
+	m.wg.Wait()
+}
@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testJobConfig(name string) JobConfig {
+	return JobConfig{
+		Name:      name,
+		Type:      JOB_TYPE_POSTGRESQL,
+		QueryType: QUERY_TYPE_READ,
+		Host:      "127.0.0.1",
+		Database:  "canary_db",
+		Table:     "canary_table",
+		Interval:  3600,
+		Timeout:   1,
+	}
+}
+
+func newTestJobManager() *JobManager {
+	return NewJobManager(&Config{
+		JobLabelName: "job_name",
+		QueryLabels:  QueryLabelsConfig{Name: "query"},
+	}, testMetrics(), nil)
+}
+
+func managedKeys(m *JobManager) []string {
+	keys := make([]string, 0, len(m.running))
+	for k := range m.running {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestJobManagerReconcile(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestJobManager()
+	m.Reconcile(ctx, []JobConfig{testJobConfig("a"), testJobConfig("b"), testJobConfig("c")})
+
+	if got, want := managedKeys(m), []string{"a", "b", "c"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, expect %v", got, want)
+	}
+
+	unchanged := m.running["a"]
+	changed := m.running["b"]
+
+	b := testJobConfig("b")
+	b.Interval = 1800
+	m.Reconcile(ctx, []JobConfig{testJobConfig("a"), b, testJobConfig("d")})
+
+	if got, want := managedKeys(m), []string{"a", "b", "d"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, expect %v", got, want)
+	}
+	if m.running["a"] != unchanged {
+		t.Error("unchanged job was restarted instead of kept")
+	}
+	if m.running["b"] == changed {
+		t.Error("changed job was kept instead of restarted")
+	}
+	if m.running["b"].config.Interval != 1800 {
+		t.Errorf("got interval %d for changed job, expect 1800", m.running["b"].config.Interval)
+	}
+
+	// Removed jobs are not exported anymore
+	m.Reconcile(ctx, []JobConfig{testJobConfig("a")})
+	if got := testutil.CollectAndCount(m.metrics.jobs); got > 1 {
+		t.Errorf("got %d jobs series, expect at most the one of a", got)
+	}
+
+	cancel()
+	m.Wait()
+}
+
+func TestJobManagerStop(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestJobManager()
+	if err := m.Reconcile(ctx, []JobConfig{testJobConfig("a")}); err != nil {
+		t.Fatalf("could not reconcile: %v", err)
+	}
+	r := m.running["a"]
+	labels := r.jobs[0].labels
+	r.jobs[0].metrics.jobs.With(labels).Inc()
+
+	if err := m.Reconcile(ctx, nil); err != nil {
+		t.Fatalf("could not reconcile: %v", err)
+	}
+	select {
+	case <-r.done:
+	default:
+		t.Error("removed job still running")
+	}
+	if got := m.metrics.jobs.DeletePartialMatch(labels); got != 0 {
+		t.Errorf("got %d series left for removed job, expect 0", got)
+	}
+
+	cancel()
+	m.Wait()
+}
+
+func TestJobManagerReload(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	file := filepath.Join(t.TempDir(), "canary-ng.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatalf("could not write configuration: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestJobManager()
+
+	t.Run("starts jobs from a valid configuration", func(t *testing.T) {
+		write(`
+jobs:
+  - name: a
+    type: postgresql
+    query_type: read
+    host: 127.0.0.1
+    table: canary_table
+    interval: 3600
+`)
+		if err := m.Reload(ctx, file); err != nil {
+			t.Fatalf("could not reload: %v", err)
+		}
+		if got := managedKeys(m); fmt.Sprint(got) != "[a]" {
+			t.Errorf("got %v, expect [a]", got)
+		}
+		if got := testutil.ToFloat64(m.metrics.reload); got != 1 {
+			t.Errorf("got reload status %v, expect 1", got)
+		}
+	})
+
+	t.Run("keeps running jobs on an invalid configuration", func(t *testing.T) {
+		write(`
+jobs:
+  - name: a
+    query_type: invalid
+`)
+		if err := m.Reload(ctx, file); err == nil {
+			t.Fatal("expected an error on invalid configuration")
+		}
+		if got := managedKeys(m); fmt.Sprint(got) != "[a]" {
+			t.Errorf("got %v, expect [a]", got)
+		}
+		if got := testutil.ToFloat64(m.metrics.reload); got != 0 {
+			t.Errorf("got reload status %v, expect 0", got)
+		}
+	})
+
+	t.Run("keeps running jobs on a configuration adding labels", func(t *testing.T) {
+		write(`
+jobs:
+  - name: a
+    type: postgresql
+    query_type: read
+    host: 127.0.0.1
+    table: canary_table
+    interval: 3600
+    labels:
+      role: primary
+`)
+		if err := m.Reload(ctx, file); err == nil {
+			t.Fatal("expected an error on a configuration adding labels")
+		}
+		if got := managedKeys(m); fmt.Sprint(got) != "[a]" {
+			t.Errorf("got %v, expect [a]", got)
+		}
+		if got := testutil.ToFloat64(m.metrics.reload); got != 0 {
+			t.Errorf("got reload status %v, expect 0", got)
+		}
+	})
+
+	t.Run("fails on a job that cannot be started", func(t *testing.T) {
+		write(`
+jobs:
+  - name: a
+    type: postgresql
+    query_type: read
+    host: 127.0.0.1
+    table: a.b.c
+    interval: 3600
+`)
+		if err := m.Reload(ctx, file); err == nil {
+			t.Fatal("expected an error on a job that cannot be started")
+		}
+		if got := testutil.ToFloat64(m.metrics.reload); got != 0 {
+			t.Errorf("got reload status %v, expect 0", got)
+		}
+	})
+
+	t.Run("stops every job on a configuration without jobs", func(t *testing.T) {
+		write(`
+jobs: []
+`)
+		if err := m.Reload(ctx, file); err != nil {
+			t.Fatalf("could not reload: %v", err)
+		}
+		if got := managedKeys(m); len(got) != 0 {
+			t.Errorf("got %v, expect no job", got)
+		}
+		if got := testutil.ToFloat64(m.metrics.reload); got != 1 {
+			t.Errorf("got reload status %v, expect 1", got)
+		}
+	})
+
+	cancel()
+	m.Wait()
+}
@@ -1,13 +1,22 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/ovh/canary-ng/discover"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 // slowDriver simulates a backend whose connect/query/disconnect cycle takes
@@ -20,7 +29,7 @@ type slowDriver struct {
 	ends   []time.Time
 }
 
-func (d *slowDriver) Connect() error {
+func (d *slowDriver) Connect(ctx context.Context) error {
 	d.mu.Lock()
 	d.starts = append(d.starts, time.Now())
 	d.mu.Unlock()
@@ -28,10 +37,10 @@ func (d *slowDriver) Connect() error {
 	return nil
 }
 
-func (d *slowDriver) Read() error  { return nil }
-func (d *slowDriver) Write() error { return nil }
+func (d *slowDriver) Read(ctx context.Context) error  { return nil }
+func (d *slowDriver) Write(ctx context.Context) error { return nil }
 
-func (d *slowDriver) Disconnect() error {
+func (d *slowDriver) Disconnect(ctx context.Context) error {
 	d.mu.Lock()
 	d.ends = append(d.ends, time.Now())
 	d.mu.Unlock()
@@ -66,15 +75,15 @@ func TestJobLoopKeepsIntervalCooldown(t *testing.T) {
 		logger:      slog.With("job", "test"),
 	}
 
-	stop := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
 	done := make(chan struct{})
 	go func() {
-		j.loop(stop, interval)
+		j.loop(ctx, interval)
 		close(done)
 	}()
 
 	time.Sleep(600 * time.Millisecond)
-	close(stop)
+	cancel()
 	<-done
 
 	gaps := driver.gaps()
@@ -89,3 +98,423 @@ func TestJobLoopKeepsIntervalCooldown(t *testing.T) {
 		}
 	}
 }
+
+func TestJobLoopDrainsInFlightMeasurement(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	driver := &slowDriver{work: 100 * time.Millisecond}
+
+	j := &Job{
+		config:      JobConfig{Name: "test", QueryType: QUERY_TYPE_READ},
+		driver:      driver,
+		metrics:     testMetrics(),
+		labels:      prometheus.Labels{"job_name": "test"},
+		queryLabels: QueryLabelsConfig{Name: "query"},
+		logger:      slog.With("job", "test"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		j.loop(ctx, time.Hour)
+		close(done)
+	}()
+
+	// Cancel while the first measurement is still connecting
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job did not stop after cancellation")
+	}
+
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	if len(driver.starts) != 1 || len(driver.ends) != 1 {
+		t.Errorf("got %d connect(s) and %d disconnect(s), expect the in-flight measurement to complete", len(driver.starts), len(driver.ends))
+	}
+}
+
+func TestGraceContext(t *testing.T) {
+	const grace = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	graceCtx, stop := graceContext(ctx, grace)
+	defer stop()
+
+	cancel()
+	cancelled := time.Now()
+	select {
+	case <-graceCtx.Done():
+		t.Fatal("grace context cancelled along with its parent")
+	case <-time.After(grace / 2):
+	}
+
+	// A measurement ignoring its timeouts is interrupted past the grace period
+	select {
+	case <-graceCtx.Done():
+		if elapsed := time.Since(cancelled); elapsed < grace {
+			t.Errorf("got cancelled after %v, expect at least %v", elapsed, grace)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("grace context not cancelled after the grace period")
+	}
+}
+
+func TestJobReadWriteVerification(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	store := &tokenStore{}
+	j := &Job{
+		config:      JobConfig{Name: "test", QueryType: QUERY_TYPE_READ_WRITE},
+		driver:      &replicatedDriver{store: store},
+		metrics:     testMetrics(),
+		labels:      prometheus.Labels{"job_name": "test"},
+		queryLabels: QueryLabelsConfig{Name: "query"},
+		logger:      slog.With("job", "test"),
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := j.Measure(context.Background()); err != nil {
+			t.Fatalf("could not measure: %v", err)
+		}
+	}
+	if got := testutil.ToFloat64(j.metrics.mismatches.With(j.labels)); got != 0 {
+		t.Errorf("got %v mismatches, expect 0", got)
+	}
+
+	// Simulate a failover to a node missing the last write
+	store.token = "stale"
+	if err := j.Measure(context.Background()); err != nil {
+		t.Fatalf("could not measure: %v", err)
+	}
+	if got := testutil.ToFloat64(j.metrics.mismatches.With(j.labels)); got != 1 {
+		t.Errorf("got %v mismatches, expect 1", got)
+	}
+	if got := testutil.CollectAndCount(j.metrics.failures); got != 0 {
+		t.Errorf("got %v failures, expect 0", got)
+	}
+}
+
+// queuedDriver records the order of the token reads and writes
+type queuedDriver struct {
+	replicatedDriver
+	ops []string
+}
+
+func (d *queuedDriver) WriteToken(ctx context.Context, token string) error {
+	d.ops = append(d.ops, QUERY_TYPE_WRITE)
+	return d.replicatedDriver.WriteToken(ctx, token)
+}
+
+func (d *queuedDriver) ReadToken(ctx context.Context) (string, time.Time, error) {
+	d.ops = append(d.ops, QUERY_TYPE_READ)
+	return d.replicatedDriver.ReadToken(ctx)
+}
+
+func (d *queuedDriver) Queued() {}
+
+func TestJobReadWriteQueued(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	d := &queuedDriver{replicatedDriver: replicatedDriver{store: &tokenStore{}}}
+	j := &Job{
+		config:      JobConfig{Name: "test", QueryType: QUERY_TYPE_READ_WRITE},
+		driver:      d,
+		metrics:     testMetrics(),
+		labels:      prometheus.Labels{"job_name": "test"},
+		queryLabels: QueryLabelsConfig{Name: "query"},
+		logger:      slog.With("job", "test"),
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := j.Measure(context.Background()); err != nil {
+			t.Fatalf("could not measure: %v", err)
+		}
+	}
+	expected := []string{QUERY_TYPE_WRITE, QUERY_TYPE_READ, QUERY_TYPE_WRITE, QUERY_TYPE_READ}
+	if !slices.Equal(d.ops, expected) {
+		t.Errorf("got %v, expect %v", d.ops, expected)
+	}
+	if got := testutil.ToFloat64(j.metrics.mismatches.With(j.labels)); got != 0 {
+		t.Errorf("got %v mismatches, expect 0", got)
+	}
+}
+
+// failingDriver fails reads with err, when set
+type failingDriver struct {
+	err error
+}
+
+func (d *failingDriver) Connect(ctx context.Context) error    { return nil }
+func (d *failingDriver) Read(ctx context.Context) error       { return d.err }
+func (d *failingDriver) Write(ctx context.Context) error      { return nil }
+func (d *failingDriver) Disconnect(ctx context.Context) error { return nil }
+
+func TestJobHealthMetrics(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	d := &failingDriver{}
+	j := &Job{
+		config:      JobConfig{Name: "test", QueryType: QUERY_TYPE_READ},
+		driver:      d,
+		metrics:     testMetrics(),
+		labels:      prometheus.Labels{"job_name": "test"},
+		queryLabels: QueryLabelsConfig{Name: "query"},
+		logger:      slog.With("job", "test"),
+	}
+
+	tests := []struct {
+		name        string
+		err         error
+		up          float64
+		consecutive float64
+	}{
+		{"with success", nil, 1, 0},
+		{"with first failure", errors.New("failed"), 0, 1},
+		{"with second failure", errors.New("failed"), 0, 2},
+		{"with recovery", nil, 1, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d.err = tc.err
+			j.Measure(context.Background())
+
+			if got := testutil.ToFloat64(j.metrics.up.With(j.labels)); got != tc.up {
+				t.Errorf("got up %v, expect %v", got, tc.up)
+			}
+			if got := testutil.ToFloat64(j.metrics.consecutive.With(j.labels)); got != tc.consecutive {
+				t.Errorf("got %v consecutive failures, expect %v", got, tc.consecutive)
+			}
+		})
+	}
+
+	if testutil.ToFloat64(j.metrics.lastSuccess.With(j.labels)) == 0 {
+		t.Error("last success timestamp not set")
+	}
+	if testutil.ToFloat64(j.metrics.lastFailure.With(j.labels)) == 0 {
+		t.Error("last failure timestamp not set")
+	}
+}
+
+func TestBuildJobsTargetLabels(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	job := testJobConfig("discovery")
+	job.JobPerHost = true
+	job.PrefixNameWithHost = true
+	job.Labels = map[string]string{"role": "primary"}
+	job.HostsDiscovery.Labels = map[string]string{"az": "az", "cluster": "__meta_consul_metadata_cluster", "dc": "__meta_consul_dc"}
+
+	config := defaultConfig()
+	config.Jobs = []JobConfig{job}
+	metrics := NewMetrics(prometheus.NewRegistry(), config)
+
+	targets := []discover.Target{
+		{Host: "192.168.0.1", Labels: map[string]string{"az": "a", "role": "replica", "rack": "1", "__meta_filepath": "targets.json"}},
+		{Host: "192.168.0.2"},
+		{Host: "192.168.0.3", Labels: map[string]string{"__meta_consul_metadata_cluster": "pg1", "__meta_consul_dc": "gra", "__meta_consul_node": "pg1-a"}},
+	}
+	jobs, err := BuildJobs(job, targets, metrics, config.QueryLabels, config.JobLabelName)
+	if err != nil {
+		t.Fatalf("could not build jobs: %v", err)
+	}
+
+	tests := []struct {
+		host     string
+		expected prometheus.Labels
+	}{
+		{"192.168.0.1", prometheus.Labels{"job_name": "192.168.0.1/discovery", "az": "a", "cluster": "", "dc": "", "role": "primary"}},
+		{"192.168.0.2", prometheus.Labels{"job_name": "192.168.0.2/discovery", "az": "", "cluster": "", "dc": "", "role": "primary"}},
+		{"192.168.0.3", prometheus.Labels{"job_name": "192.168.0.3/discovery", "az": "", "cluster": "pg1", "dc": "gra", "role": "primary"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.host, func(t *testing.T) {
+			got := jobs[tc.host].labels
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Errorf("got %v, expect %v", got, tc.expected)
+			}
+			// Metrics accept the labels of every job
+			jobs[tc.host].IncrJobs()
+		})
+	}
+}
+
+func TestBuildJobsMemcached(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name      string
+		hosts     []string
+		discovery string
+		expected  []string
+	}{
+		{"with a single host", []string{"192.168.0.1"}, "", []string{"memcached"}},
+		{"with hosts", []string{"192.168.0.1", "192.168.0.2"}, "", []string{"192.168.0.1/memcached", "192.168.0.2/memcached"}},
+		{"with discovery", []string{"192.168.0.1"}, DISCOVER_TYPE_CONSUL, []string{"192.168.0.1/memcached"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			job := JobConfig{Name: "memcached", Type: JOB_TYPE_MEMCACHED, QueryType: QUERY_TYPE_READ, Key: "canary_ng"}
+			job.HostsDiscovery.Type = tc.discovery
+			jobs, err := BuildJobs(job, discover.Targets(tc.hosts), testMetrics(), QueryLabelsConfig{Name: "query"}, "job_name")
+			if err != nil {
+				t.Fatalf("could not build jobs: %v", err)
+			}
+			var names []string
+			for _, j := range jobs {
+				names = append(names, j.config.Name)
+			}
+			slices.Sort(names)
+			if fmt.Sprint(names) != fmt.Sprint(tc.expected) {
+				t.Errorf("got %v, expect %v", names, tc.expected)
+			}
+		})
+	}
+}
+
+func TestResolveTargetsRelabel(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "targets.json")
+	groups := `[
+		{"targets": ["pg1-a:5432", "pg1-b:5432"], "labels": {"__meta_state": "active"}},
+		{"targets": ["pg2-a:5432"], "labels": {"__meta_state": "decommissioning"}}
+	]`
+	if err := os.WriteFile(file, []byte(groups), 0o600); err != nil {
+		t.Fatalf("could not write targets: %v", err)
+	}
+
+	job := testJobConfig("discovery")
+	job.Host = ""
+	job.HostsDiscovery = DiscoveryConfig{
+		Type:  DISCOVER_TYPE_FILE,
+		Files: []string{file},
+		Relabel: []RelabelConfig{
+			{Action: "drop", SourceLabels: []string{"__meta_state"}, Regex: "decommissioning"},
+			{SourceLabels: []string{"__address__"}, Regex: "(.+)-.:.+", TargetLabel: "cluster"},
+		},
+	}
+
+	targets, err := ResolveTargets(job)
+	if err != nil {
+		t.Fatalf("could not resolve targets: %v", err)
+	}
+	expected := "[{pg1-a:5432 map[__meta_filepath:" + file + " __meta_state:active cluster:pg1]} {pg1-b:5432 map[__meta_filepath:" + file + " __meta_state:active cluster:pg1]}]"
+	if fmt.Sprint(targets) != expected {
+		t.Errorf("got %v, expect %v", targets, expected)
+	}
+
+	// Labels set by relabeling are registered on the metrics
+	config := defaultConfig()
+	config.Jobs = []JobConfig{job}
+	if names := labelNames(config); !slices.Contains(names, "cluster") {
+		t.Errorf("got label names %v, expect them to contain cluster", names)
+	}
+}
+
+// Return the number of observations of a histogram
+func sampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("could not write metric: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// countingDriver counts connections and disconnections, and fails reads with
+// err when set
+type countingDriver struct {
+	failingDriver
+	connects    int
+	disconnects int
+}
+
+func (d *countingDriver) Connect(ctx context.Context) error {
+	d.connects++
+	return nil
+}
+
+func (d *countingDriver) Disconnect(ctx context.Context) error {
+	d.disconnects++
+	return nil
+}
+
+func TestJobConnectionMode(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name        string
+		mode        string
+		errs        []error
+		connects    int
+		disconnects int
+	}{
+		{"with connection per cycle", "", []error{nil, nil, nil}, 3, 3},
+		{"with connection per cycle and failure", CONNECTION_MODE_CYCLE, []error{nil, errors.New("failed"), nil}, 3, 3},
+		{"with persistent connection", CONNECTION_MODE_PERSISTENT, []error{nil, nil, nil}, 1, 0},
+		{"with persistent connection and failure", CONNECTION_MODE_PERSISTENT, []error{nil, errors.New("failed"), nil, nil}, 2, 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &countingDriver{}
+			j := &Job{
+				config:      JobConfig{Name: "test", QueryType: QUERY_TYPE_READ, ConnectionMode: tc.mode},
+				driver:      d,
+				metrics:     testMetrics(),
+				labels:      prometheus.Labels{"job_name": "test"},
+				queryLabels: QueryLabelsConfig{Name: "query", ConnectValue: "connect", ReadValue: "read", DisconnectValue: "disconnect"},
+				logger:      slog.With("job", "test"),
+			}
+
+			for _, err := range tc.errs {
+				d.err = err
+				j.Measure(context.Background())
+			}
+			if d.connects != tc.connects || d.disconnects != tc.disconnects {
+				t.Errorf("got %d connects and %d disconnects, expect %d and %d", d.connects, d.disconnects, tc.connects, tc.disconnects)
+			}
+
+			// Only actual connections are measured
+			if got := sampleCount(t, j.metrics.duration.With(prometheus.Labels{"job_name": "test", "query": "connect"})); got != uint64(tc.connects) {
+				t.Errorf("got %d connections measured, expect %d", got, tc.connects)
+			}
+
+			// The connection kept is closed when the job stops
+			j.Close(context.Background())
+			if d.connects != d.disconnects {
+				t.Errorf("got %d connects and %d disconnects after close, expect as many", d.connects, d.disconnects)
+			}
+		})
+	}
+}
+
+func TestResolveHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		hosts    []string
+		expected []string
+	}{
+		{"with ip address", []string{"192.168.0.1"}, []string{"192.168.0.1"}},
+		{"with ip address and port", []string{"192.168.0.1:5432"}, []string{"192.168.0.1:5432"}},
+		{"with ipv6 address and port", []string{"[::1]:5432"}, []string{"[::1]:5432"}},
+		{"with several addresses", []string{"192.168.0.1", "192.168.0.2:5432"}, []string{"192.168.0.1", "192.168.0.2:5432"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveHosts(tc.hosts)
+			if err != nil {
+				t.Fatalf("could not resolve hosts: %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Errorf("got %v, expect %v", got, tc.expected)
+			}
+		})
+	}
+}
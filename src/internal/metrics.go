@@ -1,18 +1,64 @@
 package internal
 
 import (
+	"maps"
+	"slices"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Metrics struct {
-	duration *prometheus.HistogramVec
-	failures *prometheus.CounterVec
-	jobs     *prometheus.CounterVec
-	queries  *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	failures    *prometheus.CounterVec
+	jobs        *prometheus.CounterVec
+	queries     *prometheus.CounterVec
+	mismatches  *prometheus.CounterVec
+	readAge     *prometheus.GaugeVec
+	replication *prometheus.HistogramVec
+	up          *prometheus.GaugeVec
+	lastSuccess *prometheus.GaugeVec
+	lastFailure *prometheus.GaugeVec
+	consecutive *prometheus.GaugeVec
+	discovered  *prometheus.GaugeVec
+	reload      prometheus.Gauge
+	reloadTs    prometheus.Gauge
+
+	// Names of the labels set on every job metric besides the job label
+	labelNames []string
+	// Name of the label identifying the replica in replication metrics
+	replicaLabelName string
+	// Names of the labels identifying the phase and reason of a failure
+	phaseLabelName  string
+	reasonLabelName string
 }
 
 func NewMetrics(reg prometheus.Registerer, config *Config) *Metrics {
-	labels := []string{config.JobLabelName}
+	m := newJobMetrics(reg, config)
+	m.reload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: config.ReloadSuccessMetric,
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+	m.reloadTs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: config.ReloadTimestampMetric,
+		Help: "Timestamp of the last successful configuration reload",
+	})
+	m.discovered = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: config.DiscoveredJobsMetric,
+		Help: "Number of jobs running for the hosts returned by discovery",
+	}, []string{config.JobLabelName})
+	reg.MustRegister(m.reload, m.reloadTs, m.discovered)
+
+	// The configuration loaded at startup counts as the first successful reload
+	m.reload.Set(1)
+	m.reloadTs.SetToCurrentTime()
+	return m
+}
+
+// newJobMetrics creates only the metrics updated by jobs, as exposed by a probe
+func newJobMetrics(reg prometheus.Registerer, config *Config) *Metrics {
+	names := labelNames(config)
+	// Clipped so the label names appended below never share the same array
+	labels := slices.Clip(append([]string{config.JobLabelName}, names...))
 	m := &Metrics{
 		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    config.DurationMetric,
@@ -22,7 +68,7 @@ func NewMetrics(reg prometheus.Registerer, config *Config) *Metrics {
 		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: config.FailuresMetric,
 			Help: "Number of execution that has failed",
-		}, labels),
+		}, append(labels, config.PhaseLabelName, config.ReasonLabelName)),
 		jobs: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: config.JobsMetric,
 			Help: "Total number of job executions including failures",
@@ -31,7 +77,72 @@ func NewMetrics(reg prometheus.Registerer, config *Config) *Metrics {
 			Name: config.QueriesMetric,
 			Help: "Total number of queries executions including failures",
 		}, labels),
+		mismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: config.MismatchesMetric,
+			Help: "Number of reads that did not return the token of the previous write",
+		}, labels),
+		readAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: config.ReadAgeMetric,
+			Help: "Age of the value returned by the last read",
+		}, labels),
+		replication: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    config.ReplicationMetric,
+			Help:    "Delay for a write on the primary to be visible on a replica",
+			Buckets: config.Buckets,
+		}, append(labels, config.ReplicaLabelName)),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: config.UpMetric,
+			Help: "Whether the last execution of the job was successful",
+		}, labels),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: config.LastSuccessMetric,
+			Help: "Timestamp of the last successful execution",
+		}, labels),
+		lastFailure: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: config.LastFailureMetric,
+			Help: "Timestamp of the last failed execution",
+		}, labels),
+		consecutive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: config.ConsecutiveFailuresMetric,
+			Help: "Number of failed executions since the last successful one",
+		}, labels),
+		labelNames:       names,
+		replicaLabelName: config.ReplicaLabelName,
+		phaseLabelName:   config.PhaseLabelName,
+		reasonLabelName:  config.ReasonLabelName,
 	}
-	reg.MustRegister(m.duration, m.failures, m.jobs, m.queries)
+	reg.MustRegister(m.duration, m.failures, m.jobs, m.queries, m.mismatches, m.readAge, m.replication,
+		m.up, m.lastSuccess, m.lastFailure, m.consecutive)
 	return m
 }
+
+// labelNames returns the names of the labels set on every job metric besides
+// the job label: the labels of the jobs and the ones selected or set by their
+// discovery. Metrics must be registered with all the label names they are set
+// with, so labels added by a reload are only registered by a restart.
+func labelNames(config *Config) []string {
+	names := map[string]bool{}
+	for _, job := range config.Jobs {
+		for name := range job.Labels {
+			names[name] = true
+		}
+		for name := range job.HostsDiscovery.Labels {
+			names[name] = true
+		}
+		for _, name := range relabelLabelNames(job.HostsDiscovery) {
+			names[name] = true
+		}
+	}
+	delete(names, config.JobLabelName)
+	return slices.Sorted(maps.Keys(names))
+}
+
+// deleteJob deletes every series of a job, whatever its other labels
+func (m *Metrics) deleteJob(labels prometheus.Labels) {
+	for _, vec := range []interface{ DeletePartialMatch(prometheus.Labels) int }{
+		m.duration, m.failures, m.jobs, m.queries, m.mismatches, m.readAge, m.replication,
+		m.up, m.lastSuccess, m.lastFailure, m.consecutive,
+	} {
+		vec.DeletePartialMatch(labels)
+	}
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ovh/canary-ng/discover"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	PROBE_SUCCESS_METRIC  = "canary_ng_probe_success"
+	PROBE_DURATION_METRIC = "canary_ng_probe_duration_seconds"
+)
+
+// ProbeHandler serves on-demand measurements following the multi-target pattern
+// of the Prometheus blackbox exporter. A request to ?module=<job>&target=<host>
+// runs a single measurement against the target, using the configured job named
+// after the module as a template, and responds with the resulting metrics.
+func ProbeHandler(manager *JobManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := manager.Config()
+
+		module := r.URL.Query().Get("module")
+		if module == "" {
+			http.Error(w, "module parameter is missing", http.StatusBadRequest)
+			return
+		}
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		var jobConfig *JobConfig
+		for i := range config.Jobs {
+			if config.Jobs[i].Name == module {
+				jobConfig = &config.Jobs[i]
+				break
+			}
+		}
+		if jobConfig == nil {
+			http.Error(w, fmt.Sprintf("unknown module %s", module), http.StatusBadRequest)
+			return
+		}
+
+		reg := prometheus.NewRegistry()
+		j, err := newProbeJob(*jobConfig, target, newJobMetrics(reg, config), config.QueryLabels, config.JobLabelName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		success := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: PROBE_SUCCESS_METRIC,
+			Help: "Whether the probe was successful",
+		})
+		duration := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: PROBE_DURATION_METRIC,
+			Help: "Duration of the probe in seconds",
+		})
+		reg.MustRegister(success, duration)
+
+		start := time.Now()
+		err = j.Measure(r.Context())
+		duration.Set(time.Since(start).Seconds())
+		if err == nil {
+			success.Set(1)
+		}
+		j.logger.Debug("probe performed", slog.String("target", target), slog.Any("error", err))
+
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// Build a job from a configured job, targeting the given host instead of the
+// configured hosts or discovery
+func newProbeJob(config JobConfig, target string, metrics *Metrics, queryLabels QueryLabelsConfig, jobLabelName string) (*Job, error) {
+	if config.DSN != "" {
+		return nil, fmt.Errorf("module %s uses a dsn and cannot be probed against a target", config.Name)
+	}
+
+	config.Host = ""
+	config.HostsDiscovery = DiscoveryConfig{}
+	config.JobPerHost = false
+	// A probe measures a whole cycle and does not outlive the request
+	config.ConnectionMode = CONNECTION_MODE_CYCLE
+
+	jobs, err := BuildJobs(config, discover.Targets([]string{target}), metrics, queryLabels, jobLabelName)
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range jobs {
+		return j, nil
+	}
+	return nil, fmt.Errorf("no job built for target %s", target)
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProbeHandler(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	job := testJobConfig("postgresql_ro")
+	dsnJob := testJobConfig("postgresql_dsn")
+	dsnJob.DSN = "postgres://127.0.0.1:1/canary_db"
+
+	config := defaultConfig()
+	config.Jobs = []JobConfig{job, dsnJob}
+	handler := ProbeHandler(NewJobManager(config, testMetrics(), nil))
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		body   []string
+	}{
+		{"without module", "target=127.0.0.1", http.StatusBadRequest, []string{"module parameter is missing"}},
+		{"without target", "module=postgresql_ro", http.StatusBadRequest, []string{"target parameter is missing"}},
+		{"with unknown module", "module=unknown&target=127.0.0.1", http.StatusBadRequest, []string{"unknown module unknown"}},
+		{"with dsn module", "module=postgresql_dsn&target=127.0.0.1", http.StatusBadRequest, []string{"uses a dsn"}},
+		{"with unreachable target", "module=postgresql_ro&target=127.0.0.1:1", http.StatusOK, []string{
+			"canary_ng_probe_success 0",
+			`canary_ng_failures{job_name="postgresql_ro",phase="connect",reason="connection"} 1`,
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe?"+tc.query, nil))
+
+			if rec.Code != tc.status {
+				t.Errorf("got status %d, expect %d", rec.Code, tc.status)
+			}
+			for _, want := range tc.body {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("got body %q, expect it to contain %q", rec.Body.String(), want)
+				}
+			}
+		})
+	}
+}
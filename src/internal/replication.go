@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ovh/canary-ng/driver"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	REPLICATION_POLL_INTERVAL = 10 * time.Millisecond
+)
+
+// A replica polled by a replication job until it returns the token written on
+// the primary
+type replica struct {
+	host   string
+	driver driver.Driver
+
+	// Whether the replica is connected by a previous measurement, kept in the
+	// persistent connection mode
+	connected bool
+}
+
+// Split the hosts of a replication job between the primary, where the token is
+// written, and the replicas. Replicas are taken from replica_hosts when defined,
+// otherwise the first host is the primary and the others are replicas.
+func newReplicas(config JobConfig, logger *slog.Logger) (JobConfig, []*replica, error) {
+	hosts := config.ReplicaHosts
+	if len(hosts) == 0 {
+		if len(config.Hosts) < 2 {
+			return config, nil, fmt.Errorf("replication query type requires replica_hosts or at least two hosts")
+		}
+		hosts = config.Hosts[1:]
+		config.Hosts = config.Hosts[:1]
+	}
+
+	replicas := make([]*replica, 0, len(hosts))
+	for _, host := range hosts {
+		// Replicas are reached directly, bypassing any primary routing the
+		// job configuration would otherwise apply
+		rc := config
+		rc.DSN = ""
+		rc.Host = ""
+		rc.Hosts = []string{host}
+		rc.Scheme = ""
+		rc.MasterSet = ""
+		rc.DirectConnection = true
+
+		d, err := newDriver(rc, logger.With("replica", host))
+		if err != nil {
+			return config, nil, err
+		}
+		// Queues deliver each message once, so replicas cannot poll the token
+		_, tokenized := d.(driver.Tokenized)
+		if _, queued := d.(driver.Queued); !tokenized || queued {
+			return config, nil, fmt.Errorf("replication query type is not supported by %s", config.Type)
+		}
+		replicas = append(replicas, &replica{host: host, driver: d})
+	}
+	return config, replicas, nil
+}
+
+// measureReplication writes a unique token on the primary and waits for each
+// replica to return it, recording the propagation delay per replica. Replicas
+// are connected before the write so the delay excludes their handshake. On
+// failure, the phase it failed in is returned along with the error.
+func (j *Job) measureReplication(ctx context.Context) (phase string, err error) {
+	var connected []*replica
+	var errs []error
+	for _, r := range j.replicas {
+		if !r.connected {
+			if err := r.driver.Connect(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("could not connect to replica %s: %w", r.host, err))
+				continue
+			}
+			r.connected = true
+		}
+		connected = append(connected, r)
+	}
+	// Replicas are disconnected unless their connection is kept, in which case
+	// only the ones that failed are
+	failed := map[*replica]bool{}
+	defer func() {
+		for _, r := range connected {
+			if j.persistent() && !failed[r] {
+				continue
+			}
+			r.connected = false
+			if err := r.driver.Disconnect(ctx); err != nil {
+				j.logger.Warn("could not disconnect from replica", slog.String("replica", r.host), slog.Any("error", err))
+			}
+		}
+	}()
+
+	token := rand.Text()
+
+	j.StartMeasurement()
+	if err := j.driver.(driver.Tokenized).WriteToken(ctx, token); err != nil {
+		return QUERY_TYPE_WRITE, err
+	}
+	j.EndMeasurement(QUERY_TYPE_WRITE)
+	written := time.Now()
+
+	// Replicas unreachable before the write take precedence over replicas
+	// not returning the token
+	phase = QUERY_TYPE_READ
+	if len(errs) > 0 {
+		phase = QUERY_TYPE_CONNECT
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, r := range connected {
+		wg.Go(func() {
+			if err := j.waitReplica(ctx, r, token, written); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				failed[r] = true
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	if err = errors.Join(errs...); err != nil {
+		return phase, err
+	}
+	return "", nil
+}
+
+// waitReplica polls a replica until it returns the token, within the job
+// timeout
+func (j *Job) waitReplica(ctx context.Context, r *replica, token string, written time.Time) error {
+	timeout := j.config.Timeout
+	if timeout == 0 {
+		timeout = driver.TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	labels := prometheus.Labels{}
+	for k, v := range j.labels {
+		labels[k] = v
+	}
+	labels[j.metrics.replicaLabelName] = r.host
+
+	var lastErr error
+	for {
+		value, _, err := r.driver.(driver.Tokenized).ReadToken(ctx)
+		if err == nil && value == token {
+			lag := time.Since(written)
+			j.metrics.replication.With(labels).Observe(lag.Seconds())
+			j.logger.Debug("token replicated", slog.String("replica", r.host), slog.Duration("lag", lag))
+			return nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("token not replicated to %s: %w", r.host, lastErr)
+			}
+			return fmt.Errorf("token not replicated to %s: %w", r.host, ctx.Err())
+		case <-time.After(REPLICATION_POLL_INTERVAL):
+		}
+	}
+}
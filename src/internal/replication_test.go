@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ovh/canary-ng/driver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// replicatedDriver stores tokens in memory. Tokens written on the primary are
+// shared with the replicas, which return them only after a number of reads to
+// simulate a replication delay.
+type replicatedDriver struct {
+	store *tokenStore
+	delay int
+	reads int
+}
+
+type tokenStore struct {
+	mu    sync.Mutex
+	token string
+}
+
+func (d *replicatedDriver) Connect(ctx context.Context) error    { return nil }
+func (d *replicatedDriver) Read(ctx context.Context) error       { return nil }
+func (d *replicatedDriver) Write(ctx context.Context) error      { return nil }
+func (d *replicatedDriver) Disconnect(ctx context.Context) error { return nil }
+
+func (d *replicatedDriver) WriteToken(ctx context.Context, token string) error {
+	d.store.mu.Lock()
+	defer d.store.mu.Unlock()
+	d.store.token = token
+	return nil
+}
+
+func (d *replicatedDriver) ReadToken(ctx context.Context) (string, time.Time, error) {
+	d.reads++
+	if d.delay < 0 || d.reads <= d.delay {
+		return "stale", time.Time{}, nil
+	}
+	d.store.mu.Lock()
+	defer d.store.mu.Unlock()
+	return d.store.token, time.Now(), nil
+}
+
+func TestNewReplicas(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name     string
+		hosts    []string
+		replicas []string
+		primary  string
+		expected string
+	}{
+		{"with hosts", []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"}, nil, "[192.168.0.1]", "[192.168.0.2 192.168.0.3]"},
+		{"with replica hosts", []string{"192.168.0.1"}, []string{"192.168.0.2"}, "[192.168.0.1]", "[192.168.0.2]"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testJobConfig("replication")
+			config.QueryType = QUERY_TYPE_REPLICATION
+			config.Host = ""
+			config.Hosts = tc.hosts
+			config.ReplicaHosts = tc.replicas
+
+			config, replicas, err := newReplicas(config, slog.Default())
+			if err != nil {
+				t.Fatalf("could not create replicas: %v", err)
+			}
+
+			var hosts []string
+			for _, r := range replicas {
+				hosts = append(hosts, r.host)
+			}
+			if got := fmt.Sprint(config.Hosts); got != tc.primary {
+				t.Errorf("got primary %s, expect %s", got, tc.primary)
+			}
+			if got := fmt.Sprint(hosts); got != tc.expected {
+				t.Errorf("got replicas %s, expect %s", got, tc.expected)
+			}
+		})
+	}
+
+	t.Run("without replica", func(t *testing.T) {
+		config := testJobConfig("replication")
+		config.Hosts = []string{"192.168.0.1"}
+		if _, _, err := newReplicas(config, slog.Default()); err == nil {
+			t.Error("expected error without replica")
+		}
+	})
+
+	t.Run("with unsupported driver", func(t *testing.T) {
+		config := testJobConfig("replication")
+		config.Type = JOB_TYPE_KAFKA
+		config.Topic = "canary_ng"
+		config.Hosts = []string{"192.168.0.1", "192.168.0.2"}
+		if _, _, err := newReplicas(config, slog.Default()); err == nil {
+			t.Error("expected error for a driver without replication support")
+		}
+	})
+}
+
+func TestMeasureReplication(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	store := &tokenStore{}
+	j := &Job{
+		config: JobConfig{Name: "test", QueryType: QUERY_TYPE_REPLICATION, Timeout: 1},
+		driver: &replicatedDriver{store: store},
+		replicas: []*replica{
+			{host: "replica1", driver: &replicatedDriver{store: store, delay: 3}},
+			{host: "replica2", driver: &replicatedDriver{store: store, delay: -1}},
+		},
+		metrics:     testMetrics(),
+		labels:      prometheus.Labels{"job_name": "test"},
+		queryLabels: QueryLabelsConfig{Name: "query"},
+		logger:      slog.With("job", "test"),
+	}
+
+	if err := j.Measure(context.Background()); err == nil {
+		t.Error("expected error for a replica never returning the token")
+	}
+
+	if got := testutil.CollectAndCount(j.metrics.replication); got != 1 {
+		t.Errorf("got %d replication series, expect 1", got)
+	}
+	failure := prometheus.Labels{"job_name": "test", "phase": QUERY_TYPE_READ, "reason": driver.REASON_TIMEOUT}
+	if got := testutil.ToFloat64(j.metrics.failures.With(failure)); got != 1 {
+		t.Errorf("got %v failures, expect 1", got)
+	}
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ovh/canary-ng/discover"
+)
+
+// Sharder splits the discovered hosts between several instances so each host
+// is measured by a single one. Hosts are assigned with rendezvous hashing: a
+// host belongs to the member scoring the highest for it, so when a member
+// leaves only its hosts move to the others, and when one joins it only takes
+// hosts from the others. Members are either the shard indexes of a static
+// count, or the peers returned by a discovery.
+type Sharder struct {
+	self     string
+	interval time.Duration
+	discover func() ([]discover.Target, error)
+	watch    func(ctx context.Context, updates chan<- []discover.Target) error
+	close    func()
+	relabels []*discover.Relabel
+
+	mu      sync.RWMutex
+	members []string
+	// Closed and replaced when the members change, to notify the discovery
+	// managers their hosts must be assigned again
+	changed chan struct{}
+}
+
+// NewSharder returns the sharder of a configuration, or nil when sharding is
+// disabled. With a peers discovery, peers are discovered once before
+// returning so hosts are not all assigned to this instance at startup, and an
+// error is returned when they cannot be.
+func NewSharder(config ShardingConfig) (*Sharder, error) {
+	if config.Count == 0 && config.PeersDiscovery.Type == "" {
+		return nil, nil
+	}
+
+	s := &Sharder{changed: make(chan struct{})}
+	if config.Count > 0 {
+		s.self = strconv.Itoa(config.Index)
+		for i := range config.Count {
+			s.members = append(s.members, strconv.Itoa(i))
+		}
+		return s, nil
+	}
+
+	dh, err := newDiscover(config.PeersDiscovery)
+	if err != nil {
+		return nil, err
+	}
+	s.relabels, err = newRelabels(config.PeersDiscovery)
+	if err != nil {
+		return nil, err
+	}
+	interval := config.PeersDiscovery.Interval
+	if interval == 0 {
+		interval = DISCOVERY_INTERVAL
+	}
+	s.self = config.Instance
+	s.interval = time.Duration(interval) * time.Second
+	s.discover = dh.Discover
+	if w, ok := dh.(discover.Watcher); ok {
+		s.watch = w.Watch
+	}
+	if c, ok := dh.(discover.Closer); ok {
+		s.close = c.Close
+	}
+
+	targets, err := s.discover()
+	if err != nil {
+		return nil, fmt.Errorf("could not discover peers: %w", err)
+	}
+	s.apply(targets)
+	return s, nil
+}
+
+// Run follows the peers until ctx is cancelled, on each change pushed by the
+// provider or on the discovery interval when it cannot watch or its watch
+// failed, then closes the provider. It returns immediately with a static
+// count.
+func (s *Sharder) Run(ctx context.Context) {
+	if s.discover == nil {
+		return
+	}
+	if s.close != nil {
+		defer s.close()
+	}
+
+	updates := make(chan []discover.Target)
+	watchErr := make(chan error, 1)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	tick := ticker.C
+	if s.watch != nil {
+		tick = nil
+		go func() {
+			if err := s.watch(ctx, updates); err != nil {
+				watchErr <- err
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			s.reconcile()
+		case targets := <-updates:
+			s.apply(targets)
+		case err := <-watchErr:
+			slog.Error("could not watch peers, polling instead", slog.Duration("interval", s.interval), slog.Any("error", err))
+			tick = ticker.C
+		}
+	}
+}
+
+// Discover the peers, keeping the current members on failure
+func (s *Sharder) reconcile() {
+	targets, err := s.discover()
+	if err != nil {
+		slog.Warn("could not discover peers", slog.Any("error", err))
+		return
+	}
+	s.apply(targets)
+}
+
+// Replace the members by the given peers. This instance is always a member, so
+// it keeps measuring its share of the hosts while it is not registered yet.
+func (s *Sharder) apply(targets []discover.Target) {
+	members := discover.Hosts(discover.ApplyRelabel(targets, s.relabels))
+	if !slices.Contains(members, s.self) {
+		slog.Warn("instance not found in peers", slog.String("instance", s.self))
+		members = append(members, s.self)
+	}
+	slices.Sort(members)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Equal(members, s.members) {
+		return
+	}
+	slog.Info("shard members changed", slog.Any("members", members))
+	s.members = members
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Filter returns the targets assigned to this instance, along with a channel
+// closed once the members they were assigned with change
+func (s *Sharder) Filter(targets []discover.Target) ([]discover.Target, <-chan struct{}) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	owned := make([]discover.Target, 0, len(targets))
+	for _, t := range targets {
+		if owner(s.members, t.Host) == s.self {
+			owned = append(owned, t)
+		}
+	}
+	return owned, s.changed
+}
+
+// Return the member scoring the highest for a host
+func owner(members []string, host string) (best string) {
+	var bestScore uint64
+	for _, member := range members {
+		sum := sha256.Sum256([]byte(member + "\x00" + host))
+		score := binary.BigEndian.Uint64(sum[:8])
+		if best == "" || score > bestScore {
+			best, bestScore = member, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ovh/canary-ng/discover"
+)
+
+func testTargets(n int) []discover.Target {
+	hosts := make([]string, 0, n)
+	for i := range n {
+		hosts = append(hosts, fmt.Sprintf("192.168.0.%d:5432", i))
+	}
+	return discover.Targets(hosts)
+}
+
+func TestSharderFilter(t *testing.T) {
+	targets := testTargets(100)
+
+	// Every host is assigned to exactly one shard
+	owners := map[string]int{}
+	for index := range 3 {
+		s, err := NewSharder(ShardingConfig{Index: index, Count: 3})
+		if err != nil {
+			t.Fatalf("could not create sharder: %v", err)
+		}
+		owned, _ := s.Filter(targets)
+		if len(owned) == 0 {
+			t.Errorf("got no host for shard %d, expect some", index)
+		}
+		for _, target := range owned {
+			owners[target.Host]++
+		}
+	}
+	for _, target := range targets {
+		if owners[target.Host] != 1 {
+			t.Errorf("got %s assigned %d times, expect once", target.Host, owners[target.Host])
+		}
+	}
+
+	// Only the hosts of a member leaving are assigned again
+	for _, target := range targets {
+		before := owner([]string{"a", "b", "c"}, target.Host)
+		after := owner([]string{"a", "b"}, target.Host)
+		if before != "c" && before != after {
+			t.Errorf("got %s moved from %s to %s, expect it kept", target.Host, before, after)
+		}
+	}
+}
+
+func TestSharderPeers(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	file := filepath.Join(t.TempDir(), "peers.json")
+	writePeers := func(peers string) {
+		if err := os.WriteFile(file, []byte(`[{"targets": [`+peers+`]}]`), 0o600); err != nil {
+			t.Fatalf("could not write peers: %v", err)
+		}
+	}
+	writePeers(`"10.0.0.1:8080", "10.0.0.2:8080"`)
+
+	s, err := NewSharder(ShardingConfig{
+		Instance:       "10.0.0.1:8080",
+		PeersDiscovery: DiscoveryConfig{Type: DISCOVER_TYPE_FILE, Files: []string{file}},
+	})
+	if err != nil {
+		t.Fatalf("could not create sharder: %v", err)
+	}
+
+	targets := testTargets(100)
+	owned, changed := s.Filter(targets)
+	if len(owned) == 0 || len(owned) == len(targets) {
+		t.Errorf("got %d hosts assigned out of %d, expect a share", len(owned), len(targets))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	// The instance takes every host once its peer leaves
+	writePeers(`"10.0.0.1:8080"`)
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("members did not change after the peer left")
+	}
+	if owned, _ = s.Filter(targets); len(owned) != len(targets) {
+		t.Errorf("got %d hosts assigned, expect %d", len(owned), len(targets))
+	}
+}
+
+func TestDiscoveryManagerSharding(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	hosts := discover.Hosts(testTargets(10))
+	s := newTestDiscoveryManager(func() ([]string, error) { return hosts, nil })
+	sharder, err := NewSharder(ShardingConfig{Index: 1, Count: 2})
+	if err != nil {
+		t.Fatalf("could not create sharder: %v", err)
+	}
+	s.sharder = sharder
+	defer s.stopAll()
+
+	s.reconcile(context.Background())
+
+	owned, _ := sharder.Filter(testTargets(10))
+	expected := discover.Hosts(owned)
+	if got := runningKeys(s); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got %v, expect %v", got, expected)
+	}
+}
+
+func TestSharderFirstDiscoveryFails(t *testing.T) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	file := filepath.Join(t.TempDir(), "peers.json")
+	if err := os.WriteFile(file, []byte(`invalid`), 0o600); err != nil {
+		t.Fatalf("could not write peers: %v", err)
+	}
+
+	// Claiming every host would measure them twice along with the peers
+	_, err := NewSharder(ShardingConfig{
+		Instance:       "10.0.0.1:8080",
+		PeersDiscovery: DiscoveryConfig{Type: DISCOVER_TYPE_FILE, Files: []string{file}},
+	})
+	if err == nil {
+		t.Error("expected an error when peers cannot be discovered")
+	}
+}
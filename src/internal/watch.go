@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchFile sends on changed whenever the content of file changes, until ctx
+// is cancelled. The parent directory is watched instead of the file itself so
+// replacements through a rename, as done by editors or Kubernetes ConfigMaps,
+// are still followed. Notifications are coalesced when changed is full.
+func WatchFile(ctx context.Context, file string, changed chan<- struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	content, _ := os.ReadFile(file)
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("could not watch file", slog.String("file", file), slog.Any("error", err))
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				buf, err := os.ReadFile(file)
+				if err != nil || bytes.Equal(buf, content) {
+					continue
+				}
+				content = buf
+				slog.Debug("file changed", slog.String("file", file))
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return nil
+}